@@ -21,6 +21,11 @@ type StorageClusterSpec struct {
 	// External Storage is optional and defaults to false. When set to true, OCS will
 	// connect to an external OCS Storage Cluster instead of provisioning one locally.
 	ExternalStorage ExternalStorageClusterSpec `json:"externalStorage,omitempty"`
+	// FlexibleScaling spreads the replicas across hosts instead of racks or
+	// zones, so that the storage nodes can be added one at a time. It makes
+	// host the preferred failure domain unless NodeTopologies prefers one.
+	// +optional
+	FlexibleScaling bool `json:"flexibleScaling,omitempty"`
 	// HostNetwork defaults to false
 	HostNetwork bool `json:"hostNetwork,omitempty"`
 	// Placement is optional and used to specify placements of OCS components explicitly
@@ -32,8 +37,239 @@ type StorageClusterSpec struct {
 	MonDataDirHostPath string                                 `json:"monDataDirHostPath,omitempty"`
 	// Version specifies the version of StorageCluster
 	Version string `json:"version,omitempty"`
+	// NodeTopologies is optional and used to tune how the operator
+	// determines and manages the topology of the storage nodes
+	// +optional
+	NodeTopologies *NodeTopologySpec `json:"nodeTopologies,omitempty"`
 }
 
+// NodeTopologySpec defines how the operator determines and manages the
+// topology labels of the storage nodes
+type NodeTopologySpec struct {
+	// MaxRackCount is the maximum number of racks the operator will
+	// generate. Once it is reached, nodes are packed into the existing
+	// racks. Zero means no limit.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxRackCount int `json:"maxRackCount,omitempty"`
+
+	// MinRackCount is the minimum number of racks the operator will
+	// generate. It must not be lower than the number of replicas of the
+	// StorageDeviceSets, which is also its default.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MinRackCount int `json:"minRackCount,omitempty"`
+
+	// RackPrefix is the prefix of the names of the racks generated by the
+	// operator, which are numbered from 0. Racks already assigned to nodes
+	// are kept when it changes, but new nodes are only placed in the racks
+	// named after the current prefix. Racks named otherwise are managed by
+	// the admin. Defaults to "rack".
+	// +optional
+	RackPrefix string `json:"rackPrefix,omitempty"`
+
+	// MinRacksPerZone is the minimum number of racks the operator will
+	// generate in every zone to spread data within the zone. Every zone
+	// must have at least that many storage nodes. Zero means no minimum.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MinRacksPerZone int `json:"minRacksPerZone,omitempty"`
+
+	// NodePatchConcurrency is the number of nodes patched concurrently when
+	// labeling the storage nodes with racks. Defaults to 4.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	NodePatchConcurrency int `json:"nodePatchConcurrency,omitempty"`
+
+	// RackCapacityKey when set makes the operator place a new storage node in
+	// the rack with the least total capacity instead of the rack with the
+	// fewest nodes, still only among the racks of its zone. It is the name
+	// of a node label holding the capacity of the node as a quantity, e.g.
+	// ocs.openshift.io/storage-capacity, or of an allocatable node resource,
+	// e.g. ephemeral-storage or cpu. Nodes without that capacity count as
+	// having none.
+	// +optional
+	RackCapacityKey string `json:"rackCapacityKey,omitempty"`
+
+	// AnnotateCrushLocation when set makes the operator annotate every
+	// storage node with its computed CRUSH location
+	// +optional
+	AnnotateCrushLocation bool `json:"annotateCrushLocation,omitempty"`
+
+	// RemoveDeselectedNodeRacks when set makes the operator remove the rack
+	// label it applied to a node once the node is no longer a storage node.
+	// Rack labels set by an admin are kept.
+	// +optional
+	RemoveDeselectedNodeRacks bool `json:"removeDeselectedNodeRacks,omitempty"`
+
+	// PruneGracePeriod is how long a topology value must be absent from all
+	// storage nodes before it is pruned from the node topology map. Values
+	// are never pruned when it is not set, except for the racks which no
+	// longer hold any storage node, which are always pruned.
+	// +optional
+	PruneGracePeriod *metav1.Duration `json:"pruneGracePeriod,omitempty"`
+
+	// DryRunRackAssignment when set makes the operator log the rack labels
+	// it would apply to the storage nodes instead of applying them.
+	// +optional
+	DryRunRackAssignment bool `json:"dryRunRackAssignment,omitempty"`
+
+	// RebuildTopologyMap when set makes the operator rebuild the node
+	// topology map from the storage nodes on every reconcile. The values no
+	// longer found on any storage node are removed right away, ignoring the
+	// PruneGracePeriod.
+	// +optional
+	RebuildTopologyMap bool `json:"rebuildTopologyMap,omitempty"`
+
+	// AllowPartialZoneLabels when set allows some storage nodes to carry
+	// no zone label while others do. By default the StorageCluster is not
+	// reconciled until all or none of the storage nodes carry one.
+	// +optional
+	AllowPartialZoneLabels bool `json:"allowPartialZoneLabels,omitempty"`
+
+	// RequiredTopologyKeys is a list of node label keys that every storage
+	// node must carry. The StorageCluster is not reconciled while any
+	// storage node is missing one of them.
+	// +optional
+	RequiredTopologyKeys []string `json:"requiredTopologyKeys,omitempty"`
+
+	// AdditionalLabelKeys is a list of node label keys recognized as topology
+	// labels in addition to the built-in ones. Keys whose name after the
+	// last "/" ends with "zone" or "rack" are treated as zone or rack labels
+	// and may be picked as failure domain. An empty list preserves the
+	// built-in topology labels only.
+	// +optional
+	AdditionalLabelKeys []string `json:"additionalLabelKeys,omitempty"`
+
+	// IncludeNotReadyNodes when set makes the operator count the selected
+	// nodes which are unschedulable or NotReady as storage nodes. They are
+	// left out by default.
+	// +optional
+	IncludeNotReadyNodes bool `json:"includeNotReadyNodes,omitempty"`
+
+	// LabelSelectors are additional label selectors of the storage nodes.
+	// The nodes matching any of them or the LabelSelector of the
+	// StorageCluster are selected. When set without a LabelSelector, the
+	// default storage node label is not used.
+	// +optional
+	LabelSelectors []*metav1.LabelSelector `json:"labelSelectors,omitempty"`
+
+	// FieldSelector restricts the storage nodes to the selected nodes also
+	// matching this node field selector, e.g. "metadata.name!=worker-0".
+	// Only the metadata.name and spec.unschedulable fields are supported.
+	// +optional
+	FieldSelector string `json:"fieldSelector,omitempty"`
+
+	// Mode controls how much of the node topology the operator manages.
+	// Auto (the default) lets the operator label the nodes and determine the
+	// failure domain. Hybrid only fills in what is missing and never
+	// overrides existing node labels or annotations. Manual leaves node
+	// labels and the failure domain to the admin, the operator only reads
+	// them.
+	// +kubebuilder:validation:Enum=Auto;Manual;Hybrid
+	// +optional
+	Mode TopologyMode `json:"mode,omitempty"`
+
+	// ExpansionStabilityWindow is how long the node topology must be
+	// unchanged before the storage capacity may be expanded. Expansion is
+	// never postponed when it is not set.
+	// +optional
+	ExpansionStabilityWindow *metav1.Duration `json:"expansionStabilityWindow,omitempty"`
+
+	// DiscoverFromProviderID when set makes the operator label the storage
+	// nodes missing zone or region labels with the zone and region encoded
+	// in their spec.providerID, on the cloud platforms where it is encoded
+	// (AWS and GCP)
+	// +optional
+	DiscoverFromProviderID bool `json:"discoverFromProviderID,omitempty"`
+
+	// FailureDomainWeights sets the priority of the "datacenter", "zone"
+	// and "rack" failure domains. The failure domain with the highest weight
+	// which the storage nodes can provide is used. Defaults to 3 for
+	// datacenter, 2 for zone and 1 for rack.
+	// +optional
+	FailureDomainWeights map[string]int `json:"failureDomainWeights,omitempty"`
+
+	// FailureDomainAlias maps a failure domain type among "host", "rack",
+	// "zone" and "datacenter" to the CRUSH bucket type used for it by the
+	// Ceph pools and the CRUSH locations of the nodes, e.g. zone to room.
+	// The failure domain values are still read from the node labels of the
+	// failure domain type.
+	// +optional
+	FailureDomainAlias map[string]string `json:"failureDomainAlias,omitempty"`
+
+	// AllowFailureDomainPromotion when set lets the operator switch the
+	// failure domain of the StorageCluster to one with a higher weight when
+	// new topology labels make it available
+	// +optional
+	AllowFailureDomainPromotion bool `json:"allowFailureDomainPromotion,omitempty"`
+
+	// FailureDomain is the requested failure domain. It is used whenever the
+	// storage nodes can provide it, otherwise the operator falls back to
+	// another failure domain.
+	// +kubebuilder:validation:Enum=datacenter;zone;rack
+	// +optional
+	FailureDomain string `json:"failureDomain,omitempty"`
+
+	// PreferredFailureDomain is the failure domain to use regardless of the
+	// other failure domains the storage nodes provide. Unlike FailureDomain,
+	// it has no fallback. The StorageCluster is not reconciled until the
+	// storage nodes provide enough buckets of that failure domain.
+	// +kubebuilder:validation:Enum=host;rack;zone
+	// +optional
+	PreferredFailureDomain string `json:"preferredFailureDomain,omitempty"`
+
+	// PreferredZoneKey is the node label used to detect the zones of the
+	// storage nodes, e.g. when the nodes carry a vendor zone label besides
+	// the well-known ones. When unset, topology.kubernetes.io/zone is
+	// preferred over the deprecated failure-domain.beta.kubernetes.io/zone,
+	// and then the first zone label in lexical order.
+	// +optional
+	PreferredZoneKey string `json:"preferredZoneKey,omitempty"`
+
+	// MinimumNodes overrides the minimum number of storage nodes, keyed by
+	// failure domain type among "host", "rack", "zone" and "datacenter". The
+	// override of the failure domain of the StorageCluster applies, or the
+	// one of its preferred failure domain until the failure domain is
+	// determined. It can not lower the minimum the failure domain requires,
+	// e.g. a node in each of the racks generated for a rack failure domain.
+	// +optional
+	MinimumNodes map[string]int `json:"minimumNodes,omitempty"`
+
+	// AutoRebalanceRacks when set makes the operator move storage nodes
+	// between the racks it generated in the same zone when the largest rack
+	// holds more than RackRebalanceRatio times the nodes of the smallest
+	// one. Moving nodes relocates their data.
+	// +optional
+	AutoRebalanceRacks bool `json:"autoRebalanceRacks,omitempty"`
+
+	// RackRebalanceRatio is the ratio between the node counts of the
+	// largest and the smallest racks of a zone above which they are
+	// rebalanced. Defaults to 2.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	RackRebalanceRatio int `json:"rackRebalanceRatio,omitempty"`
+
+	// PersistRackAssignments when set makes the operator record the rack of
+	// every storage node in the status, and label a known node which lost
+	// its rack label, e.g. after being reprovisioned, with its previous rack
+	// +optional
+	PersistRackAssignments bool `json:"persistRackAssignments,omitempty"`
+}
+
+// TopologyMode defines how the operator manages the node topology
+type TopologyMode string
+
+const (
+	// TopologyModeAuto lets the operator fully manage the node topology
+	TopologyModeAuto TopologyMode = "Auto"
+	// TopologyModeManual makes the operator only read the node topology
+	TopologyModeManual TopologyMode = "Manual"
+	// TopologyModeHybrid lets the operator fill in the missing node topology
+	// without overriding what is already set
+	TopologyModeHybrid TopologyMode = "Hybrid"
+)
+
 // ExternalStorageClusterSpec defines the spec of the external Storage Cluster
 // to be connected to the local cluster
 type ExternalStorageClusterSpec struct {
@@ -117,8 +353,110 @@ type StorageClusterStatus struct {
 	CephBlockPoolsCreated       bool `json:"cephBlockPoolsCreated,omitempty"`
 	CephObjectStoreUsersCreated bool `json:"cephObjectStoreUsersCreated,omitempty"`
 	CephFilesystemsCreated      bool `json:"cephFilesystemsCreated,omitempty"`
+
+	// NodeLabelSelector is the effective label selector used to determine
+	// the nodes that belong to the StorageCluster
+	// +optional
+	NodeLabelSelector string `json:"nodeLabelSelector,omitempty"`
+
+	// FailureDomainSpreadFactor is the number of distinct values of the
+	// failure domain divided by the replica count, formatted with two
+	// decimals. A value of at least 1.00 means every replica can be placed
+	// in its own failure domain.
+	// +optional
+	FailureDomainSpreadFactor string `json:"failureDomainSpreadFactor,omitempty"`
+
+	// TopologyValuesLastSeen records when topology values that are no
+	// longer found on any storage node were last seen, keyed by
+	// "<label>=<value>"
+	// +optional
+	TopologyValuesLastSeen map[string]metav1.Time `json:"topologyValuesLastSeen,omitempty"`
+
+	// TopologyPhase summarizes the health of the node topology
+	// +optional
+	TopologyPhase TopologyPhase `json:"topologyPhase,omitempty"`
+
+	// TopologySummary is a human readable explanation of the TopologyPhase
+	// +optional
+	TopologySummary string `json:"topologySummary,omitempty"`
+
+	// TopologyHash is a hash of the node topology map
+	// +optional
+	TopologyHash string `json:"topologyHash,omitempty"`
+
+	// TopologyLastChangeTime is the last time the TopologyHash changed
+	// +optional
+	TopologyLastChangeTime *metav1.Time `json:"topologyLastChangeTime,omitempty"`
+
+	// TopologyStableReconciles is the number of consecutive reconciles
+	// which found the same TopologyHash, up to the convergence threshold
+	// +optional
+	TopologyStableReconciles int `json:"topologyStableReconciles,omitempty"`
+
+	// RequestedFailureDomain is the failure domain requested in the spec
+	// +optional
+	RequestedFailureDomain string `json:"requestedFailureDomain,omitempty"`
+
+	// FailureDomainReason explains why the FailureDomain is used
+	// +optional
+	FailureDomainReason string `json:"failureDomainReason,omitempty"`
+
+	// ParentFailureDomain is the failure domain type above FailureDomain in
+	// the CRUSH hierarchy. It is only set to region when the zone failure
+	// domain spans at least two regions.
+	// +optional
+	ParentFailureDomain string `json:"parentFailureDomain,omitempty"`
+
+	// Topology is a consistent view of the node topology and the failure
+	// domain derived from it
+	// +optional
+	Topology *TopologyStatus `json:"topology,omitempty"`
+
+	// NodeRacks is the rack of every storage node, keyed by node name. It
+	// is only recorded when PersistRackAssignments is set.
+	// +optional
+	NodeRacks map[string]string `json:"nodeRacks,omitempty"`
 }
 
+// TopologyStatus describes the node topology and the failure domain derived
+// from it
+type TopologyStatus struct {
+	// FailureDomain is the failure domain derived from the node topology
+	// +optional
+	FailureDomain string `json:"failureDomain,omitempty"`
+
+	// Keys is the sorted list of discovered topology label keys
+	// +optional
+	Keys []string `json:"keys,omitempty"`
+
+	// ValueCounts is the number of distinct values of each topology label key
+	// +optional
+	ValueCounts map[string]int `json:"valueCounts,omitempty"`
+
+	// Domains is a map of failure domain values to the names of the storage
+	// nodes in them
+	// +optional
+	Domains map[string][]string `json:"domains,omitempty"`
+}
+
+// TopologyPhase summarizes the health of the node topology
+type TopologyPhase string
+
+const (
+	// TopologyPhaseHealthy means the storage nodes are evenly spread over
+	// enough failure domains
+	TopologyPhaseHealthy TopologyPhase = "Healthy"
+	// TopologyPhaseDegraded means the storage nodes are unevenly spread over
+	// the failure domains
+	TopologyPhaseDegraded TopologyPhase = "Degraded"
+	// TopologyPhaseInsufficient means there are not enough storage nodes or
+	// failure domains to place all the replicas
+	TopologyPhaseInsufficient TopologyPhase = "Insufficient"
+	// TopologyPhaseMisconfigured means the topology labels of the storage
+	// nodes are invalid
+	TopologyPhaseMisconfigured TopologyPhase = "Misconfigured"
+)
+
 // TopologyLabelValues is a list of values for a topology label
 type TopologyLabelValues []string
 
@@ -145,6 +483,37 @@ const (
 	// ConditionExternalClusterConnecting type indicates that rook is still trying for
 	// an external connection
 	ConditionExternalClusterConnecting conditionsv1.ConditionType = "ExternalClusterConnecting"
+
+	// ConditionTopologyValid type indicates whether the topology labels
+	// of the storage nodes form a valid CRUSH hierarchy
+	ConditionTopologyValid conditionsv1.ConditionType = "TopologyValid"
+
+	// ConditionTopologyRebalancing type indicates whether a change of the
+	// node topology may make Ceph rebalance the data across the OSDs
+	ConditionTopologyRebalancing conditionsv1.ConditionType = "TopologyRebalancing"
+
+	// ConditionSingleFailureDomain type indicates whether all the storage
+	// nodes share a single zone and rack, leaving the node as the only
+	// failure domain
+	ConditionSingleFailureDomain conditionsv1.ConditionType = "SingleFailureDomain"
+
+	// ConditionFailureDomainFallback type indicates whether the rack failure
+	// domain is used although the storage nodes have zone labels
+	ConditionFailureDomainFallback conditionsv1.ConditionType = "FailureDomainFallback"
+
+	// ConditionTopologyConverged type indicates whether several consecutive
+	// reconciles found the same node topology
+	ConditionTopologyConverged conditionsv1.ConditionType = "TopologyConverged"
+
+	// ConditionFailureDomainStranded type indicates whether the selected
+	// nodes which are excluded from storage, cordoned, NotReady or tainted
+	// leave too few values of the failure domain for the replicas
+	ConditionFailureDomainStranded conditionsv1.ConditionType = "FailureDomainStranded"
+
+	// ConditionTopologyReady type indicates whether the node topology was
+	// reconciled, or why it is not, e.g. too few storage nodes or a failure
+	// to label the nodes with racks
+	ConditionTopologyReady conditionsv1.ConditionType = "TopologyReady"
 )
 
 // List of constants to show different different reconciliation messages and statuses.
@@ -1,6 +1,7 @@
 package v1
 
 import (
+	"sort"
 	"strings"
 )
 
@@ -35,18 +36,76 @@ func (m *NodeTopologyMap) Add(topologyKey string, value string) {
 	m.Labels[topologyKey] = append(m.Labels[topologyKey], value)
 }
 
-// GetKeyValues returns a node label matching the topologyKey and all values
-// for that label across all storage nodes
-func (m *NodeTopologyMap) GetKeyValues(topologyKey string) (string, []string) {
+// RemoveDuplicates removes the values found more than once under the same key
+// of the NodeTopologyMap, keeping their first occurrence. It returns the
+// removed duplicates by key.
+func (m *NodeTopologyMap) RemoveDuplicates() map[string][]string {
+	duplicates := map[string][]string{}
+
+	for topologyKey, values := range m.Labels {
+		seen := map[string]bool{}
+		unique := TopologyLabelValues{}
+		for _, value := range values {
+			if seen[value] {
+				duplicates[topologyKey] = append(duplicates[topologyKey], value)
+				continue
+			}
+			seen[value] = true
+			unique = append(unique, value)
+		}
+		if _, ok := duplicates[topologyKey]; ok {
+			m.Labels[topologyKey] = unique
+		}
+	}
+
+	return duplicates
+}
+
+// topologyLabelDomains are the domains of the well-known topology labels, in
+// the order GetKeyValues prefers them when several labels match
+var topologyLabelDomains = []string{"topology.kubernetes.io/", "failure-domain.beta.kubernetes.io/"}
+
+// GetKeyValues returns a node label matching the topologyKey, see
+// IsTopologyLabelOf, and all values for that label across all storage
+// nodes. The first of the preferredLabels found in the map is returned if
+// any. Otherwise, when several labels match, the current and then the
+// deprecated well-known topology label is preferred, and then the first one
+// in lexical order. The values are returned sorted.
+func (m *NodeTopologyMap) GetKeyValues(topologyKey string, preferredLabels ...string) (string, []string) {
 	values := []string{}
 
-	for label, labelValues := range m.Labels {
-		if strings.Contains(label, topologyKey) {
-			topologyKey = label
-			values = labelValues
-			break
+	candidates := append([]string{}, preferredLabels...)
+	for _, domain := range topologyLabelDomains {
+		candidates = append(candidates, domain+topologyKey)
+	}
+	for _, label := range candidates {
+		if _, ok := m.Labels[label]; ok {
+			values = append(values, m.Labels[label]...)
+			sort.Strings(values)
+			return label, values
+		}
+	}
+
+	labels := []string{}
+	for label := range m.Labels {
+		if IsTopologyLabelOf(label, topologyKey) {
+			labels = append(labels, label)
 		}
 	}
+	if len(labels) > 0 {
+		sort.Strings(labels)
+		topologyKey = labels[0]
+		values = append(values, m.Labels[topologyKey]...)
+		sort.Strings(values)
+	}
 
 	return topologyKey, values
 }
+
+// IsTopologyLabelOf returns true if the label is the topologyKey itself, or
+// if the name of the label after its last "/" ends with the topologyKey,
+// e.g. a topology type. "topology.rook.io/rack" and "acme.io/powerzone" are
+// rack and zone labels, "myapp.io/brackets" and "acme.io/dezoned" are not.
+func IsTopologyLabelOf(label, topologyKey string) bool {
+	return label == topologyKey || strings.HasSuffix(label[strings.LastIndex(label, "/")+1:], topologyKey)
+}
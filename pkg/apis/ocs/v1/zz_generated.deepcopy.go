@@ -59,6 +59,74 @@ func (in *NodeTopologyMap) DeepCopy() *NodeTopologyMap {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeTopologySpec) DeepCopyInto(out *NodeTopologySpec) {
+	*out = *in
+	if in.PruneGracePeriod != nil {
+		in, out := &in.PruneGracePeriod, &out.PruneGracePeriod
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.RequiredTopologyKeys != nil {
+		in, out := &in.RequiredTopologyKeys, &out.RequiredTopologyKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AdditionalLabelKeys != nil {
+		in, out := &in.AdditionalLabelKeys, &out.AdditionalLabelKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.LabelSelectors != nil {
+		in, out := &in.LabelSelectors, &out.LabelSelectors
+		*out = make([]*metav1.LabelSelector, len(*in))
+		for i := range *in {
+			if (*in)[i] != nil {
+				in, out := &(*in)[i], &(*out)[i]
+				*out = new(metav1.LabelSelector)
+				(*in).DeepCopyInto(*out)
+			}
+		}
+	}
+	if in.ExpansionStabilityWindow != nil {
+		in, out := &in.ExpansionStabilityWindow, &out.ExpansionStabilityWindow
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.FailureDomainWeights != nil {
+		in, out := &in.FailureDomainWeights, &out.FailureDomainWeights
+		*out = make(map[string]int, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.FailureDomainAlias != nil {
+		in, out := &in.FailureDomainAlias, &out.FailureDomainAlias
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.MinimumNodes != nil {
+		in, out := &in.MinimumNodes, &out.MinimumNodes
+		*out = make(map[string]int, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeTopologySpec.
+func (in *NodeTopologySpec) DeepCopy() *NodeTopologySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeTopologySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *OCSInitialization) DeepCopyInto(out *OCSInitialization) {
 	*out = *in
@@ -353,6 +421,11 @@ func (in *StorageClusterSpec) DeepCopyInto(out *StorageClusterSpec) {
 		*out = new(corev1.PersistentVolumeClaim)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.NodeTopologies != nil {
+		in, out := &in.NodeTopologies, &out.NodeTopologies
+		*out = new(NodeTopologySpec)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -386,6 +459,29 @@ func (in *StorageClusterStatus) DeepCopyInto(out *StorageClusterStatus) {
 		*out = new(NodeTopologyMap)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.TopologyValuesLastSeen != nil {
+		in, out := &in.TopologyValuesLastSeen, &out.TopologyValuesLastSeen
+		*out = make(map[string]metav1.Time, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.TopologyLastChangeTime != nil {
+		in, out := &in.TopologyLastChangeTime, &out.TopologyLastChangeTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Topology != nil {
+		in, out := &in.Topology, &out.Topology
+		*out = new(TopologyStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.NodeRacks != nil {
+		in, out := &in.NodeRacks, &out.NodeRacks
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 	return
 }
 
@@ -454,3 +550,46 @@ func (in TopologyLabelValues) DeepCopy() TopologyLabelValues {
 	in.DeepCopyInto(out)
 	return *out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TopologyStatus) DeepCopyInto(out *TopologyStatus) {
+	*out = *in
+	if in.Keys != nil {
+		in, out := &in.Keys, &out.Keys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ValueCounts != nil {
+		in, out := &in.ValueCounts, &out.ValueCounts
+		*out = make(map[string]int, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Domains != nil {
+		in, out := &in.Domains, &out.Domains
+		*out = make(map[string][]string, len(*in))
+		for key, val := range *in {
+			var outVal []string
+			if val == nil {
+				(*out)[key] = nil
+			} else {
+				in, out := &val, &outVal
+				*out = make([]string, len(*in))
+				copy(*out, *in)
+			}
+			(*out)[key] = outVal
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TopologyStatus.
+func (in *TopologyStatus) DeepCopy() *TopologyStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(TopologyStatus)
+	in.DeepCopyInto(out)
+	return out
+}
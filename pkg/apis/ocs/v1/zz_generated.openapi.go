@@ -343,10 +343,114 @@ func schema_pkg_apis_ocs_v1_StorageClusterStatus(ref common.ReferenceCallback) c
 							Format: "",
 						},
 					},
+					"nodeLabelSelector": {
+						SchemaProps: spec.SchemaProps{
+							Description: "NodeLabelSelector is the effective label selector used to determine the nodes that belong to the StorageCluster",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"failureDomainSpreadFactor": {
+						SchemaProps: spec.SchemaProps{
+							Description: "FailureDomainSpreadFactor is the number of distinct values of the failure domain divided by the replica count, formatted with two decimals. A value of at least 1.00 means every replica can be placed in its own failure domain.",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"topologyValuesLastSeen": {
+						SchemaProps: spec.SchemaProps{
+							Description: "TopologyValuesLastSeen records when topology values that are no longer found on any storage node were last seen, keyed by \"<label>=<value>\"",
+							Type:        []string{"object"},
+							AdditionalProperties: &spec.SchemaOrBool{
+								Allows: true,
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.Time"),
+									},
+								},
+							},
+						},
+					},
+					"topologyPhase": {
+						SchemaProps: spec.SchemaProps{
+							Description: "TopologyPhase summarizes the health of the node topology",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"topologySummary": {
+						SchemaProps: spec.SchemaProps{
+							Description: "TopologySummary is a human readable explanation of the TopologyPhase",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"topologyHash": {
+						SchemaProps: spec.SchemaProps{
+							Description: "TopologyHash is a hash of the node topology map",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"topologyLastChangeTime": {
+						SchemaProps: spec.SchemaProps{
+							Description: "TopologyLastChangeTime is the last time the TopologyHash changed",
+							Ref:         ref("k8s.io/apimachinery/pkg/apis/meta/v1.Time"),
+						},
+					},
+					"topologyStableReconciles": {
+						SchemaProps: spec.SchemaProps{
+							Description: "TopologyStableReconciles is the number of consecutive reconciles which found the same TopologyHash, up to the convergence threshold",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+					"requestedFailureDomain": {
+						SchemaProps: spec.SchemaProps{
+							Description: "RequestedFailureDomain is the failure domain requested in the spec",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"failureDomainReason": {
+						SchemaProps: spec.SchemaProps{
+							Description: "FailureDomainReason explains why the FailureDomain is used",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"parentFailureDomain": {
+						SchemaProps: spec.SchemaProps{
+							Description: "ParentFailureDomain is the failure domain type above FailureDomain in the CRUSH hierarchy. It is only set to region when the zone failure domain spans at least two regions.",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"topology": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Topology is a consistent view of the node topology and the failure domain derived from it",
+							Ref:         ref("github.com/openshift/ocs-operator/pkg/apis/ocs/v1.TopologyStatus"),
+						},
+					},
+					"nodeRacks": {
+						SchemaProps: spec.SchemaProps{
+							Description: "NodeRacks is the rack of every storage node, keyed by node name. It is only recorded when PersistRackAssignments is set.",
+							Type:        []string{"object"},
+							AdditionalProperties: &spec.SchemaOrBool{
+								Allows: true,
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Type:   []string{"string"},
+										Format: "",
+									},
+								},
+							},
+						},
+					},
 				},
 			},
 		},
 		Dependencies: []string{
-			"github.com/openshift/custom-resource-status/conditions/v1.Condition", "github.com/openshift/ocs-operator/pkg/apis/ocs/v1.NodeTopologyMap", "k8s.io/api/core/v1.ObjectReference"},
+			"github.com/openshift/custom-resource-status/conditions/v1.Condition", "github.com/openshift/ocs-operator/pkg/apis/ocs/v1.NodeTopologyMap", "github.com/openshift/ocs-operator/pkg/apis/ocs/v1.TopologyStatus", "k8s.io/api/core/v1.ObjectReference", "k8s.io/apimachinery/pkg/apis/meta/v1.Time"},
 	}
 }
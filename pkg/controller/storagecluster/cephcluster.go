@@ -8,6 +8,7 @@ import (
 	"strconv"
 
 	"github.com/go-logr/logr"
+	conditionsv1 "github.com/openshift/custom-resource-status/conditions/v1"
 	objectreferencesv1 "github.com/openshift/custom-resource-status/objectreferences/v1"
 	ocsv1 "github.com/openshift/ocs-operator/pkg/apis/ocs/v1"
 	"github.com/openshift/ocs-operator/pkg/controller/defaults"
@@ -93,6 +94,24 @@ func (r *ReconcileStorageCluster) ensureCephCluster(sc *ocsv1.StorageCluster, re
 				}
 			}
 		}
+		if r.phase == statusutil.PhaseClusterExpanding && sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.ExpansionStabilityWindow != nil {
+			window := sc.Spec.NodeTopologies.ExpansionStabilityWindow.Duration
+			if delay := getTopologyStabilityDelay(sc, window); delay > 0 {
+				// waiting for the topology to settle is expected, it is not
+				// a failure of the reconcile
+				r.phase = ""
+				message := fmt.Sprintf("Node topology changed at %v, postponing the storage expansion until it is unchanged for %v", sc.Status.TopologyLastChangeTime, window)
+				reqLogger.Info(message, "RequeueAfter", delay)
+				r.conditions = append(r.conditions, conditionsv1.Condition{
+					Type:    conditionsv1.ConditionProgressing,
+					Status:  corev1.ConditionTrue,
+					Reason:  "WaitingForTopologyStability",
+					Message: message,
+				})
+				r.requeueAfter = delay
+				return nil
+			}
+		}
 		found.Spec = cephCluster.Spec
 		return r.client.Update(context.TODO(), found)
 	}
@@ -296,8 +315,11 @@ func newStorageClassDeviceSets(sc *ocsv1.StorageCluster) []rook.StorageClassDevi
 			if topologyKey == "" {
 				topologyKey = determineFailureDomain(sc)
 			}
-			if topologyMap != nil {
-				topologyKey, topologyKeyValues = topologyMap.GetKeyValues(topologyKey)
+			// host buckets are not tracked in the node topology map
+			if topologyKey == "host" {
+				topologyKey = corev1.LabelHostname
+			} else if topologyMap != nil {
+				topologyKey, topologyKeyValues = getTopologyKeyValues(topologyMap, topologyKey, getPreferredZoneKey(sc))
 			}
 		}
 
@@ -338,13 +338,13 @@ func (r *ReconcileStorageCluster) newCephObjectStoreInstances(initData *ocsv1.St
 			Spec: cephv1.ObjectStoreSpec{
 				PreservePoolsOnDelete: false,
 				DataPool: cephv1.PoolSpec{
-					FailureDomain: initData.Status.FailureDomain,
+					FailureDomain: getCrushFailureDomain(initData, initData.Status.FailureDomain),
 					Replicated: cephv1.ReplicatedSpec{
 						Size: 3,
 					},
 				},
 				MetadataPool: cephv1.PoolSpec{
-					FailureDomain: initData.Status.FailureDomain,
+					FailureDomain: getCrushFailureDomain(initData, initData.Status.FailureDomain),
 					Replicated: cephv1.ReplicatedSpec{
 						Size: 3,
 					},
@@ -421,7 +421,7 @@ func (r *ReconcileStorageCluster) newCephBlockPoolInstances(initData *ocsv1.Stor
 				Namespace: initData.Namespace,
 			},
 			Spec: cephv1.PoolSpec{
-				FailureDomain: initData.Status.FailureDomain,
+				FailureDomain: getCrushFailureDomain(initData, initData.Status.FailureDomain),
 				Replicated: cephv1.ReplicatedSpec{
 					Size:            3,
 					TargetSizeRatio: .49,
@@ -569,7 +569,7 @@ func (r *ReconcileStorageCluster) newCephFilesystemInstances(initData *ocsv1.Sto
 					Replicated: cephv1.ReplicatedSpec{
 						Size: 3,
 					},
-					FailureDomain: initData.Status.FailureDomain,
+					FailureDomain: getCrushFailureDomain(initData, initData.Status.FailureDomain),
 				},
 				DataPools: []cephv1.PoolSpec{
 					cephv1.PoolSpec{
@@ -577,7 +577,7 @@ func (r *ReconcileStorageCluster) newCephFilesystemInstances(initData *ocsv1.Sto
 							Size:            3,
 							TargetSizeRatio: .49,
 						},
-						FailureDomain: initData.Status.FailureDomain,
+						FailureDomain: getCrushFailureDomain(initData, initData.Status.FailureDomain),
 					},
 				},
 				MetadataServer: cephv1.MetadataServerSpec{
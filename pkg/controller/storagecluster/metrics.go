@@ -0,0 +1,101 @@
+package storagecluster
+
+import (
+	"sort"
+	"sync"
+
+	ocsv1 "github.com/openshift/ocs-operator/pkg/apis/ocs/v1"
+	statusutil "github.com/openshift/ocs-operator/pkg/controller/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	failureDomainTypeGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ocs_storagecluster_failure_domain_type",
+			Help: "Failure domain type determined for the StorageCluster, 1 for the determined type and 0 for the others",
+		},
+		[]string{"namespace", "storagecluster", "type"},
+	)
+	failureDomainMembersGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ocs_storagecluster_failure_domain_members",
+			Help: "Number of storage nodes in each failure domain of the StorageCluster",
+		},
+		[]string{"namespace", "storagecluster", "failure_domain"},
+	)
+
+	// publishedFailureDomains holds the failure domain values last published
+	// for every StorageCluster, so that the values which disappeared from its
+	// topology are removed from the metrics
+	publishedFailureDomains     = map[types.NamespacedName][]string{}
+	publishedFailureDomainsLock sync.Mutex
+)
+
+func init() {
+	metrics.Registry.MustRegister(failureDomainTypeGauge, failureDomainMembersGauge)
+}
+
+// publishTopologyMetrics sets the failure domain metrics of the given
+// StorageCluster from its node topology status and the number of storage
+// nodes in each value of its failure domain, see nodesPerFailureDomain. The
+// hosts are not part of the node topology status, the values of the host
+// failure domain are the hosts of the storage nodes.
+func publishTopologyMetrics(sc *ocsv1.StorageCluster, failureDomainNodes map[string]int) {
+	failureDomain := determineFailureDomain(sc)
+	for _, failureDomainType := range failureDomainTypes {
+		value := 0.0
+		if failureDomainType == failureDomain {
+			value = 1
+		}
+		failureDomainTypeGauge.WithLabelValues(sc.Namespace, sc.Name, failureDomainType).Set(value)
+	}
+
+	values := []string{}
+	if failureDomain == "host" {
+		for host := range failureDomainNodes {
+			values = append(values, host)
+		}
+		sort.Strings(values)
+	} else if sc.Status.NodeTopologies != nil {
+		_, topologyValues := getTopologyKeyValues(sc.Status.NodeTopologies, failureDomain, getPreferredZoneKey(sc))
+		for _, value := range topologyValues {
+			if !statusutil.ContainsString(values, value) {
+				values = append(values, value)
+			}
+		}
+	}
+
+	publishedFailureDomainsLock.Lock()
+	defer publishedFailureDomainsLock.Unlock()
+
+	key := types.NamespacedName{Namespace: sc.Namespace, Name: sc.Name}
+	for _, value := range publishedFailureDomains[key] {
+		if !statusutil.ContainsString(values, value) {
+			failureDomainMembersGauge.DeleteLabelValues(sc.Namespace, sc.Name, value)
+		}
+	}
+	for _, value := range values {
+		failureDomainMembersGauge.WithLabelValues(sc.Namespace, sc.Name, value).Set(float64(failureDomainNodes[value]))
+	}
+	publishedFailureDomains[key] = values
+}
+
+// deleteTopologyMetrics removes all the failure domain metrics of the given
+// StorageCluster
+func deleteTopologyMetrics(sc *ocsv1.StorageCluster) {
+	for _, failureDomainType := range failureDomainTypes {
+		failureDomainTypeGauge.DeleteLabelValues(sc.Namespace, sc.Name, failureDomainType)
+	}
+
+	publishedFailureDomainsLock.Lock()
+	defer publishedFailureDomainsLock.Unlock()
+
+	key := types.NamespacedName{Namespace: sc.Namespace, Name: sc.Name}
+	for _, value := range publishedFailureDomains[key] {
+		failureDomainMembersGauge.DeleteLabelValues(sc.Namespace, sc.Name, value)
+	}
+	delete(publishedFailureDomains, key)
+}
@@ -16,6 +16,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
@@ -290,5 +291,6 @@ func getReconciler(t *testing.T, objs ...runtime.Object) ReconcileStorageCluster
 		scheme:   scheme,
 		client:   client,
 		platform: &CloudPlatform{},
+		recorder: record.NewFakeRecorder(1024),
 	}
 }
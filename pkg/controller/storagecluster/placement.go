@@ -36,7 +36,11 @@ func getPlacement(sc *ocsv1.StorageCluster, component string) rookv1.Placement {
 	topologyMap := sc.Status.NodeTopologies
 	if topologyMap != nil && (component == "mon" || component == "mds") {
 		topologyKey := determineFailureDomain(sc)
-		topologyKey, _ = topologyMap.GetKeyValues(topologyKey)
+		if topologyKey == "host" {
+			topologyKey = corev1.LabelHostname
+		} else {
+			topologyKey, _ = getTopologyKeyValues(topologyMap, topologyKey, getPreferredZoneKey(sc))
+		}
 		podAffinityTerms := placement.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
 		podAffinityTerms[0].PodAffinityTerm.TopologyKey = topologyKey
 	}
@@ -3,6 +3,7 @@ package storagecluster
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"strings"
 	"sync"
 
@@ -27,6 +28,13 @@ const (
 // ValidCloudPlatforms is a list of all CloudPlatformTypes recognized by the package other than PlatformUnknown
 var ValidCloudPlatforms = []CloudPlatformType{PlatformAWS, PlatformGCP, PlatformAzure}
 
+var (
+	// awsZoneRegexp matches AWS availability zones, e.g. us-east-1a
+	awsZoneRegexp = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+[a-z]$`)
+	// gcpZoneRegexp matches GCP zones, e.g. us-central1-a
+	gcpZoneRegexp = regexp.MustCompile(`^[a-z]+-[a-z]+[0-9]+-[a-z]$`)
+)
+
 // CloudPlatform is used to get the CloudPlatformType of the running cluster in a thread-safe manner.
 type CloudPlatform struct {
 	platform CloudPlatformType
@@ -73,3 +81,34 @@ func isValidCloudPlatform(p CloudPlatformType) bool {
 	}
 	return false
 }
+
+// parseProviderIDTopology returns the region and zone encoded in the
+// providerID of a node running on the given cloud platform. It returns false
+// if the providerID format is not recognized, or does not encode them, as on
+// Azure.
+func parseProviderIDTopology(platform CloudPlatformType, providerID string) (string, string, bool) {
+	prefix := fmt.Sprintf("%s://", platform)
+	if !strings.HasPrefix(providerID, prefix) {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(providerID, prefix), "/")
+
+	switch platform {
+	case PlatformAWS:
+		// aws:///<zone>/<instance-id>
+		if len(parts) != 3 || !awsZoneRegexp.MatchString(parts[1]) {
+			return "", "", false
+		}
+		zone := parts[1]
+		return zone[:len(zone)-1], zone, true
+	case PlatformGCP:
+		// gce://<project>/<zone>/<instance-name>
+		if len(parts) != 3 || !gcpZoneRegexp.MatchString(parts[1]) {
+			return "", "", false
+		}
+		zone := parts[1]
+		return zone[:strings.LastIndex(zone, "-")], zone, true
+	}
+
+	return "", "", false
+}
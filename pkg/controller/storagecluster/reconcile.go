@@ -3,10 +3,15 @@ package storagecluster
 import (
 	"context"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
 	"os"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/blang/semver"
 	"github.com/go-logr/logr"
@@ -22,7 +27,9 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
@@ -66,21 +73,40 @@ var validTopologyLabelKeys = []string{
 	"failure-domain.beta.kubernetes.io",
 	"failure-domain.kubernetes.io",
 	"topology.rook.io",
+	"topology.kubernetes.io/datacenter",
+	"topology.kubernetes.io/zone",
+	"topology.kubernetes.io/region",
 }
 
 var throttleDiskTypes = []string{"gp2", "io1"}
 
+// insufficientNodesRequeueDelay is how long to wait before reconciling a
+// StorageCluster again when fewer storage nodes than required were found for
+// the first time. The delay doubles on every consecutive reconcile which
+// finds too few nodes, up to maxInsufficientNodesRequeueDelay.
+const insufficientNodesRequeueDelay = 10 * time.Second
+
+// maxInsufficientNodesRequeueDelay is the maximum delay before reconciling a
+// StorageCluster again while waiting for enough storage nodes
+const maxInsufficientNodesRequeueDelay = 5 * time.Minute
+
+// nodeRackEventInterval is the minimum time between two events recording
+// that a node was labeled with the same rack, so that a flapping rack label
+// does not flood the events
+const nodeRackEventInterval = 10 * time.Minute
+
 // Reconcile reads that state of the cluster for a StorageCluster object and makes changes based on the state read
 // and what is in the StorageCluster.Spec
 // Note:
 // The Controller will requeue the Request to be processed again if the returned error is non-nil or
 // Result.Requeue is true, otherwise upon completion it will remove the work from the queue.
 func (r *ReconcileStorageCluster) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	ctx := context.TODO()
 	reqLogger := r.reqLogger.WithValues("Request.Namespace", request.Namespace, "Request.Name", request.Name)
 
 	// Fetch the StorageCluster instance
 	instance := &ocsv1.StorageCluster{}
-	err := r.client.Get(context.TODO(), request.NamespacedName, instance)
+	err := r.client.Get(ctx, request.NamespacedName, instance)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			reqLogger.Info("No StorageCluster resource")
@@ -115,7 +141,7 @@ func (r *ReconcileStorageCluster) Reconcile(request reconcile.Request) (reconcil
 		}
 		if !isActive {
 			instance.Status.Phase = statusutil.PhaseIgnored
-			phaseErr := r.client.Status().Update(context.TODO(), instance)
+			phaseErr := r.client.Status().Update(ctx, instance)
 			if phaseErr != nil {
 				reqLogger.Error(phaseErr, "Failed to set PhaseIgnored")
 				return reconcile.Result{}, phaseErr
@@ -132,6 +158,17 @@ func (r *ReconcileStorageCluster) Reconcile(request reconcile.Request) (reconcil
 			reqLogger.Error(err, "Failed to validate StorageDeviceSets")
 			return reconcile.Result{}, err
 		}
+		// the spec is not reconciled until the user fixes it
+		if reason, err := validateNodeTopologySpec(instance); err != nil {
+			reqLogger.Error(err, "Invalid node topology spec")
+			statusutil.SetErrorCondition(&instance.Status.Conditions, reason, err.Error())
+			r.recorder.Event(instance, corev1.EventTypeWarning, reason, err.Error())
+			if uErr := r.client.Status().Update(ctx, instance); uErr != nil {
+				reqLogger.Error(uErr, "Failed to update status")
+				return reconcile.Result{}, uErr
+			}
+			return reconcile.Result{}, nil
+		}
 	}
 
 	if instance.Status.Phase != statusutil.PhaseReady &&
@@ -139,7 +176,7 @@ func (r *ReconcileStorageCluster) Reconcile(request reconcile.Request) (reconcil
 		instance.Status.Phase != statusutil.PhaseDeleting &&
 		instance.Status.Phase != statusutil.PhaseConnecting {
 		instance.Status.Phase = statusutil.PhaseProgressing
-		phaseErr := r.client.Status().Update(context.TODO(), instance)
+		phaseErr := r.client.Status().Update(ctx, instance)
 		if phaseErr != nil {
 			reqLogger.Error(phaseErr, "Failed to set PhaseProgressing")
 		}
@@ -150,7 +187,7 @@ func (r *ReconcileStorageCluster) Reconcile(request reconcile.Request) (reconcil
 		reason := ocsv1.ReconcileInit
 		message := "Initializing StorageCluster"
 		statusutil.SetProgressingCondition(&instance.Status.Conditions, reason, message)
-		err = r.client.Status().Update(context.TODO(), instance)
+		err = r.client.Status().Update(ctx, instance)
 		if err != nil {
 			reqLogger.Error(err, "Failed to add conditions to status")
 			return reconcile.Result{}, err
@@ -159,10 +196,10 @@ func (r *ReconcileStorageCluster) Reconcile(request reconcile.Request) (reconcil
 
 	// Check GetDeletionTimestamp to determine if the object is under deletion
 	if instance.GetDeletionTimestamp().IsZero() {
-		if !contains(instance.GetFinalizers(), storageClusterFinalizer) {
+		if !statusutil.ContainsString(instance.GetFinalizers(), storageClusterFinalizer) {
 			reqLogger.Info("Finalizer not found for storagecluster. Adding finalizer")
 			instance.ObjectMeta.Finalizers = append(instance.ObjectMeta.Finalizers, storageClusterFinalizer)
-			if err := r.client.Update(context.TODO(), instance); err != nil {
+			if err := r.client.Update(ctx, instance); err != nil {
 				reqLogger.Error(err, "Failed to update storagecluster with finalizer")
 				return reconcile.Result{}, err
 			}
@@ -170,38 +207,96 @@ func (r *ReconcileStorageCluster) Reconcile(request reconcile.Request) (reconcil
 	} else {
 		// The object is marked for deletion
 		instance.Status.Phase = statusutil.PhaseDeleting
-		phaseErr := r.client.Status().Update(context.TODO(), instance)
+		phaseErr := r.client.Status().Update(ctx, instance)
 		if phaseErr != nil {
 			reqLogger.Error(phaseErr, "Failed to set PhaseDeleting")
 		}
 
-		if contains(instance.GetFinalizers(), storageClusterFinalizer) {
+		if statusutil.ContainsString(instance.GetFinalizers(), storageClusterFinalizer) {
 			err = r.deleteResources(instance, reqLogger)
 			if err != nil {
 				return reconcile.Result{}, err
 			}
 			reqLogger.Info("Removing finalizer")
 			// Once all finalizers have been removed, the object will be deleted
-			instance.ObjectMeta.Finalizers = remove(instance.ObjectMeta.Finalizers, storageClusterFinalizer)
-			if err := r.client.Update(context.TODO(), instance); err != nil {
+			instance.ObjectMeta.Finalizers = statusutil.RemoveString(instance.ObjectMeta.Finalizers, storageClusterFinalizer)
+			if err := r.client.Update(ctx, instance); err != nil {
 				reqLogger.Error(err, "Failed to remove finalizer from storagecluster")
 				return reconcile.Result{}, err
 			}
 		}
+		deleteTopologyMetrics(instance)
 		reqLogger.Info("Object is terminated, skipping reconciliation")
 		return reconcile.Result{}, nil
 	}
 
 	if !instance.Spec.ExternalStorage.Enable {
+		// the nodes can't be listed until the selectors are fixed
+		if err := validateNodeLabelSelectors(instance); err != nil {
+			reqLogger.Error(err, "Invalid storage node label selector")
+			statusutil.SetErrorCondition(&instance.Status.Conditions, "InvalidLabelSelector", err.Error())
+			if uErr := r.client.Status().Update(ctx, instance); uErr != nil {
+				reqLogger.Error(uErr, "Failed to update status")
+				return reconcile.Result{}, uErr
+			}
+			return reconcile.Result{}, nil
+		}
+		if _, err := getStorageClusterFieldSelector(instance); err != nil {
+			reqLogger.Error(err, "Invalid storage node field selector")
+			statusutil.SetErrorCondition(&instance.Status.Conditions, "InvalidFieldSelector", err.Error())
+			if uErr := r.client.Status().Update(ctx, instance); uErr != nil {
+				reqLogger.Error(uErr, "Failed to update status")
+				return reconcile.Result{}, uErr
+			}
+			return reconcile.Result{}, nil
+		}
+		// the storage nodes are listed once and shared by the topology
+		// reconciliation, which only patches their labels and annotations
+		selectedNodes, err := r.getStorageClusterNodes(ctx, instance)
+		if err != nil {
+			reqLogger.Error(err, "Failed to list storage nodes")
+			return reconcile.Result{}, err
+		}
+		nodes := getEligibleNodes(instance, selectedNodes, reqLogger)
 		// Get storage node topology labels
-		if err := r.reconcileNodeTopologyMap(instance, reqLogger); err != nil {
-			reqLogger.Error(err, "Failed to set node topology map")
+		topologyErr := r.reconcileNodeTopologyMap(ctx, instance, nodes, selectedNodes, reqLogger)
+		if topologyErr != nil {
+			// waiting for nodes to join is not a failure
+			if !stderrors.Is(topologyErr, ErrInsufficientNodes) {
+				reqLogger.Error(topologyErr, "Failed to set node topology map")
+			}
+		} else if isBootstrapping(instance, time.Now(), reqLogger) {
+			reqLogger.Info("Skipping StorageDeviceSet placement validation while bootstrapping")
+		} else if topologyErr = validateDeviceSetPlacement(instance); topologyErr != nil {
+			reqLogger.Error(topologyErr, "Failed to validate StorageDeviceSet placement")
+		}
+		if err := r.reconcileTopologyPhase(ctx, instance, nodes, topologyErr, reqLogger); err != nil {
+			reqLogger.Error(err, "Failed to update topology phase")
+			return reconcile.Result{}, err
+		}
+		if stderrors.Is(topologyErr, ErrInsufficientNodes) {
+			return r.waitForStorageNodes(ctx, instance, reqLogger)
+		}
+		r.nodeWaits = 0
+		if topologyErr != nil {
+			return reconcile.Result{}, topologyErr
+		}
+		if err := r.ensureTopologyConfigMap(ctx, instance, reqLogger); err != nil {
+			reqLogger.Error(err, "Failed to publish the node topology map")
 			return reconcile.Result{}, err
 		}
 		if err := r.ensureStorageClusterInit(instance, request, reqLogger); err != nil {
 			reqLogger.Error(err, "Failed to initialize the storagecluster")
 			return reconcile.Result{}, err
 		}
+		pools, err := r.getCephPoolSpecs(instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if err := validatePoolsTopology(instance, pools, reqLogger); err != nil {
+			reqLogger.Error(err, "Failed to validate Ceph pools against the node topology")
+			return reconcile.Result{}, err
+		}
 	}
 
 	// in-memory conditions should start off empty. It will only ever hold
@@ -209,6 +304,7 @@ func (r *ReconcileStorageCluster) Reconcile(request reconcile.Request) (reconcil
 	r.conditions = nil
 	// Start with empty r.phase
 	r.phase = ""
+	r.requeueAfter = 0
 	var ensureFs []ensureFunc
 	if !instance.Spec.ExternalStorage.Enable {
 		// list of default ensure functions
@@ -237,7 +333,7 @@ func (r *ReconcileStorageCluster) Reconcile(request reconcile.Request) (reconcil
 		err = f(instance, reqLogger)
 		if r.phase == statusutil.PhaseClusterExpanding {
 			instance.Status.Phase = statusutil.PhaseClusterExpanding
-			phaseErr := r.client.Status().Update(context.TODO(), instance)
+			phaseErr := r.client.Status().Update(ctx, instance)
 			if phaseErr != nil {
 				reqLogger.Error(phaseErr, "Failed to set PhaseClusterExpanding")
 			}
@@ -245,7 +341,7 @@ func (r *ReconcileStorageCluster) Reconcile(request reconcile.Request) (reconcil
 			if instance.Status.Phase != statusutil.PhaseReady &&
 				instance.Status.Phase != statusutil.PhaseConnecting {
 				instance.Status.Phase = statusutil.PhaseProgressing
-				phaseErr := r.client.Status().Update(context.TODO(), instance)
+				phaseErr := r.client.Status().Update(ctx, instance)
 				if phaseErr != nil {
 					reqLogger.Error(phaseErr, "Failed to set PhaseProgressing")
 				}
@@ -257,7 +353,7 @@ func (r *ReconcileStorageCluster) Reconcile(request reconcile.Request) (reconcil
 			statusutil.SetErrorCondition(&instance.Status.Conditions, reason, message)
 			instance.Status.Phase = statusutil.PhaseError
 			// don't want to overwrite the actual reconcile failure
-			uErr := r.client.Status().Update(context.TODO(), instance)
+			uErr := r.client.Status().Update(ctx, instance)
 			if uErr != nil {
 				reqLogger.Error(uErr, "Failed to update status")
 			}
@@ -324,13 +420,16 @@ func (r *ReconcileStorageCluster) Reconcile(request reconcile.Request) (reconcil
 			}
 		}
 	}
-	phaseErr := r.client.Status().Update(context.TODO(), instance)
+	phaseErr := r.client.Status().Update(ctx, instance)
 	if phaseErr != nil {
 		reqLogger.Error(phaseErr, "Failed to update status")
 		return reconcile.Result{}, phaseErr
 	}
+	if !instance.Spec.ExternalStorage.Enable {
+		publishTopologyMetrics(instance, r.failureDomainNodes)
+	}
 
-	return reconcile.Result{}, nil
+	return reconcile.Result{RequeueAfter: r.requeueAfter}, nil
 }
 
 // versionCheck populates the `.Spec.Version` field
@@ -381,7 +480,9 @@ func (r *ReconcileStorageCluster) ensureStorageClusterInit(
 			instance.Status.CephBlockPoolsCreated = false
 			instance.Status.CephObjectStoreUsersCreated = false
 			instance.Status.CephFilesystemsCreated = false
-			instance.Status.FailureDomain = determineFailureDomain(instance)
+			if getTopologyMode(instance) != ocsv1.TopologyModeManual {
+				instance.Status.FailureDomain = determineFailureDomain(instance)
+			}
 			err = r.client.Status().Update(context.TODO(), instance)
 			if err != nil {
 				return err
@@ -424,302 +525,1527 @@ func (r *ReconcileStorageCluster) validateStorageDeviceSets(sc *ocsv1.StorageClu
 	return nil
 }
 
-func (r *ReconcileStorageCluster) getStorageClusterEligibleNodes(sc *ocsv1.StorageCluster, reqLogger logr.Logger) (nodes *corev1.NodeList, err error) {
-	nodes = &corev1.NodeList{}
-	var selector labels.Selector
-
-	labelSelector := &metav1.LabelSelector{
-		MatchLabels: map[string]string{defaults.NodeAffinityKey: ""},
-	}
+// getStorageClusterNodeSelectors returns the label selectors used to
+// determine which nodes are part of the StorageCluster. A node is part of it
+// when it matches any of them.
+func getStorageClusterNodeSelectors(sc *ocsv1.StorageCluster) ([]labels.Selector, error) {
+	labelSelectors := []*metav1.LabelSelector{}
 	if sc.Spec.LabelSelector != nil {
-		labelSelector = sc.Spec.LabelSelector
+		labelSelectors = append(labelSelectors, sc.Spec.LabelSelector)
 	}
-
-	selector, err = metav1.LabelSelectorAsSelector(labelSelector)
-	err = r.client.List(context.TODO(), nodes, MatchingLabelsSelector{Selector: selector})
-
-	return nodes, err
-}
-
-// reconcileNodeTopologyMap builds the map of all topology labels on all nodes
-// in the storage cluster
-func (r *ReconcileStorageCluster) reconcileNodeTopologyMap(sc *ocsv1.StorageCluster, reqLogger logr.Logger) error {
-	minNodes := defaults.DeviceSetReplica
-	for _, deviceSet := range sc.Spec.StorageDeviceSets {
-		if deviceSet.Replica > minNodes {
-			minNodes = deviceSet.Replica
+	if sc.Spec.NodeTopologies != nil {
+		for _, labelSelector := range sc.Spec.NodeTopologies.LabelSelectors {
+			if labelSelector != nil {
+				labelSelectors = append(labelSelectors, labelSelector)
+			}
 		}
 	}
-
-	nodes, err := r.getStorageClusterEligibleNodes(sc, reqLogger)
-	if err != nil {
-		return err
+	if len(labelSelectors) == 0 {
+		labelSelectors = append(labelSelectors, &metav1.LabelSelector{
+			MatchLabels: map[string]string{defaults.NodeAffinityKey: ""},
+		})
 	}
 
-	if sc.Status.NodeTopologies == nil || sc.Status.NodeTopologies.Labels == nil {
-		sc.Status.NodeTopologies = ocsv1.NewNodeTopologyMap()
+	selectors := []labels.Selector{}
+	for _, labelSelector := range labelSelectors {
+		selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, selector)
 	}
-	topologyMap := sc.Status.NodeTopologies
-	updated := false
-	nodeRacks := ocsv1.NewNodeTopologyMap()
 
-	r.nodeCount = len(nodes.Items)
+	return selectors, nil
+}
 
-	if r.nodeCount < minNodes {
-		return fmt.Errorf("Not enough nodes found: Expected %d, found %d", minNodes, r.nodeCount)
+// validateNodeLabelSelectors checks that the label selectors of the storage
+// nodes of the StorageCluster are valid. The error names the first invalid
+// match expression found.
+func validateNodeLabelSelectors(sc *ocsv1.StorageCluster) error {
+	labelSelectors := []*metav1.LabelSelector{}
+	if sc.Spec.LabelSelector != nil {
+		labelSelectors = append(labelSelectors, sc.Spec.LabelSelector)
+	}
+	if sc.Spec.NodeTopologies != nil {
+		labelSelectors = append(labelSelectors, sc.Spec.NodeTopologies.LabelSelectors...)
 	}
 
-	for _, node := range nodes.Items {
-		labels := node.Labels
-		for label, value := range labels {
-			for _, key := range validTopologyLabelKeys {
-				if strings.Contains(label, key) {
-					if !topologyMap.Contains(label, value) {
-						reqLogger.Info("Adding topology label from node", "Node", node.Name, "Label", label, "Value", value)
-						topologyMap.Add(label, value)
-						updated = true
-					}
-				}
-			}
-			if strings.Contains(label, "rack") {
-				if !nodeRacks.Contains(value, node.Name) {
-					nodeRacks.Add(value, node.Name)
-				}
+	for _, labelSelector := range labelSelectors {
+		if labelSelector == nil {
+			continue
+		}
+		for _, expression := range labelSelector.MatchExpressions {
+			_, err := metav1.LabelSelectorAsSelector(&metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{expression},
+			})
+			if err != nil {
+				return fmt.Errorf("invalid node label selector expression {key: %q, operator: %q, values: %v}: %v", expression.Key, expression.Operator, expression.Values, err)
 			}
 		}
+		if _, err := metav1.LabelSelectorAsSelector(labelSelector); err != nil {
+			return fmt.Errorf("invalid node label selector: %v", err)
+		}
+	}
+
+	return nil
+}
 
+// supportedNodeFieldSelectors lists the node fields which the API server
+// supports in field selectors
+var supportedNodeFieldSelectors = []string{"metadata.name", "spec.unschedulable"}
+
+// getStorageClusterFieldSelector returns the node field selector of the
+// StorageCluster, which selects every node if none is set. It fails if the
+// field selector can not be parsed or uses an unsupported node field.
+func getStorageClusterFieldSelector(sc *ocsv1.StorageCluster) (fields.Selector, error) {
+	if sc.Spec.NodeTopologies == nil || sc.Spec.NodeTopologies.FieldSelector == "" {
+		return fields.Everything(), nil
 	}
 
-	if determineFailureDomain(sc) == "rack" {
-		err = r.ensureNodeRacks(nodes, minNodes, nodeRacks, topologyMap, reqLogger)
-		if err != nil {
-			return err
+	selector, err := fields.ParseSelector(sc.Spec.NodeTopologies.FieldSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node field selector %q: %v", sc.Spec.NodeTopologies.FieldSelector, err)
+	}
+	for _, requirement := range selector.Requirements() {
+		if !statusutil.ContainsString(supportedNodeFieldSelectors, requirement.Field) {
+			return nil, fmt.Errorf("invalid node field selector %q: field %q is not supported for nodes, only %v are", sc.Spec.NodeTopologies.FieldSelector, requirement.Field, supportedNodeFieldSelectors)
 		}
 	}
 
-	if updated {
-		reqLogger.Info("Updating node topology map for StorageCluster")
-		err = r.client.Status().Update(context.TODO(), sc)
-		if err != nil {
-			return err
+	return selector, nil
+}
+
+// getNodeFields returns the fields of the given node supported in field
+// selectors
+func getNodeFields(node corev1.Node) fields.Set {
+	return fields.Set{
+		"metadata.name":      node.Name,
+		"spec.unschedulable": strconv.FormatBool(node.Spec.Unschedulable),
+	}
+}
+
+// matchesAnySelector returns whether the given node labels match any of the
+// given selectors
+func matchesAnySelector(selectors []labels.Selector, nodeLabels map[string]string) bool {
+	for _, selector := range selectors {
+		if selector.Matches(labels.Set(nodeLabels)) {
+			return true
 		}
 	}
 
-	return nil
+	return false
 }
 
-// ensureNodeRacks iterates through the list of storage nodes and ensures
-// all nodes have a rack topology label.
-func (r *ReconcileStorageCluster) ensureNodeRacks(nodes *corev1.NodeList, minRacks int, nodeRacks, topologyMap *ocsv1.NodeTopologyMap, reqLogger logr.Logger) error {
-
-	for _, node := range nodes.Items {
-		hasRack := false
+// getSelectorsString returns the string representation of the given
+// selectors, separated by " || "
+func getSelectorsString(selectors []labels.Selector) string {
+	strs := []string{}
+	for _, selector := range selectors {
+		strs = append(strs, selector.String())
+	}
 
-		for _, nodeNames := range nodeRacks.Labels {
-			for _, nodeName := range nodeNames {
-				if nodeName == node.Name {
-					hasRack = true
-					break
-				}
-			}
-			if hasRack {
-				break
-			}
-		}
+	return strings.Join(strs, " || ")
+}
 
-		if !hasRack {
-			rack := determinePlacementRack(nodes, node, minRacks, nodeRacks)
-			nodeRacks.Add(rack, node.Name)
-			if !topologyMap.Contains(defaults.RackTopologyKey, rack) {
-				reqLogger.Info("Adding rack label from node", "Node", node.Name, "Label", defaults.RackTopologyKey, "Value", rack)
-				topologyMap.Add(defaults.RackTopologyKey, rack)
-			}
+// getStorageClusterNodes returns all the nodes selected for the given
+// StorageCluster, whatever their state. The nodes matching several selectors
+// are returned once.
+func (r *ReconcileStorageCluster) getStorageClusterNodes(ctx context.Context, sc *ocsv1.StorageCluster) (nodes *corev1.NodeList, err error) {
+	nodes = &corev1.NodeList{}
 
-			reqLogger.Info("Labeling node with rack label", "Node", node.Name, "Label", defaults.RackTopologyKey, "Value", rack)
-			newNode := node.DeepCopy()
-			newNode.Labels[defaults.RackTopologyKey] = rack
-			patch, err := generateStrategicPatch(node, newNode)
-			if err != nil {
-				return err
+	selectors, err := getStorageClusterNodeSelectors(sc)
+	if err != nil {
+		return nodes, err
+	}
+	fieldSelector, err := getStorageClusterFieldSelector(sc)
+	if err != nil {
+		return nodes, err
+	}
+	seen := map[string]bool{}
+	for _, selector := range selectors {
+		selected := &corev1.NodeList{}
+		err = r.getTopologyClient().List(ctx, selected, MatchingLabelsSelector{Selector: selector})
+		if err != nil {
+			return nodes, err
+		}
+		for _, node := range selected.Items {
+			// the cached client can't list nodes by field without an
+			// index, the field selector is matched here instead
+			if !fieldSelector.Matches(getNodeFields(node)) {
+				continue
 			}
-			err = r.client.Patch(context.TODO(), &node, patch)
-			if err != nil {
-				return err
+			if !seen[node.Name] {
+				seen[node.Name] = true
+				nodes.Items = append(nodes.Items, node)
 			}
 		}
 	}
 
-	return nil
+	return nodes, nil
 }
 
-func generateStrategicPatch(oldObj, newObj interface{}) (client.Patch, error) {
-	oldJSON, err := json.Marshal(oldObj)
+// getStorageClusterEligibleNodes returns the nodes selected for the given
+// StorageCluster which may host storage daemons. Nodes annotated with
+// excludeFromStorageAnnotation are left out. Unschedulable and NotReady nodes
+// are left out too, unless IncludeNotReadyNodes is set. The nodes left out
+// do not count towards the minimum number of storage nodes, so excluding
+// nodes may leave the StorageCluster waiting for more nodes.
+func (r *ReconcileStorageCluster) getStorageClusterEligibleNodes(ctx context.Context, sc *ocsv1.StorageCluster, reqLogger logr.Logger) (nodes *corev1.NodeList, err error) {
+	nodes, err = r.getStorageClusterNodes(ctx, sc)
 	if err != nil {
-		return nil, err
+		return nodes, err
 	}
 
-	newJSON, err := json.Marshal(newObj)
-	if err != nil {
-		return nil, err
+	return getEligibleNodes(sc, nodes, reqLogger), nil
+}
+
+// getEligibleNodes returns the given nodes selected for the StorageCluster
+// which may host storage daemons, see getStorageClusterEligibleNodes. The
+// given list is left untouched.
+func getEligibleNodes(sc *ocsv1.StorageCluster, selectedNodes *corev1.NodeList, reqLogger logr.Logger) *corev1.NodeList {
+	nodes := &corev1.NodeList{Items: []corev1.Node{}}
+	for _, node := range selectedNodes.Items {
+		if reason := getNodeIneligibleReason(sc, node); reason != "" {
+			reqLogger.Info("Skipping node not eligible for storage", "Node", node.Name, "Reason", reason)
+			continue
+		}
+		nodes.Items = append(nodes.Items, node)
 	}
 
-	patch, err := strategicpatch.CreateTwoWayMergePatch(oldJSON, newJSON, oldObj)
-	if err != nil {
-		return nil, err
+	return nodes
+}
+
+// getNodeIneligibleReason returns why the given node selected for the
+// StorageCluster is left out by getStorageClusterEligibleNodes, or an empty
+// string if it is eligible
+func getNodeIneligibleReason(sc *ocsv1.StorageCluster, node corev1.Node) string {
+	if isExcludedFromStorage(node) {
+		return "excluded by annotation"
+	}
+	if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.IncludeNotReadyNodes {
+		return ""
+	}
+	if node.Spec.Unschedulable {
+		return "cordoned"
+	}
+	if !isNodeReady(node) {
+		return "not ready"
 	}
 
-	return client.ConstantPatch(types.StrategicMergePatchType, patch), nil
+	return ""
 }
 
-// determinePlacementRack sorts the list of known racks in alphabetical order,
-// counts the number of Nodes in each rack, then returns the first rack with
-// the fewest number of Nodes. If there are fewer than three racks, define new
-// racks so that there are at least three. It also ensures that only racks with
-// either no nodes or nodes in the same AZ are considered valid racks.
-func determinePlacementRack(nodes *corev1.NodeList, node corev1.Node, minRacks int, nodeRacks *ocsv1.NodeTopologyMap) string {
-	rackList := []string{}
+// isExcludedFromStorage returns whether the given node is annotated with
+// excludeFromStorageAnnotation set to "true"
+func isExcludedFromStorage(node corev1.Node) bool {
+	return node.Annotations[excludeFromStorageAnnotation] == "true"
+}
 
-	if len(nodeRacks.Labels) < minRacks {
-		for i := len(nodeRacks.Labels); i < minRacks; i++ {
-			for j := 0; j <= i; j++ {
-				newRack := fmt.Sprintf("rack%d", j)
-				if _, ok := nodeRacks.Labels[newRack]; !ok {
-					nodeRacks.Labels[newRack] = ocsv1.TopologyLabelValues{}
-					break
-				}
-			}
+// isNodeReady returns whether the given node has a Ready condition which is
+// True
+func isNodeReady(node corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
 		}
 	}
 
-	targetAZ := ""
-	for label, value := range node.Labels {
-		for _, key := range validTopologyLabelKeys {
-			if strings.Contains(label, key) && strings.Contains(label, "zone") {
-				targetAZ = value
-				break
-			}
-		}
-		if targetAZ != "" {
-			break
+	return false
+}
+
+// getDeviceSetReplica returns the largest replica count of the
+// StorageDeviceSets of the given StorageCluster, which is the number of
+// failure domain values they spread their data across
+func getDeviceSetReplica(sc *ocsv1.StorageCluster) int {
+	replica := defaults.DeviceSetReplica
+	for _, deviceSet := range sc.Spec.StorageDeviceSets {
+		if deviceSet.Replica > replica {
+			replica = deviceSet.Replica
 		}
 	}
 
-	if len(targetAZ) > 0 {
-		for rack := range nodeRacks.Labels {
-			nodeNames := nodeRacks.Labels[rack]
-			if len(nodeNames) == 0 {
-				rackList = append(rackList, rack)
-				continue
-			}
+	return replica
+}
 
-			validRack := false
-			for _, nodeName := range nodeNames {
-				for _, n := range nodes.Items {
-					if n.Name == nodeName {
-						for label, value := range n.Labels {
-							for _, key := range validTopologyLabelKeys {
-								if strings.Contains(label, key) && strings.Contains(label, "zone") && value == targetAZ {
-									validRack = true
-									break
-								}
-							}
-							if validRack {
-								break
-							}
-						}
-						break
-					}
-				}
-				if validRack {
-					break
-				}
-			}
-			if validRack {
-				rackList = append(rackList, rack)
-			}
-		}
-	} else {
-		for rack := range nodeRacks.Labels {
-			rackList = append(rackList, rack)
-		}
+// getMinimumNodes returns the minimum number of storage nodes required by
+// the given StorageCluster for its failure domain, see
+// getFailureDomainMinimumNodes, unless MinimumNodes requires more nodes for
+// it. The failure domain is the one determined in its status, or the
+// preferred one until it is determined. While neither is known, it is the
+// replica count of its StorageDeviceSets.
+func getMinimumNodes(sc *ocsv1.StorageCluster) int {
+	failureDomain := sc.Status.FailureDomain
+	if failureDomain == "" {
+		failureDomain = getPreferredFailureDomain(sc)
 	}
 
-	sort.Strings(rackList)
-	rack := rackList[0]
+	minNodes := getFailureDomainMinimumNodes(sc, failureDomain)
+	if sc.Spec.NodeTopologies == nil {
+		return minNodes
+	}
+	if override := sc.Spec.NodeTopologies.MinimumNodes[failureDomain]; override > minNodes {
+		return override
+	}
 
-	for _, r := range rackList {
-		if len(nodeRacks.Labels[r]) < len(nodeRacks.Labels[rack]) {
-			rack = r
+	return minNodes
+}
+
+// getFailureDomainMinimumNodes returns the minimum number of storage nodes
+// the CRUSH rule of the given failure domain requires: one node in each of
+// the failure domain values the replicas are spread across. Every replica
+// needs its own host, zone or datacenter, while a rack failure domain needs
+// a node in each of the racks the operator generates, i.e. at least
+// MinRackCount racks and MinRacksPerZone racks in each zone.
+func getFailureDomainMinimumNodes(sc *ocsv1.StorageCluster, failureDomain string) int {
+	minNodes := getDeviceSetReplica(sc)
+	if failureDomain != "rack" {
+		return minNodes
+	}
+
+	if racks := getMinRackCount(sc); racks > minNodes {
+		minNodes = racks
+	}
+	if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.MinRacksPerZone > 0 && sc.Status.NodeTopologies != nil {
+		_, zones := getTopologyKeyValues(sc.Status.NodeTopologies, "zone", getPreferredZoneKey(sc))
+		if racks := countDistinctValues(zones) * sc.Spec.NodeTopologies.MinRacksPerZone; racks > minNodes {
+			minNodes = racks
 		}
 	}
 
-	return rack
+	return minNodes
 }
 
-// ensureCephConfig ensures that a ConfigMap resource exists with its Spec in
-// the desired state.
-func (r *ReconcileStorageCluster) ensureCephConfig(sc *ocsv1.StorageCluster, reqLogger logr.Logger) error {
-	ownerRef := metav1.OwnerReference{
-		UID:        sc.UID,
-		APIVersion: sc.APIVersion,
-		Kind:       sc.Kind,
-		Name:       sc.Name,
+// reconcileNodeTopologyMap builds the map of all topology labels on the given
+// storage nodes of the storage cluster, as returned by
+// getStorageClusterEligibleNodes. The selectedNodes are all the nodes
+// selected for the storage cluster, as returned by getStorageClusterNodes,
+// and are only used to report the nodes left out of the storage nodes. The
+// nodes are only modified by the patches of their rack labels and CRUSH
+// location annotations. The errors it returns are TopologyErrors.
+func (r *ReconcileStorageCluster) reconcileNodeTopologyMap(ctx context.Context, sc *ocsv1.StorageCluster, nodes, selectedNodes *corev1.NodeList, reqLogger logr.Logger) (err error) {
+	defer func() {
+		err = newTopologyError(nil, err)
+	}()
+
+	if sc.Status.NodeTopologies == nil || sc.Status.NodeTopologies.Labels == nil {
+		sc.Status.NodeTopologies = ocsv1.NewNodeTopologyMap()
 	}
-	cm := &corev1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:            rookConfigMapName,
-			Namespace:       sc.Namespace,
-			OwnerReferences: []metav1.OwnerReference{ownerRef},
-		},
-		Data: map[string]string{
-			"config": rookConfigData,
-		},
+	committedTopology := sc.Status.NodeTopologies.DeepCopy()
+	committedFailureDomain := determineFailureDomain(sc)
+
+	updated, err := r.validateNodeTopology(ctx, sc, nodes, reqLogger)
+	if err != nil {
+		return err
 	}
 
-	found := &corev1.ConfigMap{}
-	err := r.client.Get(context.TODO(), types.NamespacedName{Name: rookConfigMapName, Namespace: sc.Namespace}, found)
+	nodeRacks, topologyLabelKeys, collected := collectNodeTopology(sc, nodes, committedTopology, reqLogger)
+	updated = collected || updated
+
+	racksCreated, racksUpdated, err := r.reconcileNodeRacks(ctx, sc, nodes, topologyLabelKeys, nodeRacks, reqLogger)
 	if err != nil {
-		if errors.IsNotFound(err) {
-			reqLogger.Info("Creating Ceph ConfigMap")
-			err = r.client.Create(context.TODO(), cm)
-			if err != nil {
-				return err
-			}
-		}
 		return err
 	}
+	updated = racksUpdated || updated
 
-	ownerRefFound := false
-	for _, ownerRef := range found.OwnerReferences {
-		if ownerRef.UID == sc.UID {
-			ownerRefFound = true
-		}
+	conditionsUpdated, err := r.updateTopologyConditions(ctx, sc, nodes, selectedNodes, committedFailureDomain, committedTopology, nodeRacks, reqLogger)
+	if err != nil {
+		return err
 	}
-	val, ok := found.Data["config"]
-	if ok != true || val != rookConfigData || ownerRefFound != true {
-		reqLogger.Info("Updating Ceph ConfigMap")
-		return r.client.Update(context.TODO(), cm)
+	updated = conditionsUpdated || updated
+
+	err = r.publishTopologyStatus(ctx, sc, nodes, committedFailureDomain, committedTopology, nodeRacks, racksCreated, updated, reqLogger)
+	if err != nil {
+		return err
 	}
-	return nil
-}
 
-// determineFailureDomain determines the appropriate Ceph failure domain based
-// on the storage cluster's topology map
-func determineFailureDomain(sc *ocsv1.StorageCluster) string {
-	if sc.Status.FailureDomain != "" {
-		return sc.Status.FailureDomain
+	mode := getTopologyMode(sc)
+	if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.AnnotateCrushLocation && mode != ocsv1.TopologyModeManual {
+		err = r.ensureNodeCrushLocations(ctx, sc, nodes, reqLogger)
+		if err != nil {
+			return err
+		}
 	}
-	topologyMap := sc.Status.NodeTopologies
-	failureDomain := "rack"
-	for label, labelValues := range topologyMap.Labels {
-		if strings.Contains(label, "zone") {
-			if len(labelValues) >= 3 {
-				failureDomain = "zone"
-			}
+
+	if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.RemoveDeselectedNodeRacks && mode != ocsv1.TopologyModeManual {
+		err = r.removeDeselectedNodeRacks(ctx, nodes, reqLogger)
+		if err != nil {
+			return err
 		}
 	}
-	return failureDomain
-}
+
+	return nil
+}
+
+// validateNodeTopology records the node label selector and the nodes shared
+// with other StorageClusters, and validates the number of storage nodes and
+// their topology labels. The nodes are labeled with the topology of their
+// provider ID first if requested. It returns whether the status was updated.
+func (r *ReconcileStorageCluster) validateNodeTopology(ctx context.Context, sc *ocsv1.StorageCluster, nodes *corev1.NodeList, reqLogger logr.Logger) (updated bool, err error) {
+	minNodes := getMinimumNodes(sc)
+
+	selectors, err := getStorageClusterNodeSelectors(sc)
+	if err != nil {
+		return false, err
+	}
+	if selector := getSelectorsString(selectors); sc.Status.NodeLabelSelector != selector {
+		reqLogger.Info("Updating node label selector for StorageCluster", "Selector", selector)
+		sc.Status.NodeLabelSelector = selector
+		updated = true
+	}
+
+	overlaps, err := r.getOverlappingStorageClusters(ctx, sc, nodes)
+	if err != nil {
+		return false, err
+	}
+	overlappingNodes := []string{}
+	for nodeName := range overlaps {
+		overlappingNodes = append(overlappingNodes, nodeName)
+	}
+	sort.Strings(overlappingNodes)
+	for _, nodeName := range overlappingNodes {
+		reqLogger.Info("Node is also selected by other StorageClusters, its rack label will be shared with them", "Node", nodeName, "StorageClusters", overlaps[nodeName])
+		r.recorder.Eventf(sc, corev1.EventTypeWarning, "NodeSelectedByMultipleStorageClusters",
+			"Node %s is selected by StorageCluster %s/%s and by StorageClusters %v, its rack label is shared with them", nodeName, sc.Namespace, sc.Name, overlaps[nodeName])
+	}
+
+	r.nodeCount = len(nodes.Items)
+
+	if r.nodeCount < minNodes {
+		if !isBootstrapping(sc, time.Now(), reqLogger) {
+			return false, newTopologyError(ErrInsufficientNodes, fmt.Errorf("%w: Expected %d, found %d", ErrInsufficientNodes, minNodes, r.nodeCount))
+		}
+		reqLogger.Info("Not enough nodes found, proceeding while bootstrapping. Resilience is reduced until more nodes join.",
+			"Expected", minNodes, "Found", r.nodeCount, "Until", sc.Annotations[bootstrapUntilAnnotation])
+	} else {
+		if err = validateDistinctHosts(nodes, getDeviceSetReplica(sc)); err != nil {
+			return false, err
+		}
+		if err = r.clearBootstrap(ctx, sc, reqLogger); err != nil {
+			return false, err
+		}
+	}
+
+	if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.DiscoverFromProviderID && getTopologyMode(sc) != ocsv1.TopologyModeManual {
+		err = r.ensureProviderIDTopology(ctx, nodes, reqLogger)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = validateRequiredTopologyKeys(sc, nodes)
+	if err != nil {
+		return false, err
+	}
+
+	err = validatePreferredFailureDomain(sc, nodes)
+	if err != nil {
+		return false, err
+	}
+
+	if sc.Spec.NodeTopologies == nil || !sc.Spec.NodeTopologies.AllowPartialZoneLabels {
+		if unzoned := getNodesWithoutZone(nodes); len(unzoned) > 0 {
+			message := fmt.Sprintf("Some storage nodes carry a zone label, but none was found on nodes %v", unzoned)
+			conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+				Type:    ocsv1.ConditionTopologyValid,
+				Status:  corev1.ConditionFalse,
+				Reason:  "PartialZoneLabels",
+				Message: message,
+			})
+			if uErr := r.client.Status().Update(ctx, sc); uErr != nil {
+				reqLogger.Error(uErr, "Failed to update status")
+			}
+			return false, fmt.Errorf("%s", message)
+		}
+	}
+	if condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, ocsv1.ConditionTopologyValid); condition != nil && condition.Reason == "PartialZoneLabels" {
+		conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+			Type:    ocsv1.ConditionTopologyValid,
+			Status:  corev1.ConditionTrue,
+			Reason:  "TopologyValid",
+			Message: "Node topology forms a valid CRUSH hierarchy",
+		})
+		updated = true
+	}
+
+	return updated, nil
+}
+
+// collectNodeTopology adds the topology labels of the given storage nodes to
+// the node topology map of the StorageCluster, and prunes or rebuilds it as
+// requested. It returns the nodes of each rack, the topology label keys of
+// the nodes and whether the status was updated.
+func collectNodeTopology(sc *ocsv1.StorageCluster, nodes *corev1.NodeList, committedTopology *ocsv1.NodeTopologyMap, reqLogger logr.Logger) (nodeRacks *ocsv1.NodeTopologyMap, topologyLabelKeys []string, updated bool) {
+	topologyMap := sc.Status.NodeTopologies
+	nodeRacks = ocsv1.NewNodeTopologyMap()
+
+	topologyLabelKeys = append(getTopologyLabelKeys(sc), getCSITopologyLabelKeys(nodes)...)
+	missing, stale := VerifyTopologyMapCompleteness(topologyMap, nodes, topologyLabelKeys)
+	if len(missing) > 0 {
+		reqLogger.Info("Topology map is missing values found on nodes", "Nodes", missing)
+	}
+
+	redundantLabels := getRedundantDeprecatedLabels(nodes)
+	if filterDeprecatedLabels(topologyMap, redundantLabels, reqLogger) {
+		updated = true
+	}
+
+	if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.RebuildTopologyMap {
+		if rebuildTopologyMap(sc, nodes, topologyLabelKeys, reqLogger) {
+			updated = true
+		}
+	}
+
+	for _, node := range nodes.Items {
+		labels := node.Labels
+		for label, value := range labels {
+			for _, key := range topologyLabelKeys {
+				if matchesTopologyLabelKey(label, key) && !redundantLabels[label] {
+					if !topologyMap.Contains(label, value) {
+						reqLogger.Info("Adding topology label from node", "Node", node.Name, "Label", label, "Value", value)
+						topologyMap.Add(label, value)
+						updated = true
+					}
+				}
+			}
+			// the racks of CSI drivers are used when labeling the nodes
+			// with their rack, they are not rack labels of their own
+			if ocsv1.IsTopologyLabelOf(label, "rack") && !isCSITopologyLabel(label) {
+				if !nodeRacks.Contains(value, node.Name) {
+					nodeRacks.Add(value, node.Name)
+				}
+			}
+		}
+
+	}
+
+	if duplicates := topologyMap.RemoveDuplicates(); len(duplicates) > 0 {
+		reqLogger.Info("Removed duplicate values from the node topology map", "Duplicates", duplicates)
+		updated = true
+	}
+	if duplicates := nodeRacks.RemoveDuplicates(); len(duplicates) > 0 {
+		reqLogger.Info("Removed duplicate nodes from racks", "Duplicates", duplicates)
+	}
+
+	if overlap := getPartiallyOverlappingZoneLabels(topologyMap); overlap != "" {
+		reqLogger.Info("Zone labels of the storage nodes disagree, the failure domain is determined from one of them only", "Overlap", overlap)
+	}
+
+	for label, values := range topologyMap.Labels {
+		for _, variants := range caseVariantValues(values) {
+			reqLogger.Info("Topology label has values that only differ by case, they are counted once to determine the failure domain", "Label", label, "Values", variants)
+		}
+	}
+
+	if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.PruneGracePeriod != nil && !sc.Spec.NodeTopologies.RebuildTopologyMap {
+		gracePeriod := sc.Spec.NodeTopologies.PruneGracePeriod.Duration
+		if pruneTopologyValues(sc, stale, gracePeriod, metav1.Now(), reqLogger) {
+			updated = true
+		}
+	}
+
+	if newKeys := getNewTopologyKeys(committedTopology, topologyMap); len(newKeys) > 0 {
+		reqLogger.Info("Found new topology labels on nodes", "Labels", newKeys)
+		if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.AllowFailureDomainPromotion && promoteFailureDomain(sc, reqLogger) {
+			updated = true
+		}
+	}
+
+	return nodeRacks, topologyLabelKeys, updated
+}
+
+// reconcileNodeRacks labels the storage nodes without a rack, if the failure
+// domain is rack and the racks are not managed manually, and records the
+// racks in the status as requested. It returns the number of racks created,
+// and whether the status was updated.
+func (r *ReconcileStorageCluster) reconcileNodeRacks(ctx context.Context, sc *ocsv1.StorageCluster, nodes *corev1.NodeList, topologyLabelKeys []string, nodeRacks *ocsv1.NodeTopologyMap, reqLogger logr.Logger) (racksCreated int, updated bool, err error) {
+	topologyMap := sc.Status.NodeTopologies
+
+	maxRacks, minRacksPerZone := 0, 0
+	if sc.Spec.NodeTopologies != nil {
+		maxRacks = sc.Spec.NodeTopologies.MaxRackCount
+		minRacksPerZone = sc.Spec.NodeTopologies.MinRacksPerZone
+	}
+
+	mode := getTopologyMode(sc)
+	rackCount := len(nodeRacks.Labels)
+	if r.traceFailureDomain(ctx, sc) == "rack" {
+		if mode == ocsv1.TopologyModeManual {
+			if nodeNames := getNodesWithoutRack(nodes, nodeRacks); len(nodeNames) > 0 {
+				return 0, false, fmt.Errorf("topology mode %s requires every storage node to have a rack label, but none was found on nodes %v", mode, nodeNames)
+			}
+		} else {
+			if err = validateMinRacksPerZone(nodes, minRacksPerZone, maxRacks); err != nil {
+				return 0, false, err
+			}
+			knownRacks := map[string]string{}
+			if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.PersistRackAssignments {
+				knownRacks = sc.Status.NodeRacks
+			}
+			if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.DryRunRackAssignment {
+				plan, err := planNodeRacks(nodes, getMinRackCount(sc), maxRacks, minRacksPerZone, getRackPrefix(sc), topologyLabelKeys, getRackCapacityKey(sc), knownRacks, nodeRacks, reqLogger)
+				if err != nil {
+					return 0, false, err
+				}
+				if len(plan) > 0 {
+					reqLogger.Info("Planned rack labels of nodes, not applied in dry run", "Plan", plan)
+				}
+			} else {
+				assignments, err := r.ensureNodeRacks(ctx, nodes, getMinRackCount(sc), maxRacks, minRacksPerZone, getRackPrefix(sc), topologyLabelKeys, getRackCapacityKey(sc), knownRacks, nodeRacks, topologyMap, getNodePatchConcurrency(sc), reqLogger)
+				if len(assignments) > 0 {
+					reqLogger.Info("Labeled nodes with racks", "Assignments", assignments)
+					updated = true
+				}
+				if err != nil {
+					// any of the concurrent patches may be forbidden
+					if anyTopologyError(err, errors.IsForbidden) {
+						reason := "NodePatchForbidden"
+						message := fmt.Sprintf("missing RBAC: nodes patch permission required for rack labeling: %v", err)
+						statusutil.SetErrorCondition(&sc.Status.Conditions, reason, message)
+					}
+					setTopologyReadyCondition(sc, corev1.ConditionFalse, "RackAssignmentFailed", r.nodeCount, err.Error())
+					if uErr := r.client.Status().Update(ctx, sc); uErr != nil {
+						reqLogger.Error(uErr, "Failed to update status")
+					}
+					return 0, false, err
+				}
+			}
+			if rack, zones := validateRackZones(nodes, nodeRacks); rack != "" {
+				return 0, false, fmt.Errorf("rack %q contains nodes from multiple zones %v", rack, zones)
+			}
+			if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.AutoRebalanceRacks && !sc.Spec.NodeTopologies.DryRunRackAssignment {
+				moves, err := r.rebalanceNodeRacks(ctx, nodes, getRackPrefix(sc), getRackRebalanceRatio(sc), nodeRacks, reqLogger)
+				if len(moves) > 0 {
+					reqLogger.Info("Rebalanced racks", "Moves", moves)
+					updated = true
+				}
+				if err != nil {
+					return 0, false, err
+				}
+			}
+		}
+	}
+
+	racksCreated = len(nodeRacks.Labels) - rackCount
+
+	if pruneStaleRacks(sc, nodeRacks, reqLogger) {
+		updated = true
+	}
+
+	if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.PersistRackAssignments && recordNodeRacks(sc, nodeRacks) {
+		updated = true
+	}
+
+	return racksCreated, updated, nil
+}
+
+// updateTopologyConditions sets the topology conditions of the StorageCluster
+// from the collected node topology, and validates the failure domain values
+// before the failure domain is committed. It returns whether the status was
+// updated.
+func (r *ReconcileStorageCluster) updateTopologyConditions(ctx context.Context, sc *ocsv1.StorageCluster, nodes, selectedNodes *corev1.NodeList, committedFailureDomain string, committedTopology, nodeRacks *ocsv1.NodeTopologyMap, reqLogger logr.Logger) (updated bool, err error) {
+	topologyMap := sc.Status.NodeTopologies
+
+	_, zoneValues := getTopologyKeyValues(topologyMap, "zone", getPreferredZoneKey(sc))
+	_, regionValues := topologyMap.GetKeyValues("region")
+	if len(zoneValues) > 0 && (len(nodeRacks.Labels) > 0 || len(regionValues) > 0) {
+		zonesWithoutRack := []string{}
+		if len(nodeRacks.Labels) > 0 {
+			zonesWithoutRack = validateZoneRacks(nodes, nodeRacks)
+		}
+		zoneRegions := validateZoneRegions(nodes)
+		if len(zonesWithoutRack) > 0 {
+			reqLogger.Info("Found zones without any rack", "Zones", zonesWithoutRack)
+			conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+				Type:    ocsv1.ConditionTopologyValid,
+				Status:  corev1.ConditionFalse,
+				Reason:  "ZoneWithoutRack",
+				Message: fmt.Sprintf("Every zone must contain at least one rack, but no rack was found in zones %v", zonesWithoutRack),
+			})
+		} else if len(zoneRegions) > 0 {
+			reqLogger.Info("Found zones in multiple regions", "Zones", zoneRegions)
+			conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+				Type:    ocsv1.ConditionTopologyValid,
+				Status:  corev1.ConditionFalse,
+				Reason:  "ZoneInMultipleRegions",
+				Message: fmt.Sprintf("Every zone must belong to a single region, but zones were found in multiple regions %v", zoneRegions),
+			})
+		} else {
+			conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+				Type:    ocsv1.ConditionTopologyValid,
+				Status:  corev1.ConditionTrue,
+				Reason:  "TopologyValid",
+				Message: "Node topology forms a valid CRUSH hierarchy",
+			})
+		}
+	}
+
+	if message := detectTopologyRebalance(committedFailureDomain, committedTopology, topologyMap, getFailureDomainWeights(sc), getPreferredZoneKey(sc), getPreferredFailureDomain(sc) != ""); message != "" {
+		reqLogger.Info("Node topology change may trigger a rebalance of the data", "Change", message)
+		conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+			Type:    ocsv1.ConditionTopologyRebalancing,
+			Status:  corev1.ConditionTrue,
+			Reason:  "TopologyChanged",
+			Message: message,
+		})
+		updated = true
+	} else if conditionsv1.IsStatusConditionTrue(sc.Status.Conditions, ocsv1.ConditionTopologyRebalancing) {
+		conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+			Type:    ocsv1.ConditionTopologyRebalancing,
+			Status:  corev1.ConditionFalse,
+			Reason:  "TopologyStable",
+			Message: "Node topology did not change",
+		})
+		updated = true
+	}
+
+	if reason, message := getZoneFallbackMessage(sc); message != "" {
+		condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, ocsv1.ConditionFailureDomainFallback)
+		if condition == nil || condition.Status != corev1.ConditionTrue {
+			reqLogger.Info("Falling back to the rack failure domain", "Reason", message)
+		}
+		// users expecting zone-level resilience are told once they can't
+		// get it
+		if reason == "SingleZone" && (condition == nil || condition.Status != corev1.ConditionTrue || condition.Reason != reason) {
+			r.recorder.Event(sc, corev1.EventTypeWarning, reason, message)
+		}
+		conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+			Type:    ocsv1.ConditionFailureDomainFallback,
+			Status:  corev1.ConditionTrue,
+			Reason:  reason,
+			Message: message,
+		})
+	} else if conditionsv1.FindStatusCondition(sc.Status.Conditions, ocsv1.ConditionFailureDomainFallback) != nil {
+		conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+			Type:    ocsv1.ConditionFailureDomainFallback,
+			Status:  corev1.ConditionFalse,
+			Reason:  "NoFallback",
+			Message: "The failure domain is not affected by the zone labels",
+		})
+	}
+
+	if isSingleFailureDomain(topologyMap) {
+		if !conditionsv1.IsStatusConditionTrue(sc.Status.Conditions, ocsv1.ConditionSingleFailureDomain) {
+			reqLogger.Info("All storage nodes share a single zone and rack, data is only spread across hosts")
+		}
+		conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+			Type:    ocsv1.ConditionSingleFailureDomain,
+			Status:  corev1.ConditionTrue,
+			Reason:  "FlatTopology",
+			Message: "All storage nodes share a single zone and rack, the cluster does not survive the failure of that zone or rack",
+		})
+	} else if conditionsv1.FindStatusCondition(sc.Status.Conditions, ocsv1.ConditionSingleFailureDomain) != nil {
+		conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+			Type:    ocsv1.ConditionSingleFailureDomain,
+			Status:  corev1.ConditionFalse,
+			Reason:  "MultipleFailureDomains",
+			Message: "Storage nodes are spread across multiple zones or racks",
+		})
+	}
+
+	failureDomain := determineFailureDomain(sc)
+	// a failure domain read from the node labels is not committed until it
+	// provides a value for every replica. The racks are generated by the
+	// operator, and a single rack is reported as a single failure domain.
+	if sc.Status.FailureDomain == "" && (failureDomain == "zone" || failureDomain == "datacenter") && !isBootstrapping(sc, time.Now(), reqLogger) {
+		if err = validateFailureDomainValues(sc, nodes, failureDomain); err != nil {
+			setTopologyReadyCondition(sc, corev1.ConditionFalse, "InsufficientFailureDomains", r.nodeCount, err.Error())
+			if uErr := r.client.Status().Update(ctx, sc); uErr != nil {
+				reqLogger.Error(uErr, "Failed to update status")
+			}
+			return false, err
+		}
+	}
+	r.failureDomainNodes = nodesPerFailureDomain(nodes, failureDomain, getPreferredZoneKey(sc))
+	if empty := getEmptyFailureDomains(topologyMap, failureDomain, getPreferredZoneKey(sc), r.failureDomainNodes); len(empty) > 0 {
+		reqLogger.Info("Failure domain values hold no eligible storage node, Ceph can not place data in them", "FailureDomain", failureDomain, "Values", empty)
+	}
+	if setTopologyReadyCondition(sc, corev1.ConditionTrue, "TopologyReconciled", r.nodeCount, "") {
+		updated = true
+	}
+	// the nodes left out of the storage nodes are excluded too
+	if excluded, values := validateExcludedNodes(sc, failureDomain, getDeviceSetReplica(sc), selectedNodes, nodeRacks); len(excluded) > 0 {
+		message := fmt.Sprintf("Nodes %s can not schedule storage Pods, leaving only %d %s failure domains %v for %d replicas", formatExcludedNodes(excluded), len(values), failureDomain, values, getDeviceSetReplica(sc))
+		if !conditionsv1.IsStatusConditionTrue(sc.Status.Conditions, ocsv1.ConditionFailureDomainStranded) {
+			reqLogger.Info("Excluded nodes reduce the resilience of the cluster", "Nodes", excluded, "FailureDomain", failureDomain, "Values", values)
+		}
+		conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+			Type:    ocsv1.ConditionFailureDomainStranded,
+			Status:  corev1.ConditionTrue,
+			Reason:  "NodesExcluded",
+			Message: message,
+		})
+	} else if conditionsv1.FindStatusCondition(sc.Status.Conditions, ocsv1.ConditionFailureDomainStranded) != nil {
+		conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+			Type:    ocsv1.ConditionFailureDomainStranded,
+			Status:  corev1.ConditionFalse,
+			Reason:  "EnoughFailureDomains",
+			Message: "The schedulable storage nodes provide enough failure domains for the replicas",
+		})
+	}
+
+	return updated, nil
+}
+
+// publishTopologyStatus fills in the status fields derived from the node
+// topology, and updates the status of the StorageCluster if anything changed,
+// recording the failure domain or topology change as an event.
+func (r *ReconcileStorageCluster) publishTopologyStatus(ctx context.Context, sc *ocsv1.StorageCluster, nodes *corev1.NodeList, committedFailureDomain string, committedTopology, nodeRacks *ocsv1.NodeTopologyMap, racksCreated int, updated bool, reqLogger logr.Logger) error {
+	topologyMap := sc.Status.NodeTopologies
+	failureDomain := determineFailureDomain(sc)
+
+	if trackTopologyConvergence(sc, getTopologyHash(topologyMap), reqLogger) {
+		updated = true
+	}
+
+	requestedFailureDomain := ""
+	if sc.Spec.NodeTopologies != nil {
+		requestedFailureDomain = sc.Spec.NodeTopologies.FailureDomain
+	}
+	reason := getFailureDomainReason(sc)
+	if sc.Status.RequestedFailureDomain != requestedFailureDomain || sc.Status.FailureDomainReason != reason {
+		sc.Status.RequestedFailureDomain = requestedFailureDomain
+		sc.Status.FailureDomainReason = reason
+		updated = true
+	}
+
+	if parentFailureDomain := determineParentFailureDomain(sc); sc.Status.ParentFailureDomain != parentFailureDomain {
+		reqLogger.Info("Updating parent failure domain", "ParentFailureDomain", parentFailureDomain, "FailureDomain", failureDomain)
+		sc.Status.ParentFailureDomain = parentFailureDomain
+		updated = true
+	}
+
+	if topologyStatus := getTopologyStatus(failureDomain, nodes, topologyMap, nodeRacks); !reflect.DeepEqual(sc.Status.Topology, topologyStatus) {
+		sc.Status.Topology = topologyStatus
+		updated = true
+	}
+
+	reqLogger.V(placementDecisionLogLevel).Info("Placement decision", getPlacementDecision(sc, nodes, failureDomain, racksCreated)...)
+
+	spreadFactor := fmt.Sprintf("%.2f", getFailureDomainSpreadFactor(sc))
+	if sc.Status.FailureDomainSpreadFactor != spreadFactor {
+		sc.Status.FailureDomainSpreadFactor = spreadFactor
+		updated = true
+	}
+
+	if updated {
+		reqLogger.Info("Updating node topology map for StorageCluster")
+		err := r.client.Status().Update(ctx, sc)
+		if err != nil {
+			return err
+		}
+		// a failure domain change is only recorded as FailureDomainChanged,
+		// not as TopologyChanged too
+		if committedFailureDomain != failureDomain {
+			r.recorder.Eventf(sc, corev1.EventTypeNormal, "FailureDomainChanged",
+				"Failure domain changed from %s to %s with %d storage nodes", committedFailureDomain, failureDomain, len(nodes.Items))
+		} else if message := getTopologyChangeMessage(committedFailureDomain, committedTopology, failureDomain, topologyMap, getPreferredZoneKey(sc)); message != "" {
+			r.recorder.Event(sc, corev1.EventTypeNormal, "TopologyChanged", message)
+		}
+	}
+
+	return nil
+}
+
+// nodeRackAssignment is a rack label applied to a node
+type nodeRackAssignment struct {
+	Node string
+	Rack string
+}
+
+// ensureNodeRacks ensures all storage nodes have a rack topology label,
+// labeling the nodes without one with the rack planned by planNodeRacks. The
+// nodes are patched by up to concurrency workers once all the racks are
+// planned, and a failed patch does not stop the others. The applied racks
+// are added to nodeRacks and topologyMap. It returns the rack labels it
+// applied, and the errors of the failed patches.
+func (r *ReconcileStorageCluster) ensureNodeRacks(ctx context.Context, nodes *corev1.NodeList, minRacks, maxRacks, minRacksPerZone int, rackPrefix string, topologyLabelKeys []string, capacityKey string, knownRacks map[string]string, nodeRacks, topologyMap *ocsv1.NodeTopologyMap, concurrency int, reqLogger logr.Logger) ([]nodeRackAssignment, error) {
+	assignments := []nodeRackAssignment{}
+
+	plan, err := planNodeRacks(nodes, minRacks, maxRacks, minRacksPerZone, rackPrefix, topologyLabelKeys, capacityKey, knownRacks, nodeRacks, reqLogger)
+	if err != nil {
+		return assignments, err
+	}
+
+	planned := []int{}
+	previous := map[string]string{}
+	for i, node := range nodes.Items {
+		if rack, ok := plan[node.Name]; ok {
+			reqLogger.Info("Labeling node with rack label", "Node", node.Name, "Label", defaults.RackTopologyKey, "Value", rack)
+			planned = append(planned, i)
+			previous[node.Name] = node.Labels[defaults.RackTopologyKey]
+		}
+	}
+
+	// patch the nodes of the list rather than copies, so that every node
+	// is patched against its own object
+	errs := make([]error, len(nodes.Items))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(planned); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = r.patchNodeRack(ctx, &nodes.Items[i], plan[nodes.Items[i].Name])
+			}
+		}()
+	}
+	for _, i := range planned {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	var patchErr *TopologyError
+	for _, i := range planned {
+		node := &nodes.Items[i]
+		rack := plan[node.Name]
+		if errs[i] != nil {
+			reqLogger.Error(errs[i], "Failed to label node with rack label", "Node", node.Name, "Value", rack)
+			if patchErr == nil {
+				patchErr = &TopologyError{Reason: ErrRackAssignment, Err: stderrors.Unwrap(errs[i])}
+			} else {
+				patchErr.Others = append(patchErr.Others, stderrors.Unwrap(errs[i]))
+			}
+			continue
+		}
+		newRack := len(nodeRacks.Labels[rack]) == 0
+		nodeRacks.Add(rack, node.Name)
+		if !topologyMap.Contains(defaults.RackTopologyKey, rack) {
+			reqLogger.Info("Adding rack label from node", "Node", node.Name, "Label", defaults.RackTopologyKey, "Value", rack)
+			topologyMap.Add(defaults.RackTopologyKey, rack)
+		}
+		r.recordNodeRackEvent(node, previous[node.Name], rack, newRack)
+		assignments = append(assignments, nodeRackAssignment{Node: node.Name, Rack: rack})
+	}
+	if patchErr != nil {
+		return assignments, patchErr
+	}
+
+	return assignments, nil
+}
+
+// rebalanceNodeRacks moves storage nodes between the racks named after
+// rackPrefix as planned by planRackRebalance, relabeling the nodes and
+// updating nodeRacks. It returns the applied moves.
+func (r *ReconcileStorageCluster) rebalanceNodeRacks(ctx context.Context, nodes *corev1.NodeList, rackPrefix string, ratio int, nodeRacks *ocsv1.NodeTopologyMap, reqLogger logr.Logger) ([]nodeRackAssignment, error) {
+	applied := []nodeRackAssignment{}
+
+	moves := map[string]string{}
+	for _, move := range planRackRebalance(nodes, nodeRacks, rackPrefix, ratio) {
+		moves[move.Node] = move.Rack
+	}
+
+	for i, node := range nodes.Items {
+		rack, ok := moves[node.Name]
+		if !ok {
+			continue
+		}
+		previous := node.Labels[defaults.RackTopologyKey]
+		reqLogger.Info("Moving node to another rack to rebalance the racks", "Node", node.Name, "From", previous, "To", rack)
+		newRack := len(nodeRacks.Labels[rack]) == 0
+		err := r.patchNodeRack(ctx, &nodes.Items[i], rack)
+		if err != nil {
+			return applied, err
+		}
+		r.recordNodeRackEvent(&nodes.Items[i], previous, rack, newRack)
+		nodeRacks.Labels[previous] = statusutil.RemoveString(nodeRacks.Labels[previous], node.Name)
+		nodeRacks.Add(rack, node.Name)
+		applied = append(applied, nodeRackAssignment{Node: node.Name, Rack: rack})
+	}
+
+	return applied, nil
+}
+
+// patchNodeRack patches the rack topology label of the given node, recording
+// that the label was applied by the operator
+func (r *ReconcileStorageCluster) patchNodeRack(ctx context.Context, node *corev1.Node, rack string) error {
+	newNode := node.DeepCopy()
+	newNode.Labels[defaults.RackTopologyKey] = rack
+	if newNode.Annotations == nil {
+		newNode.Annotations = map[string]string{}
+	}
+	newNode.Annotations[operatorRackAnnotation] = rack
+	patch, err := generateStrategicPatch(node, newNode)
+	if err != nil {
+		return newTopologyError(ErrRackAssignment, err)
+	}
+	err = r.getTopologyClient().Patch(ctx, node, patch)
+	if err != nil {
+		return newTopologyError(ErrRackAssignment, err)
+	}
+
+	return nil
+}
+
+// recordNodeRackEvent records an event on the given node, which was labeled
+// with the given rack instead of the previous one. No event is recorded if
+// the rack did not change, or if the same event was recorded for the node
+// less than nodeRackEventInterval ago.
+func (r *ReconcileStorageCluster) recordNodeRackEvent(node *corev1.Node, previous, rack string, newRack bool) {
+	if previous == rack {
+		return
+	}
+	key := node.Name + "/" + rack
+	now := time.Now()
+	if last, ok := r.nodeRackEvents[key]; ok && now.Sub(last) < nodeRackEventInterval {
+		return
+	}
+	if r.nodeRackEvents == nil {
+		r.nodeRackEvents = map[string]time.Time{}
+	}
+	r.nodeRackEvents[key] = now
+
+	message := fmt.Sprintf("Labeled node with %s=%s", defaults.RackTopologyKey, rack)
+	if newRack {
+		message += ", a new rack"
+	}
+	if previous != "" {
+		message += fmt.Sprintf(", previously %s", previous)
+	}
+	r.recorder.Event(node, corev1.EventTypeNormal, "NodeRackLabeled", message)
+}
+
+// planNodeRacks iterates through the list of storage nodes and returns the
+// rack each node without a rack in nodeRacks would be labeled with, keyed by
+// node name. If maxRacks is non-zero, no more than maxRacks racks will be
+// generated. If minRacksPerZone is non-zero, nodes are placed in new racks
+// until every zone has at least minRacksPerZone racks. New racks are named
+// after rackPrefix. Nodes found in knownRacks are placed in their known rack
+// if it is still in their zone. If capacityKey is set, the racks are
+// balanced by the capacity of their nodes rather than by their number of
+// nodes, see determinePlacementRack. nodeRacks is left untouched.
+func planNodeRacks(nodes *corev1.NodeList, minRacks, maxRacks, minRacksPerZone int, rackPrefix string, topologyLabelKeys []string, capacityKey string, knownRacks map[string]string, nodeRacks *ocsv1.NodeTopologyMap, reqLogger logr.Logger) (map[string]string, error) {
+	plan := map[string]string{}
+
+	if maxRacks > 0 && minRacks > maxRacks {
+		reqLogger.Info("Maximum rack count reached, nodes will be packed into existing racks", "MinRacks", minRacks, "MaxRacks", maxRacks)
+		minRacks = maxRacks
+	}
+
+	nodeRacks = nodeRacks.DeepCopy()
+	// the nodes of the racks managed by the admin are placed already, and
+	// no other node is placed in them
+	generatedRacks := getGeneratedRacks(nodeRacks, rackPrefix)
+	nodesByName := getNodesByName(nodes)
+	rackedNodes := map[string]struct{}{}
+	for _, nodeNames := range nodeRacks.Labels {
+		for _, nodeName := range nodeNames {
+			rackedNodes[nodeName] = struct{}{}
+		}
+	}
+
+	for _, node := range nodes.Items {
+		if _, hasRack := rackedNodes[node.Name]; !hasRack {
+			rack, err := getPreferredRack(nodes, nodeRacks, node)
+			if err != nil {
+				return plan, newTopologyError(ErrRackAssignment, err)
+			}
+			if rack != "" {
+				reqLogger.Info("Placing node in its preferred rack", "Node", node.Name, "Rack", rack)
+			} else if knownRack, ok := knownRacks[node.Name]; ok && isRackInZone(nodes, nodeRacks, knownRack, nodeZone(node)) {
+				reqLogger.Info("Restoring the known rack of node", "Node", node.Name, "Rack", knownRack)
+				rack = knownRack
+			} else if csiRack := nodeCSIRack(node); csiRack != "" && isRackInZone(nodes, nodeRacks, csiRack, nodeZone(node)) {
+				reqLogger.Info("Using the CSI rack label of node", "Node", node.Name, "Rack", csiRack)
+				rack = csiRack
+			} else if zone := nodeZone(node); minRacksPerZone > 0 && zone != "" && len(getZoneRacks(nodes, nodeRacks)[zone]) < minRacksPerZone {
+				if canDefineRack(generatedRacks, maxRacks) {
+					rack = getEmptyRack(nodeRacks, rackPrefix)
+				} else {
+					reqLogger.Info("Maximum rack count reached, node is packed into an existing rack instead of a new rack of its zone", "Node", node.Name, "Zone", zone, "MaxRacks", maxRacks)
+				}
+			}
+			if rack == "" {
+				rack = determinePlacementRack(nodesByName, node, minRacks, maxRacks, rackPrefix, topologyLabelKeys, capacityKey, generatedRacks)
+				if maxRacks > 0 && !isRackInZone(nodes, generatedRacks, rack, nodeZone(node)) {
+					reqLogger.Info("Maximum rack count reached, node is packed into a rack of another zone", "Node", node.Name, "Rack", rack, "MaxRacks", maxRacks)
+				}
+			}
+			nodeRacks.Add(rack, node.Name)
+			if isGeneratedRack(rack, rackPrefix) {
+				generatedRacks.Add(rack, node.Name)
+			}
+			plan[node.Name] = rack
+		}
+	}
+
+	return plan, nil
+}
+
+func generateStrategicPatch(oldObj, newObj interface{}) (client.Patch, error) {
+	oldJSON, err := json.Marshal(oldObj)
+	if err != nil {
+		return nil, err
+	}
+
+	newJSON, err := json.Marshal(newObj)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := strategicpatch.CreateTwoWayMergePatch(oldJSON, newJSON, oldObj)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.ConstantPatch(types.StrategicMergePatchType, patch), nil
+}
+
+// removeDeselectedNodeRacks removes the rack topology label the operator
+// applied to the nodes which are not among the given storage nodes anymore,
+// so that a stale rack is not picked up again when the node is re-added.
+// Rack labels the operator did not apply, or which were changed since, are
+// kept.
+func (r *ReconcileStorageCluster) removeDeselectedNodeRacks(ctx context.Context, nodes *corev1.NodeList, reqLogger logr.Logger) error {
+	allNodes := &corev1.NodeList{}
+	err := r.getTopologyClient().List(ctx, allNodes)
+	if err != nil {
+		return err
+	}
+	storageNodes := getNodesByName(nodes)
+
+	for i := range allNodes.Items {
+		node := &allNodes.Items[i]
+		if _, ok := storageNodes[node.Name]; ok {
+			continue
+		}
+		rack, ok := node.Annotations[operatorRackAnnotation]
+		if !ok {
+			continue
+		}
+		newNode := node.DeepCopy()
+		delete(newNode.Annotations, operatorRackAnnotation)
+		if node.Labels[defaults.RackTopologyKey] == rack {
+			reqLogger.Info("Removing rack label from deselected node", "Node", node.Name, "Label", defaults.RackTopologyKey, "Value", rack)
+			delete(newNode.Labels, defaults.RackTopologyKey)
+		}
+		patch, err := generateStrategicPatch(node, newNode)
+		if err != nil {
+			return err
+		}
+		err = r.getTopologyClient().Patch(ctx, node, patch)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getNodesByName returns the given nodes keyed by their name
+func getNodesByName(nodes *corev1.NodeList) map[string]corev1.Node {
+	nodesByName := make(map[string]corev1.Node, len(nodes.Items))
+	for _, node := range nodes.Items {
+		nodesByName[node.Name] = node
+	}
+
+	return nodesByName
+}
+
+// determinePlacementRack sorts the list of known racks in alphabetical order,
+// counts the number of Nodes in each rack, then returns the first rack with
+// the fewest number of Nodes. If there are fewer than minRacks racks, define
+// new racks named after rackPrefix so that there are at least minRacks. It
+// also ensures that only racks with either no nodes or nodes in the same AZ
+// are considered valid racks, defining a new rack if there is no valid one.
+// The AZ of a node is read from its labels matching topologyLabelKeys.
+//
+// The racks are shared between the AZs in proportion to their number of
+// nodes in nodesByName, see getZoneRackShares. Once the AZ of the node holds
+// its share of the racks, the node is placed in one of them rather than in
+// an empty rack, leaving the empty racks to the other AZs. The alphabetical
+// order only breaks the remaining ties, or all of them when the node has no
+// AZ.
+//
+// If capacityKey is set, the rack with the least total capacity of its nodes
+// in nodesByName is returned instead of the one with the fewest nodes, see
+// getNodeCapacity.
+//
+// If maxRacks is non-zero and all the racks hold nodes from other AZs, no
+// new rack is defined once there are maxRacks racks, the node is packed into
+// the least loaded of them instead.
+func determinePlacementRack(nodesByName map[string]corev1.Node, node corev1.Node, minRacks, maxRacks int, rackPrefix string, topologyLabelKeys []string, capacityKey string, nodeRacks *ocsv1.NodeTopologyMap) string {
+	rackList := []string{}
+
+	if len(nodeRacks.Labels) < minRacks {
+		for i := len(nodeRacks.Labels); i < minRacks; i++ {
+			for j := 0; j <= i; j++ {
+				newRack := fmt.Sprintf("%s%d", rackPrefix, j)
+				if _, ok := nodeRacks.Labels[newRack]; !ok {
+					nodeRacks.Labels[newRack] = ocsv1.TopologyLabelValues{}
+					break
+				}
+			}
+		}
+	}
+
+	targetAZ := getNodeZone(node, topologyLabelKeys)
+
+	if len(targetAZ) > 0 {
+		zoneRacks := []string{}
+		for rack := range nodeRacks.Labels {
+			nodeNames := nodeRacks.Labels[rack]
+			if len(nodeNames) == 0 {
+				rackList = append(rackList, rack)
+				continue
+			}
+
+			validRack := false
+			for _, nodeName := range nodeNames {
+				n, ok := nodesByName[nodeName]
+				if ok && getNodeZone(n, topologyLabelKeys) == targetAZ {
+					validRack = true
+					break
+				}
+			}
+			if validRack {
+				rackList = append(rackList, rack)
+				zoneRacks = append(zoneRacks, rack)
+			}
+		}
+		shares := getZoneRackShares(nodesByName, len(nodeRacks.Labels), topologyLabelKeys)
+		if len(zoneRacks) > 0 && len(zoneRacks) >= shares[targetAZ] {
+			rackList = zoneRacks
+		}
+	} else {
+		for rack := range nodeRacks.Labels {
+			rackList = append(rackList, rack)
+		}
+	}
+
+	// all the racks hold nodes from other zones
+	if len(rackList) == 0 {
+		if canDefineRack(nodeRacks, maxRacks) {
+			return getEmptyRack(nodeRacks, rackPrefix)
+		}
+		for rack := range nodeRacks.Labels {
+			rackList = append(rackList, rack)
+		}
+	}
+
+	sort.Strings(rackList)
+	rack := rackList[0]
+
+	if capacityKey != "" {
+		capacity := getRackCapacity(nodesByName, nodeRacks.Labels[rack], capacityKey)
+		for _, r := range rackList {
+			if c := getRackCapacity(nodesByName, nodeRacks.Labels[r], capacityKey); c < capacity {
+				rack, capacity = r, c
+			}
+		}
+
+		return rack
+	}
+
+	for _, r := range rackList {
+		if len(nodeRacks.Labels[r]) < len(nodeRacks.Labels[rack]) {
+			rack = r
+		}
+	}
+
+	return rack
+}
+
+// getNodeCapacity returns the capacity of the given node in thousandths of
+// its unit. It is read from the node label named capacityKey, holding a
+// quantity such as "4Ti", or from the allocatable node resource of that
+// name, e.g. "ephemeral-storage" or "cpu". A node without a valid capacity
+// has none.
+func getNodeCapacity(node corev1.Node, capacityKey string) int64 {
+	if value, ok := node.Labels[capacityKey]; ok {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return 0
+		}
+		return quantity.MilliValue()
+	}
+	if quantity, ok := node.Status.Allocatable[corev1.ResourceName(capacityKey)]; ok {
+		return quantity.MilliValue()
+	}
+
+	return 0
+}
+
+// getRackCapacity returns the total capacity of the named nodes of a rack,
+// see getNodeCapacity
+func getRackCapacity(nodesByName map[string]corev1.Node, nodeNames []string, capacityKey string) int64 {
+	capacity := int64(0)
+	for _, nodeName := range nodeNames {
+		if node, ok := nodesByName[nodeName]; ok {
+			capacity += getNodeCapacity(node, capacityKey)
+		}
+	}
+
+	return capacity
+}
+
+// getNodeZone returns the value of the first zone label of the given node,
+// in alphabetical order, among its labels matching topologyLabelKeys, or an
+// empty string if it has none
+func getNodeZone(node corev1.Node, topologyLabelKeys []string) string {
+	zoneLabels := []string{}
+	for label := range node.Labels {
+		for _, key := range topologyLabelKeys {
+			if matchesTopologyLabelKey(label, key) && ocsv1.IsTopologyLabelOf(label, "zone") {
+				zoneLabels = append(zoneLabels, label)
+				break
+			}
+		}
+	}
+	if len(zoneLabels) == 0 {
+		return ""
+	}
+	sort.Strings(zoneLabels)
+
+	return node.Labels[zoneLabels[0]]
+}
+
+// getZoneRackShares shares rackCount racks between the AZs of the given
+// nodes in proportion to their number of nodes. The racks left over by
+// rounding down go to the AZs with the largest remainders, then in
+// alphabetical order of the AZs.
+func getZoneRackShares(nodesByName map[string]corev1.Node, rackCount int, topologyLabelKeys []string) map[string]int {
+	zoneNodes := map[string]int{}
+	zonedNodes := 0
+	for _, node := range nodesByName {
+		if zone := getNodeZone(node, topologyLabelKeys); zone != "" {
+			zoneNodes[zone]++
+			zonedNodes++
+		}
+	}
+
+	shares := map[string]int{}
+	if zonedNodes == 0 {
+		return shares
+	}
+	zones := []string{}
+	assigned := 0
+	for zone, count := range zoneNodes {
+		shares[zone] = rackCount * count / zonedNodes
+		assigned += shares[zone]
+		zones = append(zones, zone)
+	}
+	remainder := func(zone string) int {
+		return rackCount * zoneNodes[zone] % zonedNodes
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		if remainder(zones[i]) != remainder(zones[j]) {
+			return remainder(zones[i]) > remainder(zones[j])
+		}
+		return zones[i] < zones[j]
+	})
+	for i := 0; i < rackCount-assigned; i++ {
+		shares[zones[i]]++
+	}
+
+	return shares
+}
+
+// ensureCephConfig ensures that a ConfigMap resource exists with its Spec in
+// the desired state.
+func (r *ReconcileStorageCluster) ensureCephConfig(sc *ocsv1.StorageCluster, reqLogger logr.Logger) error {
+	ownerRef := metav1.OwnerReference{
+		UID:        sc.UID,
+		APIVersion: sc.APIVersion,
+		Kind:       sc.Kind,
+		Name:       sc.Name,
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            rookConfigMapName,
+			Namespace:       sc.Namespace,
+			OwnerReferences: []metav1.OwnerReference{ownerRef},
+		},
+		Data: map[string]string{
+			"config": rookConfigData,
+		},
+	}
+
+	found := &corev1.ConfigMap{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: rookConfigMapName, Namespace: sc.Namespace}, found)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			reqLogger.Info("Creating Ceph ConfigMap")
+			err = r.client.Create(context.TODO(), cm)
+			if err != nil {
+				return err
+			}
+		}
+		return err
+	}
+
+	ownerRefFound := false
+	for _, ownerRef := range found.OwnerReferences {
+		if ownerRef.UID == sc.UID {
+			ownerRefFound = true
+		}
+	}
+	val, ok := found.Data["config"]
+	if ok != true || val != rookConfigData || ownerRefFound != true {
+		reqLogger.Info("Updating Ceph ConfigMap")
+		return r.client.Update(context.TODO(), cm)
+	}
+	return nil
+}
+
+// getTopologyConfigMapName returns the name of the ConfigMap holding the
+// node topology map of the StorageCluster
+func getTopologyConfigMapName(sc *ocsv1.StorageCluster) string {
+	return fmt.Sprintf("%s-node-topology", sc.Name)
+}
+
+// ensureTopologyConfigMap ensures that a ConfigMap in the namespace of the
+// StorageCluster holds its node topology map as JSON, so that it can be read
+// without access to the StorageCluster status. The topology generation
+// annotation of the ConfigMap is incremented whenever the map changes.
+func (r *ReconcileStorageCluster) ensureTopologyConfigMap(ctx context.Context, sc *ocsv1.StorageCluster, reqLogger logr.Logger) error {
+	topology, err := json.Marshal(sc.Status.NodeTopologies)
+	if err != nil {
+		return err
+	}
+
+	found := &corev1.ConfigMap{}
+	err = r.client.Get(ctx, types.NamespacedName{Name: getTopologyConfigMapName(sc), Namespace: sc.Namespace}, found)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        getTopologyConfigMapName(sc),
+				Namespace:   sc.Namespace,
+				Annotations: map[string]string{topologyGenerationAnnotation: "1"},
+			},
+			Data: map[string]string{topologyConfigMapKey: string(topology)},
+		}
+		if err = controllerutil.SetControllerReference(sc, cm, r.scheme); err != nil {
+			return err
+		}
+		reqLogger.Info("Creating node topology ConfigMap", "ConfigMap", cm.Name)
+		return r.client.Create(ctx, cm)
+	}
+
+	if found.Data[topologyConfigMapKey] == string(topology) {
+		return nil
+	}
+
+	generation, _ := strconv.Atoi(found.Annotations[topologyGenerationAnnotation])
+	updated := found.DeepCopy()
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	updated.Annotations[topologyGenerationAnnotation] = strconv.Itoa(generation + 1)
+	if updated.Data == nil {
+		updated.Data = map[string]string{}
+	}
+	updated.Data[topologyConfigMapKey] = string(topology)
+	patch, err := generateStrategicPatch(found, updated)
+	if err != nil {
+		return err
+	}
+
+	reqLogger.Info("Updating node topology ConfigMap", "ConfigMap", found.Name, "Generation", generation+1)
+	return r.client.Patch(ctx, found, patch)
+}
+
+// waitForStorageNodes marks the StorageCluster as progressing while fewer
+// storage nodes than required are found, and requeues it after a delay
+// growing with every consecutive wait
+func (r *ReconcileStorageCluster) waitForStorageNodes(ctx context.Context, sc *ocsv1.StorageCluster, reqLogger logr.Logger) (reconcile.Result, error) {
+	delay := getInsufficientNodesRequeueDelay(r.nodeWaits)
+	r.nodeWaits++
+
+	minNodes := getMinimumNodes(sc)
+	message := fmt.Sprintf("Waiting for %d more storage nodes, found %d of the %d required", minNodes-r.nodeCount, r.nodeCount, minNodes)
+	reqLogger.Info(message, "RequeueAfter", delay)
+	statusutil.SetProgressingCondition(&sc.Status.Conditions, "WaitingForNodes", message)
+	setTopologyReadyCondition(sc, corev1.ConditionFalse, "WaitingForNodes", r.nodeCount, fmt.Sprintf("%d storage nodes are required", minNodes))
+	if err := r.client.Status().Update(ctx, sc); err != nil {
+		reqLogger.Error(err, "Failed to update status")
+		return reconcile.Result{}, err
+	}
+
+	return reconcile.Result{RequeueAfter: delay}, nil
+}
+
+// getInsufficientNodesRequeueDelay returns the delay before reconciling a
+// StorageCluster again after the given number of consecutive waits for
+// enough storage nodes
+func getInsufficientNodesRequeueDelay(waits int) time.Duration {
+	delay := insufficientNodesRequeueDelay
+	for i := 0; i < waits && delay < maxInsufficientNodesRequeueDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxInsufficientNodesRequeueDelay {
+		return maxInsufficientNodesRequeueDelay
+	}
+
+	return delay
+}
+
+// determineFailureDomain determines the appropriate Ceph failure domain based
+// on the storage cluster's topology map and the failure domain requested or
+// preferred in its spec. The preferred failure domain is used without any
+// fallback, validatePreferredFailureDomain fails the reconcile until the
+// storage nodes provide it.
+func determineFailureDomain(sc *ocsv1.StorageCluster) string {
+	if sc.Status.FailureDomain != "" {
+		return sc.Status.FailureDomain
+	}
+	return failureDomainFromTopology(sc.Status.NodeTopologies, getFailureDomainWeights(sc), getPreferredZoneKey(sc), getPreferredFailureDomain(sc) != "")
+}
+
+// getPreferredFailureDomain returns the failure domain preferred by the
+// StorageCluster, host when it uses FlexibleScaling, or an empty string if
+// none is
+func getPreferredFailureDomain(sc *ocsv1.StorageCluster) string {
+	if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.PreferredFailureDomain != "" {
+		return sc.Spec.NodeTopologies.PreferredFailureDomain
+	}
+	if sc.Spec.FlexibleScaling {
+		return "host"
+	}
+
+	return ""
+}
+
+// failureDomainTypes lists the failure domain types failureDomainFromTopology
+// picks from
+var failureDomainTypes = []string{"datacenter", "zone", "rack", "host"}
+
+// failureDomainFromTopology determines the appropriate Ceph failure domain
+// for the given topology map, picking the failure domain with the highest
+// weight that the topology provides. If preferred, the failure domain with
+// the highest weight, i.e. the preferred one, is picked whether the topology
+// provides it or not. The zones are detected with the zoneKey label if set.
+func failureDomainFromTopology(topologyMap *ocsv1.NodeTopologyMap, weights map[string]int, zoneKey string, preferred bool) string {
+	failureDomains := append([]string{}, failureDomainTypes...)
+	sort.SliceStable(failureDomains, func(i, j int) bool {
+		return weights[failureDomains[i]] > weights[failureDomains[j]]
+	})
+	if preferred {
+		return failureDomains[0]
+	}
+
+	for _, failureDomain := range failureDomains {
+		switch failureDomain {
+		case "datacenter", "zone":
+			// the label is picked in a fixed order, as several labels
+			// may carry the same failure domain
+			label, labelValues := getTopologyKeyValues(topologyMap, failureDomain, zoneKey)
+			if (label == zoneKey || ocsv1.IsTopologyLabelOf(label, failureDomain)) && countDistinctValues(labelValues) >= 3 {
+				return failureDomain
+			}
+		case "rack", "host":
+			// racks are generated by the operator when missing, and
+			// every node is a host
+			return failureDomain
+		}
+	}
+
+	return "rack"
+}
 
 func (r *ReconcileStorageCluster) throttleStorageDevices(storageClassName string) (bool, error) {
 	storageClass := &storagev1.StorageClass{}
@@ -729,7 +2055,7 @@ func (r *ReconcileStorageCluster) throttleStorageDevices(storageClassName string
 	}
 	switch storageClass.Provisioner {
 	case string(EBS):
-		if contains(throttleDiskTypes, storageClass.Parameters["type"]) {
+		if statusutil.ContainsString(throttleDiskTypes, storageClass.Parameters["type"]) {
 			return true, nil
 		}
 	}
@@ -838,27 +2164,6 @@ func (r *ReconcileStorageCluster) deleteResources(sc *ocsv1.StorageCluster, reqL
 	return finalerr
 }
 
-// Checks whether a string is contained within a slice
-func contains(slice []string, s string) bool {
-	for _, item := range slice {
-		if item == s {
-			return true
-		}
-	}
-	return false
-}
-
-// Removes a given string from a slice and returns the new slice
-func remove(slice []string, s string) (result []string) {
-	for _, item := range slice {
-		if item == s {
-			continue
-		}
-		result = append(result, item)
-	}
-	return
-}
-
 // ensureJobTemplates ensures if the osd removal job template exists
 func (r *ReconcileStorageCluster) ensureJobTemplates(sc *ocsv1.StorageCluster, reqLogger logr.Logger) error {
 	osdCleanUpTemplate := &openshiftv1.Template{
@@ -3,6 +3,7 @@ package storagecluster
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/go-logr/logr"
 	nbv1 "github.com/noobaa/noobaa-operator/v2/pkg/apis/noobaa/v1alpha1"
@@ -11,6 +12,7 @@ import (
 	cephv1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/event"
@@ -64,6 +66,7 @@ func newReconciler(mgr manager.Manager) reconcile.Reconciler {
 		scheme:    mgr.GetScheme(),
 		reqLogger: log,
 		platform:  &CloudPlatform{},
+		recorder:  mgr.GetEventRecorderFor("storagecluster-controller"),
 	}
 
 	err := r.initializeImageVars()
@@ -147,4 +150,21 @@ type ReconcileStorageCluster struct {
 	noobaaCoreImage string
 	nodeCount       int
 	platform        *CloudPlatform
+	tracer          topologyTracer
+	recorder        record.EventRecorder
+	// nodeClient lists and patches the nodes in the topology code, if set
+	nodeClient topologyClient
+	// nodeWaits is the number of consecutive reconciles which found fewer
+	// storage nodes than required
+	nodeWaits int
+	// failureDomainNodes is the number of eligible storage nodes in each
+	// value of the failure domain, as found by the last reconcile of the
+	// node topology
+	failureDomainNodes map[string]int
+	// nodeRackEvents holds the last time a node was recorded to be labeled
+	// with a rack, keyed by "<node>/<rack>"
+	nodeRackEvents map[string]time.Time
+	// requeueAfter is the delay before reconciling the StorageCluster again
+	// requested by the ensure functions of the current reconcile, if any
+	requeueAfter time.Duration
 }
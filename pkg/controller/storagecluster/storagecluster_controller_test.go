@@ -1,8 +1,11 @@
 package storagecluster
 
 import (
+	"context"
+	stderrors "errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/noobaa/noobaa-operator/v2/pkg/apis/noobaa/v1alpha1"
 	openshiftv1 "github.com/openshift/api/template/v1"
@@ -17,6 +20,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
@@ -116,6 +120,11 @@ var mockNodeList = &corev1.NodeList{
 					defaults.NodeAffinityKey: "",
 				},
 			},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{
+					{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+				},
+			},
 		},
 		corev1.Node{
 			TypeMeta: metav1.TypeMeta{
@@ -129,6 +138,11 @@ var mockNodeList = &corev1.NodeList{
 					defaults.NodeAffinityKey: "",
 				},
 			},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{
+					{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+				},
+			},
 		},
 		corev1.Node{
 			TypeMeta: metav1.TypeMeta{
@@ -142,6 +156,11 @@ var mockNodeList = &corev1.NodeList{
 					defaults.NodeAffinityKey: "",
 				},
 			},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{
+					{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+				},
+			},
 		},
 	},
 }
@@ -211,7 +230,7 @@ func TestNonWatchedReconcileWithTheCephClusterType(t *testing.T) {
 	err = reconciler.client.Get(nil, mockStorageClusterRequest.NamespacedName, actual)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, actual.Status.Conditions)
-	assert.Len(t, actual.Status.Conditions, 5)
+	assert.Len(t, actual.Status.Conditions, 6)
 
 	assertExpectedCondition(t, actual.Status.Conditions)
 }
@@ -220,11 +239,45 @@ func TestNodeTopologyMapNoNodes(t *testing.T) {
 	nodeList := &corev1.NodeList{}
 
 	reconciler := createFakeStorageClusterReconciler(t, mockStorageCluster, nodeList)
-	err := reconciler.reconcileNodeTopologyMap(mockStorageCluster, reconciler.reqLogger)
-	assert.Equal(t, err, fmt.Errorf("Not enough nodes found: Expected %d, found %d", defaults.DeviceSetReplica, len(nodeList.Items)))
+	err := reconcileTestNodeTopologyMap(&reconciler, mockStorageCluster)
+	assert.EqualError(t, err, fmt.Sprintf("Not enough nodes found: Expected %d, found %d", defaults.DeviceSetReplica, len(nodeList.Items)))
+	assert.True(t, stderrors.Is(err, ErrInsufficientNodes))
+	assert.True(t, stderrors.Is(err, ErrTopologyReconcile))
+	assert.False(t, stderrors.Is(err, ErrRackAssignment))
 	assert.Equal(t, reconciler.nodeCount, 0)
 }
 
+func TestReconcileInsufficientNodesRequeue(t *testing.T) {
+	reconciler := createFakeStorageClusterReconciler(t, mockStorageCluster.DeepCopy(), &corev1.NodeList{})
+	for _, delay := range []time.Duration{insufficientNodesRequeueDelay, 2 * insufficientNodesRequeueDelay, 4 * insufficientNodesRequeueDelay} {
+		result, err := reconciler.Reconcile(mockStorageClusterRequest)
+		assert.NoError(t, err)
+		assert.Equal(t, reconcile.Result{RequeueAfter: delay}, result)
+	}
+
+	actual := &api.StorageCluster{}
+	err := reconciler.client.Get(nil, mockStorageClusterRequest.NamespacedName, actual)
+	assert.NoError(t, err)
+	condition := conditionsv1.FindStatusCondition(actual.Status.Conditions, conditionsv1.ConditionProgressing)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionTrue, condition.Status)
+	assert.Equal(t, "WaitingForNodes", condition.Reason)
+	assert.Equal(t, fmt.Sprintf("Waiting for %d more storage nodes, found 0 of the %d required", defaults.DeviceSetReplica, defaults.DeviceSetReplica), condition.Message)
+
+	condition = conditionsv1.FindStatusCondition(actual.Status.Conditions, api.ConditionTopologyReady)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, "WaitingForNodes", condition.Reason)
+	assert.Contains(t, condition.Message, "Found 0 storage nodes")
+}
+
+func TestGetInsufficientNodesRequeueDelay(t *testing.T) {
+	assert.Equal(t, insufficientNodesRequeueDelay, getInsufficientNodesRequeueDelay(0))
+	assert.Equal(t, 8*insufficientNodesRequeueDelay, getInsufficientNodesRequeueDelay(3))
+	assert.Equal(t, maxInsufficientNodesRequeueDelay, getInsufficientNodesRequeueDelay(10))
+	assert.Equal(t, maxInsufficientNodesRequeueDelay, getInsufficientNodesRequeueDelay(1000))
+}
+
 func TestNodeTopologyMapPreexistingRack(t *testing.T) {
 	sc := &api.StorageCluster{}
 	mockStorageCluster.DeepCopyInto(sc)
@@ -248,7 +301,7 @@ func TestNodeTopologyMapPreexistingRack(t *testing.T) {
 	}
 
 	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
-	err := reconciler.reconcileNodeTopologyMap(sc, reconciler.reqLogger)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
 	assert.NoError(t, err)
 	assert.Equal(t, reconciler.nodeCount, 3)
 
@@ -275,7 +328,7 @@ func TestNodeTopologyMapTwoAZ(t *testing.T) {
 	}
 
 	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
-	err := reconciler.reconcileNodeTopologyMap(sc, reconciler.reqLogger)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
 	assert.NoError(t, err)
 
 	nodeTopologyMap.Add(defaults.RackTopologyKey, "rack0")
@@ -288,6 +341,45 @@ func TestNodeTopologyMapTwoAZ(t *testing.T) {
 	assert.Equal(t, nodeTopologyMap, actual.Status.NodeTopologies)
 }
 
+func TestNodeTopologyMapMaxRackCount(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Spec.StorageDeviceSets = []api.StorageDeviceSet{{Replica: 5}}
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{MaxRackCount: 3}
+
+	nodeList := &corev1.NodeList{}
+	for i := 1; i <= 5; i++ {
+		name := fmt.Sprintf("node%d", i)
+		nodeList.Items = append(nodeList.Items, corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					hostnameLabel:            name,
+					defaults.NodeAffinityKey: "",
+				},
+			},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{
+					{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+				},
+			},
+		})
+	}
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+
+	racks := map[string]int{}
+	for _, n := range nodeList.Items {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+		assert.NoError(t, err)
+		racks[node.Labels[defaults.RackTopologyKey]]++
+	}
+	assert.Equal(t, map[string]int{"rack0": 2, "rack1": 2, "rack2": 1}, racks)
+}
+
 func TestNodeTopologyMapThreeAZ(t *testing.T) {
 	sc := &api.StorageCluster{}
 	mockStorageCluster.DeepCopyInto(sc)
@@ -305,7 +397,7 @@ func TestNodeTopologyMapThreeAZ(t *testing.T) {
 	}
 
 	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
-	err := reconciler.reconcileNodeTopologyMap(sc, reconciler.reqLogger)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
 	assert.NoError(t, err)
 
 	actual := &api.StorageCluster{}
@@ -539,7 +631,7 @@ func TestStorageClusterInitConditions(t *testing.T) {
 	err = reconciler.client.Get(nil, mockStorageClusterRequest.NamespacedName, actual)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, actual.Status.Conditions)
-	assert.Len(t, actual.Status.Conditions, 5)
+	assert.Len(t, actual.Status.Conditions, 6)
 
 	assertExpectedCondition(t, actual.Status.Conditions)
 }
@@ -611,6 +703,7 @@ func assertExpectedCondition(t *testing.T, conditions []conditionsv1.Condition)
 		conditionsv1.ConditionProgressing: corev1.ConditionTrue,
 		conditionsv1.ConditionDegraded:    corev1.ConditionFalse,
 		conditionsv1.ConditionUpgradeable: corev1.ConditionUnknown,
+		api.ConditionTopologyReady:        corev1.ConditionTrue,
 	}
 	for cType, status := range expectedConditions {
 		found := assertCondition(conditions, cType, status)
@@ -629,6 +722,29 @@ func assertCondition(conditions []conditionsv1.Condition, conditionType conditio
 	return false
 }
 
+// reconcileTestNodeTopologyMap lists the storage nodes of the StorageCluster
+// and reconciles its node topology map with them, as Reconcile does
+func reconcileTestNodeTopologyMap(reconciler *ReconcileStorageCluster, sc *api.StorageCluster) error {
+	selectedNodes, err := reconciler.getStorageClusterNodes(context.TODO(), sc)
+	if err != nil {
+		return err
+	}
+	nodes := getEligibleNodes(sc, selectedNodes, reconciler.reqLogger)
+
+	return reconciler.reconcileNodeTopologyMap(context.TODO(), sc, nodes, selectedNodes, reconciler.reqLogger)
+}
+
+// reconcileTestTopologyPhase lists the storage nodes of the StorageCluster
+// and reconciles its topology phase with them, as Reconcile does
+func reconcileTestTopologyPhase(reconciler *ReconcileStorageCluster, sc *api.StorageCluster, topologyErr error) error {
+	nodes, err := reconciler.getStorageClusterEligibleNodes(context.TODO(), sc, reconciler.reqLogger)
+	if err != nil {
+		return err
+	}
+
+	return reconciler.reconcileTopologyPhase(context.TODO(), sc, nodes, topologyErr, reconciler.reqLogger)
+}
+
 func createFakeStorageClusterReconciler(t *testing.T, obj ...runtime.Object) ReconcileStorageCluster {
 	scheme := createFakeScheme(t)
 	client := fake.NewFakeClientWithScheme(scheme, obj...)
@@ -638,6 +754,7 @@ func createFakeStorageClusterReconciler(t *testing.T, obj ...runtime.Object) Rec
 		scheme:    scheme,
 		reqLogger: logf.Log.WithName("controller_storagecluster_test"),
 		platform:  &CloudPlatform{},
+		recorder:  record.NewFakeRecorder(1024),
 	}
 }
 
@@ -699,7 +816,7 @@ func TestNodeTopologyMapLabelSelector(t *testing.T) {
 		nodeList.Items[i].ObjectMeta.Labels[WorkerAffinityKey] = ""
 	}
 	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
-	reconciler.reconcileNodeTopologyMap(sc, reconciler.reqLogger)
+	reconcileTestNodeTopologyMap(&reconciler, sc)
 	nodeTopologyMap := &api.NodeTopologyMap{
 		Labels: map[string]api.TopologyLabelValues{
 			zoneTopologyLabel: []string{
@@ -711,3 +828,186 @@ func TestNodeTopologyMapLabelSelector(t *testing.T) {
 	}
 	assert.Equal(t, nodeTopologyMap, sc.Status.NodeTopologies)
 }
+
+func TestNodeTopologyMapNodeLabelSelector(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	nodeList := &corev1.NodeList{}
+	mockNodeList.DeepCopyInto(nodeList)
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+
+	actual := &api.StorageCluster{}
+	err = reconciler.client.Get(nil, mockStorageClusterRequest.NamespacedName, actual)
+	assert.NoError(t, err)
+	assert.Equal(t, defaults.NodeAffinityKey+"=", actual.Status.NodeLabelSelector)
+
+	sc.Spec.LabelSelector = &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			metav1.LabelSelectorRequirement{
+				Key:      defaults.NodeAffinityKey,
+				Operator: metav1.LabelSelectorOpExists,
+			},
+		},
+	}
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+
+	err = reconciler.client.Get(nil, mockStorageClusterRequest.NamespacedName, actual)
+	assert.NoError(t, err)
+	assert.Equal(t, defaults.NodeAffinityKey, actual.Status.NodeLabelSelector)
+}
+
+func TestValidateNodeLabelSelectors(t *testing.T) {
+	cases := []struct {
+		label         string
+		labelSelector *metav1.LabelSelector
+		expectedError string
+	}{
+		{
+			label: "invalid operator",
+			labelSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "example.com/storage", Operator: "Equals", Values: []string{"ssd"}},
+			}},
+			expectedError: `invalid node label selector expression {key: "example.com/storage", operator: "Equals", values: [ssd]}`,
+		},
+		{
+			label:         "empty selector",
+			labelSelector: &metav1.LabelSelector{},
+		},
+		{
+			label: "well-formed expressions",
+			labelSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "example.com/storage", Operator: metav1.LabelSelectorOpIn, Values: []string{"ssd", "nvme"}},
+				{Key: "example.com/maintenance", Operator: metav1.LabelSelectorOpDoesNotExist},
+			}},
+		},
+	}
+
+	for _, c := range cases {
+		sc := &api.StorageCluster{}
+		mockStorageCluster.DeepCopyInto(sc)
+		sc.Spec.LabelSelector = c.labelSelector
+		err := validateNodeLabelSelectors(sc)
+		if c.expectedError == "" {
+			assert.NoError(t, err, c.label)
+			continue
+		}
+		assert.Error(t, err, c.label)
+		assert.Contains(t, err.Error(), c.expectedError, c.label)
+
+		// the additional selectors are validated too
+		sc.Spec.LabelSelector = nil
+		sc.Spec.NodeTopologies = &api.NodeTopologySpec{LabelSelectors: []*metav1.LabelSelector{c.labelSelector}}
+		assert.Error(t, validateNodeLabelSelectors(sc), c.label)
+	}
+}
+
+func TestReconcileInvalidLabelSelector(t *testing.T) {
+	sc := mockStorageCluster.DeepCopy()
+	sc.Spec.LabelSelector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+		{Key: "example.com/storage", Operator: "Equals"},
+	}}
+	reconciler := createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+	result, err := reconciler.Reconcile(mockStorageClusterRequest)
+	assert.NoError(t, err)
+	assert.Equal(t, reconcile.Result{}, result)
+
+	actual := &api.StorageCluster{}
+	err = reconciler.client.Get(nil, mockStorageClusterRequest.NamespacedName, actual)
+	assert.NoError(t, err)
+	condition := conditionsv1.FindStatusCondition(actual.Status.Conditions, api.ConditionReconcileComplete)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, "InvalidLabelSelector", condition.Reason)
+	assert.Contains(t, condition.Message, `operator: "Equals"`)
+	// the nodes were not listed
+	assert.Empty(t, actual.Status.NodeTopologies.Labels)
+}
+
+func TestReconcileInvalidFieldSelector(t *testing.T) {
+	sc := mockStorageCluster.DeepCopy()
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{FieldSelector: "status.phase=Running"}
+	reconciler := createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+	result, err := reconciler.Reconcile(mockStorageClusterRequest)
+	assert.NoError(t, err)
+	assert.Equal(t, reconcile.Result{}, result)
+
+	actual := &api.StorageCluster{}
+	err = reconciler.client.Get(nil, mockStorageClusterRequest.NamespacedName, actual)
+	assert.NoError(t, err)
+	condition := conditionsv1.FindStatusCondition(actual.Status.Conditions, api.ConditionReconcileComplete)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, "InvalidFieldSelector", condition.Reason)
+	assert.Contains(t, condition.Message, `field "status.phase" is not supported for nodes`)
+}
+
+func TestReconcileInvalidNodeTopologySpec(t *testing.T) {
+	cases := []struct {
+		label          string
+		nodeTopologies *api.NodeTopologySpec
+		reason         string
+		message        string
+	}{
+		{
+			label:          "Case 1: invalid required topology key",
+			nodeTopologies: &api.NodeTopologySpec{RequiredTopologyKeys: []string{"-rack"}},
+			reason:         "InvalidTopologyKey",
+			message:        `invalid required topology key "-rack"`,
+		},
+		{
+			label:          "Case 2: negative failure domain weight",
+			nodeTopologies: &api.NodeTopologySpec{FailureDomainWeights: map[string]int{"zone": -1}},
+			reason:         "InvalidFailureDomainWeights",
+		},
+		{
+			label:          "Case 3: unknown aliased failure domain",
+			nodeTopologies: &api.NodeTopologySpec{FailureDomainAlias: map[string]string{"shelf": "chassis"}},
+			reason:         "InvalidFailureDomainAliases",
+			message:        `unknown failure domain "shelf"`,
+		},
+		{
+			label:          "Case 4: invalid rack prefix",
+			nodeTopologies: &api.NodeTopologySpec{RackPrefix: "-rack"},
+			reason:         "InvalidRackPrefix",
+			message:        `invalid rack prefix "-rack"`,
+		},
+		{
+			label:          "Case 5: minimum rack count below the replicas",
+			nodeTopologies: &api.NodeTopologySpec{MinRackCount: 2},
+			reason:         "InvalidMinRackCount",
+			message:        "invalid minimum rack count 2",
+		},
+	}
+
+	for _, c := range cases {
+		sc := mockStorageCluster.DeepCopy()
+		sc.Spec.NodeTopologies = c.nodeTopologies
+		reconciler := createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+		result, err := reconciler.Reconcile(mockStorageClusterRequest)
+		assert.NoErrorf(t, err, "[%s]: failed to reconcile", c.label)
+		assert.Equalf(t, reconcile.Result{}, result, "[%s]: unexpected result", c.label)
+
+		actual := &api.StorageCluster{}
+		err = reconciler.client.Get(nil, mockStorageClusterRequest.NamespacedName, actual)
+		assert.NoErrorf(t, err, "[%s]: failed to get the StorageCluster", c.label)
+		condition := conditionsv1.FindStatusCondition(actual.Status.Conditions, api.ConditionReconcileComplete)
+		if assert.NotNilf(t, condition, "[%s]: missing condition", c.label) {
+			assert.Equalf(t, corev1.ConditionFalse, condition.Status, "[%s]: unexpected condition status", c.label)
+			assert.Equalf(t, c.reason, condition.Reason, "[%s]: unexpected condition reason", c.label)
+			assert.Containsf(t, condition.Message, c.message, "[%s]: unexpected condition message", c.label)
+		}
+
+		recorder := reconciler.recorder.(*record.FakeRecorder)
+		if assert.Lenf(t, recorder.Events, 1, "[%s]: unexpected events", c.label) {
+			assert.Containsf(t, <-recorder.Events, "Warning "+c.reason, "[%s]: unexpected event", c.label)
+		}
+		// the nodes were not listed
+		if actual.Status.NodeTopologies != nil {
+			assert.Emptyf(t, actual.Status.NodeTopologies.Labels, "[%s]: unexpected node topology", c.label)
+		}
+	}
+}
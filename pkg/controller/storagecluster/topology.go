@@ -0,0 +1,2634 @@
+package storagecluster
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	conditionsv1 "github.com/openshift/custom-resource-status/conditions/v1"
+	ocsv1 "github.com/openshift/ocs-operator/pkg/apis/ocs/v1"
+	"github.com/openshift/ocs-operator/pkg/controller/defaults"
+	statusutil "github.com/openshift/ocs-operator/pkg/controller/util"
+	cephv1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// crushLocationAnnotation is the node annotation holding the CRUSH location
+// computed by the operator
+const crushLocationAnnotation = "ocs.openshift.io/crush-location"
+
+// preferredRackAnnotation is the node annotation holding the rack the node
+// must be placed in, instead of the one picked by the operator
+const preferredRackAnnotation = "ocs.openshift.io/preferred-rack"
+
+// operatorRackAnnotation is the node annotation holding the rack label the
+// operator applied to the node. Rack labels set by an admin are never
+// removed by the operator.
+const operatorRackAnnotation = "ocs.openshift.io/operator-rack"
+
+// excludeFromStorageAnnotation is the node annotation which, when set to
+// "true", keeps a node selected for the StorageCluster out of its storage
+// nodes, e.g. while it is drained. The node is included again once the
+// annotation is removed.
+const excludeFromStorageAnnotation = "ocs.openshift.io/exclude-from-storage"
+
+// topologyGenerationAnnotation is the annotation of the node topology
+// ConfigMap counting the changes of the node topology map it holds
+const topologyGenerationAnnotation = "ocs.openshift.io/topology-generation"
+
+// topologyConfigMapKey is the key of the node topology ConfigMap holding the
+// node topology map as JSON
+const topologyConfigMapKey = "topology.json"
+
+// bootstrapUntilAnnotation is the StorageCluster annotation which, until the
+// RFC 3339 time it holds, lets the StorageCluster be reconciled with fewer
+// storage nodes than required. It is removed once enough nodes are found.
+const bootstrapUntilAnnotation = "ocs.openshift.io/bootstrap-until"
+
+var (
+	// ErrTopologyReconcile matches every error returned while reconciling
+	// the node topology of a StorageCluster
+	ErrTopologyReconcile = errors.New("failed to reconcile the node topology")
+	// ErrInsufficientNodes matches the errors due to fewer storage nodes
+	// than required, which are resolved once enough nodes join
+	ErrInsufficientNodes = errors.New("Not enough nodes found")
+	// ErrRackAssignment matches the errors labeling storage nodes with racks
+	ErrRackAssignment = errors.New("failed to assign racks to nodes")
+	// ErrInsufficientFailureDomains matches the errors due to a failure
+	// domain providing fewer values than the replica count
+	ErrInsufficientFailureDomains = errors.New("Not enough failure domain values found")
+)
+
+// TopologyError is the error returned while reconciling the node topology.
+// It matches ErrTopologyReconcile and its Reason, if any, with errors.Is.
+type TopologyError struct {
+	// Reason is either ErrInsufficientNodes, ErrRackAssignment,
+	// ErrInsufficientFailureDomains or nil
+	Reason error
+	Err    error
+	// Others are the errors which occurred along with Err, e.g. while
+	// patching several nodes. They are reported, but not unwrapped, see
+	// Errors.
+	Others []error
+}
+
+func (e *TopologyError) Error() string {
+	if len(e.Others) == 0 {
+		return e.Err.Error()
+	}
+
+	messages := []string{e.Err.Error()}
+	for _, err := range e.Others {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d errors: [%s]", len(messages), strings.Join(messages, ", "))
+}
+
+// Unwrap returns the underlying error
+func (e *TopologyError) Unwrap() error {
+	return e.Err
+}
+
+// Errors returns the underlying error followed by the Others
+func (e *TopologyError) Errors() []error {
+	return append([]error{e.Err}, e.Others...)
+}
+
+// Is returns whether the target is ErrTopologyReconcile or the reason of the
+// error
+func (e *TopologyError) Is(target error) bool {
+	return target == ErrTopologyReconcile || (e.Reason != nil && target == e.Reason)
+}
+
+// anyTopologyError returns whether match holds for any of the errors of
+// err if it is a TopologyError, see Errors, or for err itself otherwise
+func anyTopologyError(err error, match func(error) bool) bool {
+	var topologyErr *TopologyError
+	if !errors.As(err, &topologyErr) {
+		return match(err)
+	}
+	for _, e := range topologyErr.Errors() {
+		if match(e) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newTopologyError wraps err in a TopologyError with the given reason,
+// unless it already is one
+func newTopologyError(reason error, err error) error {
+	var topologyErr *TopologyError
+	if err == nil || errors.As(err, &topologyErr) {
+		return err
+	}
+
+	return &TopologyError{Reason: reason, Err: err}
+}
+
+// topologyTableHeader is the first row returned by TopologyTable
+var topologyTableHeader = []string{"node", "zone", "rack", "host", "eligible"}
+
+// crushLocationTypes lists the CRUSH bucket types derived from node topology
+// labels, from the top of the hierarchy to the bottom
+var crushLocationTypes = []string{"region", "zone", "datacenter", "rack"}
+
+// topologyTracer starts the spans used to trace topology decisions. It
+// mirrors the subset of the OpenTelemetry tracer API used by the operator so
+// that a tracer can be plugged in through a thin adapter.
+type topologyTracer interface {
+	Start(ctx context.Context, spanName string) (context.Context, topologySpan)
+}
+
+// topologySpan is a span started by a topologyTracer
+type topologySpan interface {
+	SetAttributes(attributes map[string]interface{})
+	End()
+}
+
+// topologyClient is the subset of the client used by the topology code to
+// list and label the nodes. Tests can plug in a client recording the
+// patches instead of checking the resulting nodes.
+type topologyClient interface {
+	List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error
+	Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error
+}
+
+// getTopologyClient returns the client used by the topology code, which is
+// the reconciler client unless another topologyClient is configured
+func (r *ReconcileStorageCluster) getTopologyClient() topologyClient {
+	if r.nodeClient != nil {
+		return r.nodeClient
+	}
+
+	return r.client
+}
+
+// getPreferredZoneKey returns the node label used to detect the zones of
+// the storage nodes, or an empty string to use the well-known zone labels
+func getPreferredZoneKey(sc *ocsv1.StorageCluster) string {
+	if sc.Spec.NodeTopologies == nil {
+		return ""
+	}
+
+	return sc.Spec.NodeTopologies.PreferredZoneKey
+}
+
+// getTopologyKeyValues returns the label and values of the topologyKey in
+// the topology map like GetKeyValues, preferring the zoneKey label, if set,
+// for the zones
+func getTopologyKeyValues(topologyMap *ocsv1.NodeTopologyMap, topologyKey, zoneKey string) (string, []string) {
+	if topologyKey == "zone" && zoneKey != "" {
+		return topologyMap.GetKeyValues(topologyKey, zoneKey)
+	}
+
+	return topologyMap.GetKeyValues(topologyKey)
+}
+
+// getTopologyMode returns the topology mode of the StorageCluster
+func getTopologyMode(sc *ocsv1.StorageCluster) ocsv1.TopologyMode {
+	if sc.Spec.NodeTopologies == nil || sc.Spec.NodeTopologies.Mode == "" {
+		return ocsv1.TopologyModeAuto
+	}
+
+	return sc.Spec.NodeTopologies.Mode
+}
+
+// getNodesWithoutRack returns the names of the given nodes which are not part
+// of any rack
+func getNodesWithoutRack(nodes *corev1.NodeList, nodeRacks *ocsv1.NodeTopologyMap) []string {
+	nodeNames := []string{}
+	for _, node := range nodes.Items {
+		hasRack := false
+		for _, rackNodes := range nodeRacks.Labels {
+			if statusutil.ContainsString(rackNodes, node.Name) {
+				hasRack = true
+				break
+			}
+		}
+		if !hasRack {
+			nodeNames = append(nodeNames, node.Name)
+		}
+	}
+	sort.Strings(nodeNames)
+
+	return nodeNames
+}
+
+// isBootstrapping returns whether the StorageCluster is allowed to be
+// reconciled with fewer storage nodes than required at the given time
+func isBootstrapping(sc *ocsv1.StorageCluster, now time.Time, reqLogger logr.Logger) bool {
+	value, ok := sc.Annotations[bootstrapUntilAnnotation]
+	if !ok {
+		return false
+	}
+
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		reqLogger.Error(err, "Ignoring invalid bootstrap annotation", "Annotation", bootstrapUntilAnnotation, "Value", value)
+		return false
+	}
+
+	return now.Before(until)
+}
+
+// clearBootstrap removes the bootstrap annotation from the StorageCluster
+func (r *ReconcileStorageCluster) clearBootstrap(ctx context.Context, sc *ocsv1.StorageCluster, reqLogger logr.Logger) error {
+	if _, ok := sc.Annotations[bootstrapUntilAnnotation]; !ok {
+		return nil
+	}
+
+	reqLogger.Info("Enough storage nodes found, removing bootstrap annotation", "Annotation", bootstrapUntilAnnotation)
+	patch := client.MergeFrom(sc.DeepCopy())
+	delete(sc.Annotations, bootstrapUntilAnnotation)
+
+	return r.client.Patch(ctx, sc, patch)
+}
+
+// ensureProviderIDTopology labels the given nodes which have no zone or
+// region label with the zone and region encoded in their providerID, using
+// the topology.kubernetes.io labels. The labels of the nodes in the list are
+// updated as well.
+func (r *ReconcileStorageCluster) ensureProviderIDTopology(ctx context.Context, nodes *corev1.NodeList, reqLogger logr.Logger) error {
+	platform, err := r.platform.GetPlatform(r.client)
+	if err != nil {
+		return err
+	}
+
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		region, zone, ok := parseProviderIDTopology(platform, node.Spec.ProviderID)
+		if !ok {
+			continue
+		}
+
+		newNode := node.DeepCopy()
+		if newNode.Labels == nil {
+			newNode.Labels = map[string]string{}
+		}
+		topologyLabels := TopologyLabels(*node)
+		if nodeZone(*node) == "" {
+			newNode.Labels[corev1.LabelZoneFailureDomainStable] = zone
+		}
+		hasRegion := false
+		for label := range topologyLabels {
+			if ocsv1.IsTopologyLabelOf(label, "region") {
+				hasRegion = true
+				break
+			}
+		}
+		if !hasRegion {
+			newNode.Labels[corev1.LabelZoneRegionStable] = region
+		}
+		if len(newNode.Labels) == len(node.Labels) {
+			continue
+		}
+
+		reqLogger.Info("Labeling node with the topology found in its providerID", "Node", node.Name, "ProviderID", node.Spec.ProviderID, "Region", region, "Zone", zone)
+		patch, err := generateStrategicPatch(node, newNode)
+		if err != nil {
+			return err
+		}
+		err = r.getTopologyClient().Patch(ctx, node, patch)
+		if err != nil {
+			return err
+		}
+		node.Labels = newNode.Labels
+	}
+
+	return nil
+}
+
+// TopologyLabels returns all the topology labels present on the given node,
+// as recognized by validTopologyLabelKeys
+func TopologyLabels(node corev1.Node) map[string]string {
+	topologyLabels := map[string]string{}
+	for label, value := range node.Labels {
+		for _, key := range validTopologyLabelKeys {
+			if matchesTopologyLabelKey(label, key) {
+				topologyLabels[label] = value
+				break
+			}
+		}
+	}
+
+	return topologyLabels
+}
+
+// matchesTopologyLabelKey returns true if the label is designated by the
+// given topology label key, which is either the label itself or the prefix
+// of its name, e.g. "topology.rook.io" designates "topology.rook.io/rack"
+func matchesTopologyLabelKey(label, key string) bool {
+	return label == key || strings.HasPrefix(label, key+"/")
+}
+
+// isCSITopologyLabel returns true if the label is a topology label set on
+// the nodes by a CSI driver, whose domain is "topology.<driver name>" and
+// the driver name contains ".csi.", e.g. "topology.rbd.csi.ceph.com/rack"
+func isCSITopologyLabel(label string) bool {
+	i := strings.Index(label, "/")
+	if i < 0 {
+		return false
+	}
+	domain := label[:i]
+
+	return strings.HasPrefix(domain, "topology.") && strings.Contains(domain, ".csi.")
+}
+
+// getCSITopologyLabelKeys returns the sorted CSI topology labels present on
+// the given nodes
+func getCSITopologyLabelKeys(nodes *corev1.NodeList) []string {
+	keys := []string{}
+	for _, node := range nodes.Items {
+		for label := range node.Labels {
+			if isCSITopologyLabel(label) && !statusutil.ContainsString(keys, label) {
+				keys = append(keys, label)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// nodeCSIRack returns the value of the CSI rack topology label of the given
+// node, or an empty string if the node has none
+func nodeCSIRack(node corev1.Node) string {
+	labels := []string{}
+	for label := range node.Labels {
+		if isCSITopologyLabel(label) && ocsv1.IsTopologyLabelOf(label, "rack") {
+			labels = append(labels, label)
+		}
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	sort.Strings(labels)
+
+	return node.Labels[labels[0]]
+}
+
+// nodeZone returns the value of the zone topology label of the given node,
+// or an empty string if the node has none
+func nodeZone(node corev1.Node) string {
+	return nodeTopologyValue(node, "zone")
+}
+
+// nodePreferredZone returns the zone of the given node like nodeZone, read
+// from the zoneKey label instead if set and present on the node
+func nodePreferredZone(node corev1.Node, zoneKey string) string {
+	if zone, ok := node.Labels[zoneKey]; ok && zoneKey != "" {
+		return zone
+	}
+
+	return nodeZone(node)
+}
+
+// nodeRack returns the rack of the given node, read from the rack label set
+// by the operator if present, see nodeTopologyValue otherwise
+func nodeRack(node corev1.Node) string {
+	if rack, ok := node.Labels[defaults.RackTopologyKey]; ok {
+		return rack
+	}
+
+	return nodeTopologyValue(node, "rack")
+}
+
+// nodeTopologyValue returns the value of the given type of topology label of
+// the given node, or an empty string if the node has none. When several
+// labels match, the current and then the deprecated well-known topology
+// label is preferred, and then the first one in lexical order, as in
+// GetKeyValues.
+func nodeTopologyValue(node corev1.Node, topologyType string) string {
+	labels := []string{}
+	for label := range TopologyLabels(node) {
+		if ocsv1.IsTopologyLabelOf(label, topologyType) {
+			labels = append(labels, label)
+		}
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+
+	for _, preferred := range []string{"topology.kubernetes.io/" + topologyType, "failure-domain.beta.kubernetes.io/" + topologyType} {
+		if statusutil.ContainsString(labels, preferred) {
+			return node.Labels[preferred]
+		}
+	}
+	sort.Strings(labels)
+
+	return node.Labels[labels[0]]
+}
+
+// nodeDatacenter returns the value of the datacenter topology label of the
+// given node, or an empty string if the node has none
+func nodeDatacenter(node corev1.Node) string {
+	return nodeTopologyValue(node, "datacenter")
+}
+
+// nodeRegion returns the value of the region topology label of the given
+// node, or an empty string if the node has none
+func nodeRegion(node corev1.Node) string {
+	return nodeTopologyValue(node, "region")
+}
+
+// validateZoneRegions checks that every zone of the given nodes belongs to a
+// single region. It returns the regions of the zones found in more than one
+// region.
+func validateZoneRegions(nodes *corev1.NodeList) map[string][]string {
+	zoneRegions := map[string][]string{}
+	for _, node := range nodes.Items {
+		zone, region := nodeZone(node), nodeRegion(node)
+		if zone == "" || region == "" || statusutil.ContainsString(zoneRegions[zone], region) {
+			continue
+		}
+		zoneRegions[zone] = append(zoneRegions[zone], region)
+	}
+
+	for zone, regions := range zoneRegions {
+		if len(regions) < 2 {
+			delete(zoneRegions, zone)
+			continue
+		}
+		sort.Strings(regions)
+	}
+
+	return zoneRegions
+}
+
+// countDistinctValues returns the number of distinct topology values when
+// compared case-insensitively. This is only used to count failure domains,
+// the values keep their original case everywhere else.
+func countDistinctValues(values []string) int {
+	distinct := map[string]bool{}
+	for _, value := range values {
+		distinct[strings.ToLower(value)] = true
+	}
+
+	return len(distinct)
+}
+
+// caseVariantValues returns the topology values that only differ by case,
+// grouped by their lowercased value
+func caseVariantValues(values []string) map[string][]string {
+	variants := map[string][]string{}
+	for _, value := range values {
+		lower := strings.ToLower(value)
+		variants[lower] = append(variants[lower], value)
+	}
+	for lower, group := range variants {
+		if len(group) < 2 {
+			delete(variants, lower)
+		}
+	}
+
+	return variants
+}
+
+// validateZoneRacks checks that every zone contains at least one rack when
+// both zone and rack topology labels are present across the storage nodes.
+// It returns the sorted list of zones which have no rack.
+func validateZoneRacks(nodes *corev1.NodeList, nodeRacks *ocsv1.NodeTopologyMap) []string {
+	rackedNodes := map[string]bool{}
+	for _, nodeNames := range nodeRacks.Labels {
+		for _, nodeName := range nodeNames {
+			rackedNodes[nodeName] = true
+		}
+	}
+	if len(rackedNodes) == 0 {
+		return nil
+	}
+
+	zonesWithRacks := map[string]bool{}
+	for _, node := range nodes.Items {
+		zone := nodeZone(node)
+		if zone == "" {
+			continue
+		}
+		if _, ok := zonesWithRacks[zone]; !ok {
+			zonesWithRacks[zone] = false
+		}
+		if rackedNodes[node.Name] {
+			zonesWithRacks[zone] = true
+		}
+	}
+
+	zones := []string{}
+	for zone, hasRack := range zonesWithRacks {
+		if !hasRack {
+			zones = append(zones, zone)
+		}
+	}
+	sort.Strings(zones)
+
+	return zones
+}
+
+// validateRackZones checks that the nodes of every rack share the same zone.
+// It returns the first rack, in alphabetical order, whose nodes span more
+// than one zone, along with the sorted list of conflicting zones.
+func validateRackZones(nodes *corev1.NodeList, nodeRacks *ocsv1.NodeTopologyMap) (string, []string) {
+	nodeZones := map[string]string{}
+	for _, node := range nodes.Items {
+		if zone := nodeZone(node); zone != "" {
+			nodeZones[node.Name] = zone
+		}
+	}
+
+	racks := []string{}
+	for rack := range nodeRacks.Labels {
+		racks = append(racks, rack)
+	}
+	sort.Strings(racks)
+
+	for _, rack := range racks {
+		zones := map[string]bool{}
+		for _, nodeName := range nodeRacks.Labels[rack] {
+			if zone, ok := nodeZones[nodeName]; ok {
+				zones[zone] = true
+			}
+		}
+		if len(zones) > 1 {
+			zoneList := []string{}
+			for zone := range zones {
+				zoneList = append(zoneList, zone)
+			}
+			sort.Strings(zoneList)
+			return rack, zoneList
+		}
+	}
+
+	return "", nil
+}
+
+// getZoneRacks returns the sorted list of racks holding storage nodes of
+// each zone
+func getZoneRacks(nodes *corev1.NodeList, nodeRacks *ocsv1.NodeTopologyMap) map[string][]string {
+	nodeZones := map[string]string{}
+	for _, node := range nodes.Items {
+		if zone := nodeZone(node); zone != "" {
+			nodeZones[node.Name] = zone
+		}
+	}
+
+	zoneRacks := map[string][]string{}
+	for rack, nodeNames := range nodeRacks.Labels {
+		zones := map[string]bool{}
+		for _, nodeName := range nodeNames {
+			if zone, ok := nodeZones[nodeName]; ok && !zones[zone] {
+				zones[zone] = true
+				zoneRacks[zone] = append(zoneRacks[zone], rack)
+			}
+		}
+	}
+	for _, racks := range zoneRacks {
+		sort.Strings(racks)
+	}
+
+	return zoneRacks
+}
+
+// isRackInZone returns whether the storage nodes of the given rack are all
+// in the given zone. Any rack is in an unknown zone.
+func isRackInZone(nodes *corev1.NodeList, nodeRacks *ocsv1.NodeTopologyMap, rack, zone string) bool {
+	if zone == "" {
+		return true
+	}
+	for _, nodeName := range nodeRacks.Labels[rack] {
+		for _, node := range nodes.Items {
+			if node.Name == nodeName {
+				if nodeZone := nodeZone(node); nodeZone != "" && nodeZone != zone {
+					return false
+				}
+				break
+			}
+		}
+	}
+
+	return true
+}
+
+// getPreferredRack returns the rack the given node is pinned to by its
+// preferredRackAnnotation, or an empty string if it is not pinned. It fails
+// if the rack is not a valid label value or holds nodes of another zone.
+func getPreferredRack(nodes *corev1.NodeList, nodeRacks *ocsv1.NodeTopologyMap, node corev1.Node) (string, error) {
+	rack := node.Annotations[preferredRackAnnotation]
+	if rack == "" {
+		return "", nil
+	}
+	if errs := validation.IsValidLabelValue(rack); len(errs) > 0 {
+		return "", fmt.Errorf("invalid preferred rack %q of node %q: %s", rack, node.Name, strings.Join(errs, "; "))
+	}
+	if zone := nodeZone(node); !isRackInZone(nodes, nodeRacks, rack, zone) {
+		return "", fmt.Errorf("preferred rack %q of node %q in zone %q contains nodes from other zones", rack, node.Name, zone)
+	}
+
+	return rack, nil
+}
+
+// recordNodeRacks records the rack of every storage node in the status of
+// the StorageCluster. Nodes which are gone are kept, so that they get their
+// rack back when they return. It returns whether the status was updated.
+func recordNodeRacks(sc *ocsv1.StorageCluster, nodeRacks *ocsv1.NodeTopologyMap) bool {
+	updated := false
+	for rack, nodeNames := range nodeRacks.Labels {
+		for _, nodeName := range nodeNames {
+			if sc.Status.NodeRacks[nodeName] == rack {
+				continue
+			}
+			if sc.Status.NodeRacks == nil {
+				sc.Status.NodeRacks = map[string]string{}
+			}
+			sc.Status.NodeRacks[nodeName] = rack
+			updated = true
+		}
+	}
+
+	return updated
+}
+
+// isGeneratedRack returns whether the rack is named after rackPrefix followed
+// by a number, like the racks generated by the operator. Other racks are
+// managed by the admin.
+func isGeneratedRack(rack, rackPrefix string) bool {
+	if !strings.HasPrefix(rack, rackPrefix) {
+		return false
+	}
+	_, err := strconv.ParseUint(strings.TrimPrefix(rack, rackPrefix), 10, 32)
+
+	return err == nil
+}
+
+// getGeneratedRacks returns a copy of the racks generated by the operator,
+// leaving out the racks managed by the admin
+func getGeneratedRacks(nodeRacks *ocsv1.NodeTopologyMap, rackPrefix string) *ocsv1.NodeTopologyMap {
+	generatedRacks := ocsv1.NewNodeTopologyMap()
+	for rack, nodeNames := range nodeRacks.Labels {
+		if isGeneratedRack(rack, rackPrefix) {
+			generatedRacks.Labels[rack] = append(ocsv1.TopologyLabelValues{}, nodeNames...)
+		}
+	}
+
+	return generatedRacks
+}
+
+// defaultRackRebalanceRatio is the default ratio between the node counts of
+// the largest and the smallest racks of a zone above which they are
+// rebalanced
+const defaultRackRebalanceRatio = 2
+
+// getRackRebalanceRatio returns the ratio between the node counts of the
+// largest and the smallest racks of a zone above which they are rebalanced
+func getRackRebalanceRatio(sc *ocsv1.StorageCluster) int {
+	if sc.Spec.NodeTopologies == nil || sc.Spec.NodeTopologies.RackRebalanceRatio < 1 {
+		return defaultRackRebalanceRatio
+	}
+
+	return sc.Spec.NodeTopologies.RackRebalanceRatio
+}
+
+// planRackRebalance returns the storage nodes to move between the racks named
+// after rackPrefix so that no rack holds more than ratio times the nodes of
+// the smallest populated rack of its zone. Nodes are only moved between racks
+// of the same zone, and only out of racks holding several nodes, so the
+// number of populated racks never drops. The moves are sorted by node name.
+func planRackRebalance(nodes *corev1.NodeList, nodeRacks *ocsv1.NodeTopologyMap, rackPrefix string, ratio int) []nodeRackAssignment {
+	nodesByName := getNodesByName(nodes)
+	rackNodes := map[string][]string{}
+	zoneRacks := map[string][]string{}
+	for rack, nodeNames := range nodeRacks.Labels {
+		if !isGeneratedRack(rack, rackPrefix) {
+			continue
+		}
+		present := []string{}
+		for _, nodeName := range nodeNames {
+			if _, ok := nodesByName[nodeName]; ok {
+				present = append(present, nodeName)
+			}
+		}
+		if len(present) == 0 {
+			continue
+		}
+		sort.Strings(present)
+		rackNodes[rack] = present
+		zone := nodeZone(nodesByName[present[0]])
+		zoneRacks[zone] = append(zoneRacks[zone], rack)
+	}
+
+	planned := map[string]string{}
+	for _, racks := range zoneRacks {
+		sort.Strings(racks)
+		for {
+			largest, smallest := racks[0], racks[0]
+			for _, rack := range racks {
+				if len(rackNodes[rack]) > len(rackNodes[largest]) {
+					largest = rack
+				}
+				if len(rackNodes[rack]) < len(rackNodes[smallest]) {
+					smallest = rack
+				}
+			}
+			if len(rackNodes[largest]) <= ratio*len(rackNodes[smallest]) {
+				break
+			}
+			last := len(rackNodes[largest]) - 1
+			nodeName := rackNodes[largest][last]
+			rackNodes[largest] = rackNodes[largest][:last]
+			rackNodes[smallest] = append(rackNodes[smallest], nodeName)
+			planned[nodeName] = smallest
+		}
+	}
+
+	moves := []nodeRackAssignment{}
+	for nodeName, rack := range planned {
+		if nodesByName[nodeName].Labels[defaults.RackTopologyKey] != rack {
+			moves = append(moves, nodeRackAssignment{Node: nodeName, Rack: rack})
+		}
+	}
+	sort.Slice(moves, func(i, j int) bool {
+		return moves[i].Node < moves[j].Node
+	})
+
+	return moves
+}
+
+// getEmptyRack returns the first rack, in alphabetical order, without any
+// storage node. A new rack named after rackPrefix is defined if there is none.
+func getEmptyRack(nodeRacks *ocsv1.NodeTopologyMap, rackPrefix string) string {
+	racks := []string{}
+	for rack, nodeNames := range nodeRacks.Labels {
+		if len(nodeNames) == 0 {
+			racks = append(racks, rack)
+		}
+	}
+	if len(racks) > 0 {
+		sort.Strings(racks)
+		return racks[0]
+	}
+
+	for i := 0; ; i++ {
+		rack := fmt.Sprintf("%s%d", rackPrefix, i)
+		if _, ok := nodeRacks.Labels[rack]; !ok {
+			nodeRacks.Labels[rack] = ocsv1.TopologyLabelValues{}
+			return rack
+		}
+	}
+}
+
+// canDefineRack returns whether a new rack can be defined in nodeRacks
+// without exceeding maxRacks racks. There is no maximum if maxRacks is zero.
+func canDefineRack(nodeRacks *ocsv1.NodeTopologyMap, maxRacks int) bool {
+	return maxRacks == 0 || len(nodeRacks.Labels) < maxRacks
+}
+
+// validateMinRacksPerZone checks that every zone has enough storage nodes
+// to be spread across minRacksPerZone racks, and that maxRacks allows that
+// many racks in all the zones
+func validateMinRacksPerZone(nodes *corev1.NodeList, minRacksPerZone, maxRacks int) error {
+	if minRacksPerZone == 0 {
+		return nil
+	}
+
+	zoneNodes := map[string]int{}
+	for _, node := range nodes.Items {
+		if zone := nodeZone(node); zone != "" {
+			zoneNodes[zone]++
+		}
+	}
+
+	zones := []string{}
+	for zone := range zoneNodes {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+
+	for _, zone := range zones {
+		if zoneNodes[zone] < minRacksPerZone {
+			return fmt.Errorf("Not enough nodes found in zone %q: Expected at least %d to spread them across %d racks, found %d",
+				zone, minRacksPerZone, minRacksPerZone, zoneNodes[zone])
+		}
+	}
+	if maxRacks > 0 && minRacksPerZone*len(zones) > maxRacks {
+		return fmt.Errorf("%d racks per zone in %d zones exceed the maximum rack count %d", minRacksPerZone, len(zones), maxRacks)
+	}
+
+	return nil
+}
+
+// validateDeviceSetPlacement checks that the node topology provides enough
+// distinct values of the failure domain for every StorageDeviceSet without an
+// explicit Placement to spread its replicas without overlap
+func validateDeviceSetPlacement(sc *ocsv1.StorageCluster) error {
+	topologyMap := sc.Status.NodeTopologies
+	if topologyMap == nil {
+		topologyMap = ocsv1.NewNodeTopologyMap()
+	}
+
+	for _, ds := range sc.Spec.StorageDeviceSets {
+		noPlacement := ds.Placement.NodeAffinity == nil && ds.Placement.PodAffinity == nil && ds.Placement.PodAntiAffinity == nil
+		if !noPlacement {
+			continue
+		}
+
+		replica := ds.Replica
+		if replica == 0 {
+			replica = defaults.DeviceSetReplica
+		}
+		topologyKey := ds.TopologyKey
+		if topologyKey == "" {
+			topologyKey = determineFailureDomain(sc)
+		}
+		topologyKey, values := getTopologyKeyValues(topologyMap, topologyKey, getPreferredZoneKey(sc))
+		if len(values) < replica {
+			return fmt.Errorf("failed to validate StorageDeviceSet %q: %d distinct values of topology key %q are required to place its replicas, but only %d were found %v",
+				ds.Name, replica, topologyKey, len(values), values)
+		}
+	}
+
+	return nil
+}
+
+// validateDistinctHosts checks that the storage nodes are spread across at
+// least minHosts distinct hosts. Nodes without a hostname label are counted
+// by their name.
+func validateDistinctHosts(nodes *corev1.NodeList, minHosts int) error {
+	hosts := map[string]bool{}
+	for _, node := range nodes.Items {
+		host, ok := node.Labels[corev1.LabelHostname]
+		if !ok {
+			host = node.Name
+		}
+		hosts[host] = true
+	}
+
+	if len(hosts) < minHosts {
+		return fmt.Errorf("Not enough distinct hosts found: Expected %d, found %d", minHosts, len(hosts))
+	}
+
+	return nil
+}
+
+// validateTopologyKeys checks that all the topology keys supplied in the spec
+// of the StorageCluster are valid node label keys
+func validateTopologyKeys(sc *ocsv1.StorageCluster) error {
+	for _, ds := range sc.Spec.StorageDeviceSets {
+		if ds.TopologyKey == "" {
+			continue
+		}
+		if errs := validation.IsQualifiedName(ds.TopologyKey); len(errs) > 0 {
+			return fmt.Errorf("failed to validate StorageDeviceSet %q: invalid topology key %q: %s", ds.Name, ds.TopologyKey, strings.Join(errs, "; "))
+		}
+	}
+
+	if sc.Spec.NodeTopologies != nil {
+		for _, key := range sc.Spec.NodeTopologies.RequiredTopologyKeys {
+			if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+				return fmt.Errorf("invalid required topology key %q: %s", key, strings.Join(errs, "; "))
+			}
+		}
+		for _, key := range sc.Spec.NodeTopologies.AdditionalLabelKeys {
+			if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+				return fmt.Errorf("invalid additional label key %q: %s", key, strings.Join(errs, "; "))
+			}
+		}
+		if key := sc.Spec.NodeTopologies.PreferredZoneKey; key != "" {
+			if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+				return fmt.Errorf("invalid preferred zone key %q: %s", key, strings.Join(errs, "; "))
+			}
+		}
+		// a node resource name is a valid label key too
+		if key := sc.Spec.NodeTopologies.RackCapacityKey; key != "" {
+			if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+				return fmt.Errorf("invalid rack capacity key %q: %s", key, strings.Join(errs, "; "))
+			}
+		}
+	}
+
+	return nil
+}
+
+// defaultFailureDomainWeights prefers the datacenter failure domain over the
+// zone one, and the zone failure domain over the rack one
+var defaultFailureDomainWeights = map[string]int{
+	"datacenter": 3,
+	"zone":       2,
+	"rack":       1,
+}
+
+// getFailureDomainWeights returns the weights of the failure domains of the
+// StorageCluster, using the default weight of the failure domains without
+// one
+func getFailureDomainWeights(sc *ocsv1.StorageCluster) map[string]int {
+	weights := map[string]int{}
+	for failureDomain, weight := range defaultFailureDomainWeights {
+		weights[failureDomain] = weight
+	}
+	requestedFailureDomain := ""
+	if sc.Spec.NodeTopologies != nil {
+		for failureDomain, weight := range sc.Spec.NodeTopologies.FailureDomainWeights {
+			weights[failureDomain] = weight
+		}
+		requestedFailureDomain = sc.Spec.NodeTopologies.FailureDomain
+	}
+	// the requested failure domain comes first, and the preferred one
+	// before it
+	for _, requested := range []string{requestedFailureDomain, getPreferredFailureDomain(sc)} {
+		if requested == "" {
+			continue
+		}
+		max := 0
+		for _, weight := range weights {
+			if weight > max {
+				max = weight
+			}
+		}
+		weights[requested] = max + 1
+	}
+
+	return weights
+}
+
+// validateFailureDomainWeights checks that the failure domain weights of the
+// StorageCluster are set on known failure domains and are not negative
+func validateFailureDomainWeights(sc *ocsv1.StorageCluster) error {
+	if sc.Spec.NodeTopologies == nil {
+		return nil
+	}
+
+	for failureDomain, weight := range sc.Spec.NodeTopologies.FailureDomainWeights {
+		if _, ok := defaultFailureDomainWeights[failureDomain]; !ok {
+			return fmt.Errorf("invalid failure domain weight: unknown failure domain %q", failureDomain)
+		}
+		if weight < 0 {
+			return fmt.Errorf("invalid failure domain weight: weight %d of failure domain %q is negative", weight, failureDomain)
+		}
+	}
+
+	return nil
+}
+
+// aliasedFailureDomains are the failure domains which may be given a
+// FailureDomainAlias
+var aliasedFailureDomains = []string{"host", "rack", "zone", "datacenter"}
+
+// cephBucketTypes are the bucket types of the default CRUSH map of Ceph
+var cephBucketTypes = []string{"osd", "host", "chassis", "rack", "row", "pdu", "pod", "room", "datacenter", "zone", "region", "root"}
+
+// validateFailureDomainAliases checks that the failure domain aliases of the
+// StorageCluster map known failure domains to distinct Ceph bucket types
+func validateFailureDomainAliases(sc *ocsv1.StorageCluster) error {
+	if sc.Spec.NodeTopologies == nil {
+		return nil
+	}
+
+	failureDomains := []string{}
+	for failureDomain := range sc.Spec.NodeTopologies.FailureDomainAlias {
+		failureDomains = append(failureDomains, failureDomain)
+	}
+	sort.Strings(failureDomains)
+	aliased := map[string]string{}
+	for _, failureDomain := range failureDomains {
+		alias := sc.Spec.NodeTopologies.FailureDomainAlias[failureDomain]
+		if !statusutil.ContainsString(aliasedFailureDomains, failureDomain) {
+			return fmt.Errorf("invalid failure domain alias: unknown failure domain %q", failureDomain)
+		}
+		if !statusutil.ContainsString(cephBucketTypes, alias) {
+			return fmt.Errorf("invalid failure domain alias: %q of failure domain %q is not a Ceph bucket type %v", alias, failureDomain, cephBucketTypes)
+		}
+		if other, ok := aliased[alias]; ok {
+			return fmt.Errorf("invalid failure domain alias: failure domains %q and %q are both aliased to %q", other, failureDomain, alias)
+		}
+		aliased[alias] = failureDomain
+	}
+
+	return nil
+}
+
+// getCrushFailureDomain returns the CRUSH bucket type used for the given
+// failure domain of the StorageCluster, which is the failure domain itself
+// unless it has a FailureDomainAlias
+func getCrushFailureDomain(sc *ocsv1.StorageCluster, failureDomain string) string {
+	if sc.Spec.NodeTopologies != nil {
+		if alias, ok := sc.Spec.NodeTopologies.FailureDomainAlias[failureDomain]; ok {
+			return alias
+		}
+	}
+
+	return failureDomain
+}
+
+// getAliasedFailureDomain returns the failure domain of the StorageCluster
+// whose CRUSH bucket type is the given one, see getCrushFailureDomain
+func getAliasedFailureDomain(sc *ocsv1.StorageCluster, bucketType string) string {
+	if sc.Spec.NodeTopologies != nil {
+		for failureDomain, alias := range sc.Spec.NodeTopologies.FailureDomainAlias {
+			if alias == bucketType {
+				return failureDomain
+			}
+		}
+	}
+
+	return bucketType
+}
+
+// getNodeCrushLocation returns the CRUSH location of the given node like
+// CrushLocation, using the CRUSH bucket types of the failure domains of the
+// StorageCluster
+func getNodeCrushLocation(sc *ocsv1.StorageCluster, node corev1.Node) string {
+	location := strings.Split(CrushLocation(node), " ")
+	for i, bucket := range location {
+		parts := strings.SplitN(bucket, "=", 2)
+		location[i] = getCrushFailureDomain(sc, parts[0]) + "=" + parts[1]
+	}
+
+	return strings.Join(location, " ")
+}
+
+// pruneStaleRacks removes from the topology map the racks which no longer
+// hold any of the given storage nodes, e.g. because their nodes left the
+// StorageCluster. The rack labels of the nodes are left untouched. It returns
+// whether the topology map was changed.
+func pruneStaleRacks(sc *ocsv1.StorageCluster, nodeRacks *ocsv1.NodeTopologyMap, reqLogger logr.Logger) bool {
+	topologyMap := sc.Status.NodeTopologies
+	racks, ok := topologyMap.Labels[defaults.RackTopologyKey]
+	if !ok {
+		return false
+	}
+
+	remaining := ocsv1.TopologyLabelValues{}
+	for _, rack := range racks {
+		if len(nodeRacks.Labels[rack]) > 0 {
+			remaining = append(remaining, rack)
+			continue
+		}
+		reqLogger.Info("Removing stale rack without any storage node from the node topology map", "Label", defaults.RackTopologyKey, "Value", rack)
+		delete(sc.Status.TopologyValuesLastSeen, fmt.Sprintf("%s=%s", defaults.RackTopologyKey, rack))
+	}
+	if len(remaining) == len(racks) {
+		return false
+	}
+
+	if len(remaining) == 0 {
+		delete(topologyMap.Labels, defaults.RackTopologyKey)
+	} else {
+		topologyMap.Labels[defaults.RackTopologyKey] = remaining
+	}
+
+	return true
+}
+
+// defaultRackPrefix is the prefix of the names of the racks generated by the
+// operator when the StorageCluster does not set one
+const defaultRackPrefix = "rack"
+
+// getRackPrefix returns the prefix of the names of the racks generated for
+// the StorageCluster
+func getRackPrefix(sc *ocsv1.StorageCluster) string {
+	if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.RackPrefix != "" {
+		return sc.Spec.NodeTopologies.RackPrefix
+	}
+
+	return defaultRackPrefix
+}
+
+// defaultNodePatchConcurrency is the number of nodes patched concurrently
+// when labeling the storage nodes with racks, unless set in the spec
+const defaultNodePatchConcurrency = 4
+
+// getNodePatchConcurrency returns the number of nodes patched concurrently
+// when labeling the storage nodes of the StorageCluster with racks
+func getNodePatchConcurrency(sc *ocsv1.StorageCluster) int {
+	if sc.Spec.NodeTopologies == nil || sc.Spec.NodeTopologies.NodePatchConcurrency < 1 {
+		return defaultNodePatchConcurrency
+	}
+
+	return sc.Spec.NodeTopologies.NodePatchConcurrency
+}
+
+// getRackCapacityKey returns the node label or allocatable resource the racks
+// of the StorageCluster are balanced by, or an empty string to balance them
+// by their number of nodes
+func getRackCapacityKey(sc *ocsv1.StorageCluster) string {
+	if sc.Spec.NodeTopologies == nil {
+		return ""
+	}
+
+	return sc.Spec.NodeTopologies.RackCapacityKey
+}
+
+// getTopologyLabelKeys returns the node label keys recognized as topology
+// labels for the StorageCluster: the built-in validTopologyLabelKeys followed
+// by the AdditionalLabelKeys of its node topologies
+func getTopologyLabelKeys(sc *ocsv1.StorageCluster) []string {
+	keys := append([]string{}, validTopologyLabelKeys...)
+	if sc.Spec.NodeTopologies != nil {
+		keys = append(keys, sc.Spec.NodeTopologies.AdditionalLabelKeys...)
+	}
+
+	return keys
+}
+
+// validateRackPrefix checks that the racks generated with the rack prefix of
+// the StorageCluster are valid node label values
+func validateRackPrefix(sc *ocsv1.StorageCluster) error {
+	if errs := validation.IsValidLabelValue(getRackPrefix(sc) + "0"); len(errs) > 0 {
+		return fmt.Errorf("invalid rack prefix %q: %s", getRackPrefix(sc), strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// getMinRackCount returns the minimum number of racks generated for the
+// StorageCluster
+func getMinRackCount(sc *ocsv1.StorageCluster) int {
+	if sc.Spec.NodeTopologies != nil && sc.Spec.NodeTopologies.MinRackCount > 0 {
+		return sc.Spec.NodeTopologies.MinRackCount
+	}
+
+	return getDeviceSetReplica(sc)
+}
+
+// validateMinRackCount checks that the minimum rack count of the
+// StorageCluster allows a rack per replica and does not exceed the maximum
+// rack count
+func validateMinRackCount(sc *ocsv1.StorageCluster) error {
+	if sc.Spec.NodeTopologies == nil || sc.Spec.NodeTopologies.MinRackCount == 0 {
+		return nil
+	}
+
+	minRacks, maxRacks := sc.Spec.NodeTopologies.MinRackCount, sc.Spec.NodeTopologies.MaxRackCount
+	if replica := getDeviceSetReplica(sc); minRacks < replica {
+		return fmt.Errorf("invalid minimum rack count %d: at least %d racks are required by the StorageDeviceSets", minRacks, replica)
+	}
+	if maxRacks > 0 && minRacks > maxRacks {
+		return fmt.Errorf("invalid minimum rack count %d: it exceeds the maximum rack count %d", minRacks, maxRacks)
+	}
+
+	return nil
+}
+
+// validateNodeTopologySpec runs the validations of the node topology
+// settings of the StorageCluster spec. When one fails, it returns the error
+// along with the reason of the condition reporting it.
+func validateNodeTopologySpec(sc *ocsv1.StorageCluster) (string, error) {
+	validations := []struct {
+		reason   string
+		validate func(*ocsv1.StorageCluster) error
+	}{
+		{"InvalidTopologyKey", validateTopologyKeys},
+		{"InvalidFailureDomainWeights", validateFailureDomainWeights},
+		{"InvalidFailureDomainAliases", validateFailureDomainAliases},
+		{"InvalidRackPrefix", validateRackPrefix},
+		{"InvalidMinRackCount", validateMinRackCount},
+	}
+	for _, v := range validations {
+		if err := v.validate(sc); err != nil {
+			return v.reason, err
+		}
+	}
+
+	return "", nil
+}
+
+// validateRequiredTopologyKeys checks that every given node carries all the
+// topology keys required by the StorageCluster
+func validateRequiredTopologyKeys(sc *ocsv1.StorageCluster, nodes *corev1.NodeList) error {
+	if sc.Spec.NodeTopologies == nil || len(sc.Spec.NodeTopologies.RequiredTopologyKeys) == 0 {
+		return nil
+	}
+
+	nonCompliant := []string{}
+	for _, node := range nodes.Items {
+		missing := []string{}
+		for _, key := range sc.Spec.NodeTopologies.RequiredTopologyKeys {
+			if _, ok := node.Labels[key]; !ok {
+				missing = append(missing, key)
+			}
+		}
+		if len(missing) > 0 {
+			nonCompliant = append(nonCompliant, fmt.Sprintf("%s (missing %s)", node.Name, strings.Join(missing, ", ")))
+		}
+	}
+	if len(nonCompliant) > 0 {
+		sort.Strings(nonCompliant)
+		return fmt.Errorf("nodes do not carry the required topology keys: %s", strings.Join(nonCompliant, "; "))
+	}
+
+	return nil
+}
+
+// getNodesWithoutZone returns the sorted names of the given nodes without a
+// zone topology label when some of the other nodes carry one, or nil if all
+// or none of the nodes carry a zone label
+func getNodesWithoutZone(nodes *corev1.NodeList) []string {
+	unzoned := []string{}
+	for _, node := range nodes.Items {
+		if nodeZone(node) == "" {
+			unzoned = append(unzoned, node.Name)
+		}
+	}
+	if len(unzoned) == 0 || len(unzoned) == len(nodes.Items) {
+		return nil
+	}
+	sort.Strings(unzoned)
+
+	return unzoned
+}
+
+// NodeLabelSuggestion is a label the admin is advised to set on a node
+type NodeLabelSuggestion struct {
+	Node  string
+	Label string
+	Value string
+}
+
+// PlanZoneMigration returns the zone labels to set on the given nodes to
+// spread them evenly over desiredZones zones. Nodes keep their current zone
+// whenever possible, so only the nodes that have to be relabeled are part of
+// the plan. Existing zones are reused before new zone names are suggested.
+func PlanZoneMigration(topologyMap *ocsv1.NodeTopologyMap, nodes *corev1.NodeList, desiredZones int) []NodeLabelSuggestion {
+	if desiredZones <= 0 || nodes == nil || len(nodes.Items) == 0 {
+		return nil
+	}
+	if topologyMap == nil {
+		topologyMap = ocsv1.NewNodeTopologyMap()
+	}
+
+	zoneLabel, existingZones := topologyMap.GetKeyValues("zone")
+	if len(existingZones) == 0 {
+		zoneLabel = corev1.LabelZoneFailureDomain
+	}
+
+	zoneNodes := map[string][]string{}
+	for _, node := range nodes.Items {
+		if zone, ok := node.Labels[zoneLabel]; ok {
+			zoneNodes[zone] = append(zoneNodes[zone], node.Name)
+		}
+	}
+
+	// Keep the most populated existing zones, then make up new ones
+	zones := append([]string{}, existingZones...)
+	sort.SliceStable(zones, func(i, j int) bool {
+		if len(zoneNodes[zones[i]]) != len(zoneNodes[zones[j]]) {
+			return len(zoneNodes[zones[i]]) > len(zoneNodes[zones[j]])
+		}
+		return zones[i] < zones[j]
+	})
+	if len(zones) > desiredZones {
+		zones = zones[:desiredZones]
+	}
+	for i := 0; len(zones) < desiredZones; i++ {
+		zone := fmt.Sprintf("zone%d", i)
+		if !topologyMap.Contains(zoneLabel, zone) {
+			zones = append(zones, zone)
+		}
+	}
+
+	assignment := map[string][]string{}
+	unassigned := []string{}
+	for _, node := range nodes.Items {
+		zone := node.Labels[zoneLabel]
+		if statusutil.ContainsString(zones, zone) {
+			assignment[zone] = append(assignment[zone], node.Name)
+		} else {
+			unassigned = append(unassigned, node.Name)
+		}
+	}
+	sort.Strings(unassigned)
+
+	leastPopulated := func() string {
+		min := zones[0]
+		for _, zone := range zones {
+			if len(assignment[zone]) < len(assignment[min]) {
+				min = zone
+			}
+		}
+		return min
+	}
+	mostPopulated := func() string {
+		max := zones[0]
+		for _, zone := range zones {
+			if len(assignment[zone]) > len(assignment[max]) {
+				max = zone
+			}
+		}
+		return max
+	}
+
+	for _, node := range unassigned {
+		zone := leastPopulated()
+		assignment[zone] = append(assignment[zone], node)
+	}
+	for {
+		min, max := leastPopulated(), mostPopulated()
+		if len(assignment[max])-len(assignment[min]) <= 1 {
+			break
+		}
+		sort.Strings(assignment[max])
+		node := assignment[max][len(assignment[max])-1]
+		assignment[max] = assignment[max][:len(assignment[max])-1]
+		assignment[min] = append(assignment[min], node)
+	}
+
+	suggestions := []NodeLabelSuggestion{}
+	for _, node := range nodes.Items {
+		for zone, zoneNodes := range assignment {
+			if statusutil.ContainsString(zoneNodes, node.Name) && node.Labels[zoneLabel] != zone {
+				suggestions = append(suggestions, NodeLabelSuggestion{Node: node.Name, Label: zoneLabel, Value: zone})
+			}
+		}
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		return suggestions[i].Node < suggestions[j].Node
+	})
+
+	return suggestions
+}
+
+// TopologySnapshot is a hypothetical set of storage nodes, given as the labels
+// of every node keyed by node name
+type TopologySnapshot struct {
+	NodeLabels map[string]map[string]string
+}
+
+// TopologyDecision is the outcome of the topology reconcile for a set of
+// storage nodes
+type TopologyDecision struct {
+	// FailureDomain is the Ceph failure domain of the StorageCluster
+	FailureDomain string
+	// TopologyMap holds the topology values found on the nodes, including
+	// the racks the operator would generate
+	TopologyMap *ocsv1.NodeTopologyMap
+	// NodeRacks is the rack the operator would label each node with, for
+	// the nodes that have no rack yet
+	NodeRacks map[string]string
+}
+
+// AnalyzeTopologySnapshot returns the decision the topology reconcile would
+// make for the StorageCluster if its storage nodes were the ones of the given
+// snapshot, without touching the cluster. The returned error is set if the
+// snapshot could not host the StorageCluster.
+func AnalyzeTopologySnapshot(snapshot TopologySnapshot, sc *ocsv1.StorageCluster) (TopologyDecision, error) {
+	decision := TopologyDecision{
+		TopologyMap: ocsv1.NewNodeTopologyMap(),
+		NodeRacks:   map[string]string{},
+	}
+
+	nodeNames := []string{}
+	for nodeName := range snapshot.NodeLabels {
+		nodeNames = append(nodeNames, nodeName)
+	}
+	sort.Strings(nodeNames)
+	nodes := &corev1.NodeList{}
+	for _, nodeName := range nodeNames {
+		node := corev1.Node{}
+		node.Name = nodeName
+		node.Labels = map[string]string{}
+		for label, value := range snapshot.NodeLabels[nodeName] {
+			node.Labels[label] = value
+		}
+		nodes.Items = append(nodes.Items, node)
+	}
+
+	minNodes := getMinimumNodes(sc)
+	if len(nodes.Items) < minNodes {
+		return decision, newTopologyError(ErrInsufficientNodes, fmt.Errorf("%w: Expected %d, found %d", ErrInsufficientNodes, minNodes, len(nodes.Items)))
+	}
+
+	topologyLabelKeys := append(getTopologyLabelKeys(sc), getCSITopologyLabelKeys(nodes)...)
+	nodeRacks := ocsv1.NewNodeTopologyMap()
+	for _, node := range nodes.Items {
+		for label, value := range node.Labels {
+			for _, key := range topologyLabelKeys {
+				if matchesTopologyLabelKey(label, key) && !decision.TopologyMap.Contains(label, value) {
+					decision.TopologyMap.Add(label, value)
+				}
+			}
+			if ocsv1.IsTopologyLabelOf(label, "rack") && !isCSITopologyLabel(label) && !nodeRacks.Contains(value, node.Name) {
+				nodeRacks.Add(value, node.Name)
+			}
+		}
+	}
+
+	analyzed := sc.DeepCopy()
+	analyzed.Status.NodeTopologies = decision.TopologyMap
+	decision.FailureDomain = determineFailureDomain(analyzed)
+
+	if decision.FailureDomain == "rack" {
+		minRacks, maxRacks := getMinRackCount(analyzed), 0
+		if analyzed.Spec.NodeTopologies != nil {
+			maxRacks = analyzed.Spec.NodeTopologies.MaxRackCount
+		}
+		if maxRacks > 0 && minRacks > maxRacks {
+			minRacks = maxRacks
+		}
+		nodesByName := getNodesByName(nodes)
+		for _, nodeName := range getNodesWithoutRack(nodes, nodeRacks) {
+			for _, node := range nodes.Items {
+				if node.Name != nodeName {
+					continue
+				}
+				rack := nodeCSIRack(node)
+				if rack == "" || !isRackInZone(nodes, nodeRacks, rack, nodeZone(node)) {
+					rack = determinePlacementRack(nodesByName, node, minRacks, maxRacks, getRackPrefix(analyzed), topologyLabelKeys, getRackCapacityKey(analyzed), nodeRacks)
+				}
+				nodeRacks.Add(rack, node.Name)
+				if !decision.TopologyMap.Contains(defaults.RackTopologyKey, rack) {
+					decision.TopologyMap.Add(defaults.RackTopologyKey, rack)
+				}
+				decision.NodeRacks[node.Name] = rack
+			}
+		}
+	}
+
+	return decision, validateDeviceSetPlacement(analyzed)
+}
+
+// CrushLocation returns the CRUSH location of the given node, in the
+// "key=value" format understood by Ceph, based on its topology labels. The
+// bucket of a type with several labels on the node is picked as in
+// nodeTopologyValue, so the location does not change between reconciles.
+func CrushLocation(node corev1.Node) string {
+	location := []string{"root=default"}
+	for _, bucketType := range crushLocationTypes {
+		if value := nodeTopologyValue(node, bucketType); value != "" {
+			location = append(location, fmt.Sprintf("%s=%s", bucketType, value))
+		}
+	}
+	if host, ok := node.Labels[corev1.LabelHostname]; ok {
+		location = append(location, fmt.Sprintf("host=%s", host))
+	}
+
+	return strings.Join(location, " ")
+}
+
+// ensureNodeCrushLocations annotates every given storage node with its CRUSH
+// location. Nodes already carrying the right annotation are not patched.
+func (r *ReconcileStorageCluster) ensureNodeCrushLocations(ctx context.Context, sc *ocsv1.StorageCluster, nodes *corev1.NodeList, reqLogger logr.Logger) error {
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		location := getNodeCrushLocation(sc, *node)
+		if node.Annotations[crushLocationAnnotation] == location {
+			continue
+		}
+		if _, ok := node.Annotations[crushLocationAnnotation]; ok && getTopologyMode(sc) == ocsv1.TopologyModeHybrid {
+			reqLogger.Info("Keeping existing CRUSH location of node", "Node", node.Name, "Location", node.Annotations[crushLocationAnnotation])
+			continue
+		}
+
+		reqLogger.Info("Annotating node with CRUSH location", "Node", node.Name, "Location", location)
+		newNode := node.DeepCopy()
+		if newNode.Annotations == nil {
+			newNode.Annotations = map[string]string{}
+		}
+		newNode.Annotations[crushLocationAnnotation] = location
+		patch, err := generateStrategicPatch(node, newNode)
+		if err != nil {
+			return err
+		}
+		err = r.getTopologyClient().Patch(ctx, node, patch)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getOverlappingStorageClusters returns, for every node in the given list,
+// the names of the other StorageClusters whose node selector matches it too
+func (r *ReconcileStorageCluster) getOverlappingStorageClusters(ctx context.Context, sc *ocsv1.StorageCluster, nodes *corev1.NodeList) (map[string][]string, error) {
+	overlaps := map[string][]string{}
+
+	storageClusterList := &ocsv1.StorageClusterList{}
+	err := r.client.List(ctx, storageClusterList)
+	if err != nil {
+		return overlaps, err
+	}
+
+	for _, other := range storageClusterList.Items {
+		if other.Namespace == sc.Namespace && other.Name == sc.Name {
+			continue
+		}
+		if other.Status.Phase == statusutil.PhaseIgnored || other.Spec.ExternalStorage.Enable {
+			continue
+		}
+		selectors, err := getStorageClusterNodeSelectors(&other)
+		if err != nil {
+			return overlaps, err
+		}
+		for _, node := range nodes.Items {
+			if matchesAnySelector(selectors, node.Labels) {
+				overlaps[node.Name] = append(overlaps[node.Name], fmt.Sprintf("%s/%s", other.Namespace, other.Name))
+			}
+		}
+	}
+
+	return overlaps, nil
+}
+
+// detectTopologyRebalance compares the current topology map with the
+// committed one and returns a description of the changes that may make Ceph
+// rebalance the data across the OSDs: a change of the failure domain type, or
+// values of the failure domain being added or removed. It returns an empty
+// string when the change is benign or no topology was committed yet.
+func detectTopologyRebalance(committedFailureDomain string, committed, current *ocsv1.NodeTopologyMap, weights map[string]int, zoneKey string, preferred bool) string {
+	if committedFailureDomain == "" || len(committed.Labels) == 0 {
+		return ""
+	}
+
+	failureDomain := failureDomainFromTopology(current, weights, zoneKey, preferred)
+	if failureDomain != committedFailureDomain {
+		return fmt.Sprintf("failure domain changes from %s to %s", committedFailureDomain, failureDomain)
+	}
+
+	_, committedValues := getTopologyKeyValues(committed, committedFailureDomain, zoneKey)
+	_, currentValues := getTopologyKeyValues(current, committedFailureDomain, zoneKey)
+	if len(committedValues) == 0 || statusutil.SortedEqual(committedValues, currentValues) {
+		return ""
+	}
+	added, removed := []string{}, []string{}
+	for _, value := range currentValues {
+		if !statusutil.ContainsString(committedValues, value) {
+			added = append(added, value)
+		}
+	}
+	for _, value := range committedValues {
+		if !statusutil.ContainsString(currentValues, value) {
+			removed = append(removed, value)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return ""
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	return fmt.Sprintf("%s values added %v, removed %v", committedFailureDomain, added, removed)
+}
+
+// isSingleFailureDomain returns whether the topology map has no more than one
+// zone and one rack, so that no failure domain spreads the data beyond a
+// single host
+func isSingleFailureDomain(topologyMap *ocsv1.NodeTopologyMap) bool {
+	_, zones := topologyMap.GetKeyValues("zone")
+	_, racks := topologyMap.GetKeyValues("rack")
+
+	return countDistinctValues(zones) <= 1 && len(racks) <= 1
+}
+
+// getTopologyHash returns a hash of the labels and values of the topology map
+func getTopologyHash(topologyMap *ocsv1.NodeTopologyMap) string {
+	hash := sha256.Sum256([]byte(strings.Join(getTopologyEntries(topologyMap), "\n")))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// topologyConvergenceThreshold is the number of consecutive reconciles which
+// must find the same node topology for it to be considered converged
+const topologyConvergenceThreshold = 3
+
+// trackTopologyConvergence records the given topology hash in the status of
+// the StorageCluster and counts the consecutive reconciles which found it
+// unchanged. The TopologyConverged condition is set once the count reaches
+// topologyConvergenceThreshold. It returns whether the status was updated.
+func trackTopologyConvergence(sc *ocsv1.StorageCluster, hash string, reqLogger logr.Logger) bool {
+	if sc.Status.TopologyHash != hash {
+		now := metav1.Now()
+		sc.Status.TopologyHash = hash
+		sc.Status.TopologyLastChangeTime = &now
+		sc.Status.TopologyStableReconciles = 0
+		if conditionsv1.FindStatusCondition(sc.Status.Conditions, ocsv1.ConditionTopologyConverged) != nil {
+			conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+				Type:    ocsv1.ConditionTopologyConverged,
+				Status:  corev1.ConditionFalse,
+				Reason:  "TopologyChanged",
+				Message: "The node topology changed since the last reconcile",
+			})
+		}
+		return true
+	}
+
+	if sc.Status.TopologyStableReconciles >= topologyConvergenceThreshold {
+		return false
+	}
+	sc.Status.TopologyStableReconciles++
+	if sc.Status.TopologyStableReconciles == topologyConvergenceThreshold {
+		reqLogger.Info("Node topology converged", "Reconciles", sc.Status.TopologyStableReconciles)
+		conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+			Type:    ocsv1.ConditionTopologyConverged,
+			Status:  corev1.ConditionTrue,
+			Reason:  "TopologyUnchanged",
+			Message: fmt.Sprintf("The node topology did not change for %d consecutive reconciles", sc.Status.TopologyStableReconciles),
+		})
+	}
+
+	return true
+}
+
+// setTopologyReadyCondition sets the TopologyReady condition of the
+// StorageCluster. Its message reports the given number of storage nodes and
+// the failure domain, followed by the given detail if any. It returns
+// whether the condition changed.
+func setTopologyReadyCondition(sc *ocsv1.StorageCluster, status corev1.ConditionStatus, reason string, nodeCount int, detail string) bool {
+	message := fmt.Sprintf("Found %d storage nodes, failure domain is %q", nodeCount, determineFailureDomain(sc))
+	if detail != "" {
+		message = fmt.Sprintf("%s: %s", message, detail)
+	}
+	if condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, ocsv1.ConditionTopologyReady); condition != nil &&
+		condition.Status == status && condition.Reason == reason && condition.Message == message {
+		return false
+	}
+	conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+		Type:    ocsv1.ConditionTopologyReady,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+
+	return true
+}
+
+// getTopologyChangeMessage returns a description of the change between the
+// committed failure domain and topology map and the current ones, or an
+// empty string if neither changed. The zones are read from the zoneKey label
+// if set, see getTopologyKeyValues.
+func getTopologyChangeMessage(committedFailureDomain string, committed *ocsv1.NodeTopologyMap, currentFailureDomain string, current *ocsv1.NodeTopologyMap, zoneKey string) string {
+	if committedFailureDomain == currentFailureDomain && statusutil.CompareStringSlicesUnordered(getTopologyEntries(committed), getTopologyEntries(current)) {
+		return ""
+	}
+
+	_, committedValues := getTopologyKeyValues(committed, committedFailureDomain, zoneKey)
+	_, currentValues := getTopologyKeyValues(current, currentFailureDomain, zoneKey)
+	return fmt.Sprintf("Node topology changed: failure domain %s %v, was %s %v",
+		currentFailureDomain, currentValues, committedFailureDomain, committedValues)
+}
+
+// IsTopologyStable returns whether the node topology of the StorageCluster
+// has not changed for at least the given window
+func IsTopologyStable(sc *ocsv1.StorageCluster, window time.Duration) bool {
+	if sc.Status.TopologyLastChangeTime == nil {
+		return true
+	}
+
+	return time.Since(sc.Status.TopologyLastChangeTime.Time) >= window
+}
+
+// getTopologyStabilityDelay returns how long the node topology of the
+// StorageCluster must remain unchanged to be stable for the given window, or
+// zero once it is stable
+func getTopologyStabilityDelay(sc *ocsv1.StorageCluster, window time.Duration) time.Duration {
+	if IsTopologyStable(sc, window) {
+		return 0
+	}
+
+	return window - time.Since(sc.Status.TopologyLastChangeTime.Time)
+}
+
+// getNewTopologyKeys returns the topology labels of the current topology map
+// which are absent from the committed one. Nothing is new while no topology
+// was committed yet.
+func getNewTopologyKeys(committed, current *ocsv1.NodeTopologyMap) []string {
+	newKeys := []string{}
+	if len(committed.Labels) == 0 {
+		return newKeys
+	}
+	for label := range current.Labels {
+		if _, ok := committed.Labels[label]; !ok {
+			newKeys = append(newKeys, label)
+		}
+	}
+	sort.Strings(newKeys)
+
+	return newKeys
+}
+
+// promoteFailureDomain switches the failure domain of the StorageCluster to
+// the one picked for its current topology map, if it has a higher weight. It
+// returns whether the failure domain was changed.
+func promoteFailureDomain(sc *ocsv1.StorageCluster, reqLogger logr.Logger) bool {
+	if sc.Status.FailureDomain == "" {
+		return false
+	}
+
+	weights := getFailureDomainWeights(sc)
+	failureDomain := failureDomainFromTopology(sc.Status.NodeTopologies, weights, getPreferredZoneKey(sc), getPreferredFailureDomain(sc) != "")
+	if weights[failureDomain] <= weights[sc.Status.FailureDomain] {
+		return false
+	}
+
+	reqLogger.Info("Promoting failure domain", "From", sc.Status.FailureDomain, "To", failureDomain)
+	sc.Status.FailureDomain = failureDomain
+
+	return true
+}
+
+// getFailureDomainSpreadFactor returns the number of distinct values of the
+// failure domain divided by the replica count of the StorageCluster
+func getFailureDomainSpreadFactor(sc *ocsv1.StorageCluster) float64 {
+	if sc.Status.NodeTopologies == nil {
+		return 0
+	}
+	_, values := getTopologyKeyValues(sc.Status.NodeTopologies, determineFailureDomain(sc), getPreferredZoneKey(sc))
+
+	return float64(len(values)) / float64(getDeviceSetReplica(sc))
+}
+
+// getTopologyPhase aggregates the node count, failure domain and topology
+// checks of the StorageCluster into a single phase with a human readable
+// summary. topologyErr is the error, if any, returned while reconciling the
+// node topology.
+func getTopologyPhase(sc *ocsv1.StorageCluster, nodes *corev1.NodeList, topologyErr error) (ocsv1.TopologyPhase, string) {
+	minNodes := getMinimumNodes(sc)
+	if len(nodes.Items) < minNodes {
+		return ocsv1.TopologyPhaseInsufficient, fmt.Sprintf("%d storage nodes found, at least %d are required", len(nodes.Items), minNodes)
+	}
+
+	failureDomain := determineFailureDomain(sc)
+	topologyMap := sc.Status.NodeTopologies
+	if topologyMap == nil {
+		topologyMap = ocsv1.NewNodeTopologyMap()
+	}
+	label, values := getTopologyKeyValues(topologyMap, failureDomain, getPreferredZoneKey(sc))
+	if replica := getDeviceSetReplica(sc); len(values) < replica {
+		return ocsv1.TopologyPhaseInsufficient, fmt.Sprintf("%d values of the %s failure domain found, at least %d are required", len(values), failureDomain, replica)
+	}
+
+	if topologyErr != nil {
+		return ocsv1.TopologyPhaseMisconfigured, topologyErr.Error()
+	}
+	if condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, ocsv1.ConditionTopologyValid); condition != nil && condition.Status == corev1.ConditionFalse {
+		return ocsv1.TopologyPhaseMisconfigured, condition.Message
+	}
+
+	nodeCounts := map[string]int{}
+	for _, node := range nodes.Items {
+		if value, ok := node.Labels[label]; ok {
+			nodeCounts[value]++
+		}
+	}
+	minCount, maxCount := len(nodes.Items), 0
+	for _, value := range values {
+		if nodeCounts[value] < minCount {
+			minCount = nodeCounts[value]
+		}
+		if nodeCounts[value] > maxCount {
+			maxCount = nodeCounts[value]
+		}
+	}
+	if maxCount-minCount > 1 {
+		return ocsv1.TopologyPhaseDegraded, fmt.Sprintf("storage nodes are unevenly spread over the %s failure domain: %v", failureDomain, nodeCounts)
+	}
+
+	return ocsv1.TopologyPhaseHealthy, fmt.Sprintf("%d storage nodes spread over %d values of the %s failure domain", len(nodes.Items), len(values), failureDomain)
+}
+
+// reconcileTopologyPhase sets the topology phase of the StorageCluster
+// status, given its storage nodes and the error, if any, returned while
+// reconciling the node topology
+func (r *ReconcileStorageCluster) reconcileTopologyPhase(ctx context.Context, sc *ocsv1.StorageCluster, nodes *corev1.NodeList, topologyErr error, reqLogger logr.Logger) error {
+	phase, summary := getTopologyPhase(sc, nodes, topologyErr)
+	if sc.Status.TopologyPhase == phase && sc.Status.TopologySummary == summary {
+		return nil
+	}
+
+	reqLogger.Info("Updating topology phase", "Phase", phase, "Summary", summary)
+	sc.Status.TopologyPhase = phase
+	sc.Status.TopologySummary = summary
+
+	return r.client.Status().Update(ctx, sc)
+}
+
+// VerifyTopologyMapCompleteness compares the topology map with the topology
+// labels of the given nodes. It returns the names of the nodes carrying a
+// topology value absent from the map, and the "label=value" entries of the
+// map which are not carried by any of the nodes. The topology labels are the
+// node labels matching any of topologyLabelKeys.
+func VerifyTopologyMapCompleteness(topologyMap *ocsv1.NodeTopologyMap, nodes *corev1.NodeList, topologyLabelKeys []string) (missing []string, extra []string) {
+	redundant := getRedundantDeprecatedLabels(nodes)
+	observed := ocsv1.NewNodeTopologyMap()
+	for _, node := range nodes.Items {
+		nodeMissing := false
+		for label, value := range node.Labels {
+			if redundant[label] {
+				continue
+			}
+			for _, key := range topologyLabelKeys {
+				if !matchesTopologyLabelKey(label, key) {
+					continue
+				}
+				if !observed.Contains(label, value) {
+					observed.Add(label, value)
+				}
+				if !topologyMap.Contains(label, value) {
+					nodeMissing = true
+				}
+			}
+		}
+		if nodeMissing {
+			missing = append(missing, node.Name)
+		}
+	}
+
+	extra = statusutil.StringSetDifference(getTopologyEntries(topologyMap), getTopologyEntries(observed))
+	sort.Strings(missing)
+
+	return missing, extra
+}
+
+// pruneTopologyValues removes from the node topology map of the StorageCluster
+// the stale "label=value" entries which have not been observed on any storage
+// node for at least gracePeriod. Stale values are tracked in
+// Status.TopologyValuesLastSeen until they are either observed again or
+// pruned. It returns whether the status of the StorageCluster was changed.
+func pruneTopologyValues(sc *ocsv1.StorageCluster, stale []string, gracePeriod time.Duration, now metav1.Time, reqLogger logr.Logger) bool {
+	topologyMap := sc.Status.NodeTopologies
+	changed := false
+
+	lastSeen := map[string]metav1.Time{}
+	for label, values := range topologyMap.Labels {
+		remaining := ocsv1.TopologyLabelValues{}
+		for _, value := range values {
+			key := fmt.Sprintf("%s=%s", label, value)
+			if !statusutil.ContainsString(stale, key) {
+				remaining = append(remaining, value)
+				continue
+			}
+
+			seen, ok := sc.Status.TopologyValuesLastSeen[key]
+			if !ok {
+				reqLogger.Info("Topology value is no longer found on any node", "Label", label, "Value", value, "GracePeriod", gracePeriod)
+				seen = now
+				changed = true
+			}
+			if now.Sub(seen.Time) >= gracePeriod {
+				reqLogger.Info("Pruning stale topology value", "Label", label, "Value", value, "LastSeen", seen)
+				changed = true
+				continue
+			}
+			lastSeen[key] = seen
+			remaining = append(remaining, value)
+		}
+
+		if len(remaining) == 0 {
+			delete(topologyMap.Labels, label)
+		} else {
+			topologyMap.Labels[label] = remaining
+		}
+	}
+
+	if len(lastSeen) != len(sc.Status.TopologyValuesLastSeen) {
+		changed = true
+	}
+	if len(lastSeen) == 0 {
+		lastSeen = nil
+	}
+	sc.Status.TopologyValuesLastSeen = lastSeen
+
+	return changed
+}
+
+// rebuildTopologyMap replaces the content of the node topology map of the
+// StorageCluster with the topology labels of the given nodes, matching any of
+// topologyLabelKeys. The racks of the nodes are kept, as they are labels of
+// the nodes too. It returns whether the map was changed.
+func rebuildTopologyMap(sc *ocsv1.StorageCluster, nodes *corev1.NodeList, topologyLabelKeys []string, reqLogger logr.Logger) bool {
+	redundant := getRedundantDeprecatedLabels(nodes)
+	rebuilt := ocsv1.NewNodeTopologyMap()
+	for _, node := range nodes.Items {
+		for label, value := range node.Labels {
+			if redundant[label] {
+				continue
+			}
+			for _, key := range topologyLabelKeys {
+				if matchesTopologyLabelKey(label, key) && !rebuilt.Contains(label, value) {
+					rebuilt.Add(label, value)
+				}
+			}
+		}
+	}
+
+	changed := false
+	if sc.Status.TopologyValuesLastSeen != nil {
+		sc.Status.TopologyValuesLastSeen = nil
+		changed = true
+	}
+
+	added, removed := diffTopologyMaps(sc.Status.NodeTopologies, rebuilt)
+	if len(added) == 0 && len(removed) == 0 {
+		return changed
+	}
+
+	reqLogger.Info("Rebuilt the node topology map from the storage nodes", "Added", added, "Removed", removed)
+	sc.Status.NodeTopologies.Labels = rebuilt.Labels
+
+	return true
+}
+
+// diffTopologyMaps returns the sorted "label=value" entries of the current
+// topology map absent from the previous one, and those of the previous one
+// absent from the current one
+func diffTopologyMaps(previous, current *ocsv1.NodeTopologyMap) (added []string, removed []string) {
+	previousEntries, currentEntries := getTopologyEntries(previous), getTopologyEntries(current)
+
+	return statusutil.StringSetDifference(currentEntries, previousEntries), statusutil.StringSetDifference(previousEntries, currentEntries)
+}
+
+// deprecatedTopologyLabels are the deprecated topology labels of the nodes,
+// keyed by the label replacing them
+var deprecatedTopologyLabels = map[string]string{
+	corev1.LabelZoneFailureDomainStable: corev1.LabelZoneFailureDomain,
+	corev1.LabelZoneRegionStable:        corev1.LabelZoneRegion,
+}
+
+// getRedundantDeprecatedLabels returns the deprecated topology labels of the
+// given nodes whose values are all carried by the label replacing them, e.g.
+// when only the older nodes still carry the deprecated label
+func getRedundantDeprecatedLabels(nodes *corev1.NodeList) map[string]bool {
+	redundant := map[string]bool{}
+	for label, deprecated := range deprecatedTopologyLabels {
+		values, deprecatedValues := []string{}, []string{}
+		for _, node := range nodes.Items {
+			if value, ok := node.Labels[label]; ok {
+				values = append(values, value)
+			}
+			if value, ok := node.Labels[deprecated]; ok {
+				deprecatedValues = append(deprecatedValues, value)
+			}
+		}
+		if len(values) > 0 && len(deprecatedValues) > 0 && len(statusutil.StringSetDifference(deprecatedValues, values)) == 0 {
+			redundant[deprecated] = true
+		}
+	}
+
+	return redundant
+}
+
+// filterDeprecatedLabels removes the given redundant deprecated labels from
+// the topology map. It returns whether the topology map was changed.
+func filterDeprecatedLabels(topologyMap *ocsv1.NodeTopologyMap, redundant map[string]bool, reqLogger logr.Logger) bool {
+	changed := false
+	for label := range redundant {
+		if _, ok := topologyMap.Labels[label]; ok {
+			reqLogger.Info("Removing deprecated topology label covered by its replacement from the node topology map", "Label", label)
+			delete(topologyMap.Labels, label)
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// getPartiallyOverlappingZoneLabels returns a description of the zone labels
+// of the topology map sharing only some of their values, e.g. a deprecated
+// and a current zone label set to different zones on some of the nodes, or
+// an empty string if there are none
+func getPartiallyOverlappingZoneLabels(topologyMap *ocsv1.NodeTopologyMap) string {
+	zoneLabels := []string{}
+	for label := range topologyMap.Labels {
+		if ocsv1.IsTopologyLabelOf(label, "zone") {
+			zoneLabels = append(zoneLabels, label)
+		}
+	}
+	sort.Strings(zoneLabels)
+
+	overlaps := []string{}
+	for i, label := range zoneLabels {
+		for _, other := range zoneLabels[i+1:] {
+			values := statusutil.StringSliceToSet(topologyMap.Labels[label])
+			otherValues := statusutil.StringSliceToSet(topologyMap.Labels[other])
+			shared := statusutil.StringIntersection(topologyMap.Labels[label], topologyMap.Labels[other])
+			if len(shared) > 0 && (len(shared) < len(values) || len(shared) < len(otherValues)) {
+				overlaps = append(overlaps, fmt.Sprintf("%s and %s only share %v", label, other, shared))
+			}
+		}
+	}
+
+	return strings.Join(overlaps, "; ")
+}
+
+// getTopologyEntries returns the sorted "label=value" entries of the given
+// topology map
+func getTopologyEntries(topologyMap *ocsv1.NodeTopologyMap) []string {
+	entries := []string{}
+	for label, values := range topologyMap.Labels {
+		for _, value := range values {
+			entries = append(entries, fmt.Sprintf("%s=%s", label, value))
+		}
+	}
+	sort.Strings(entries)
+
+	return entries
+}
+
+// getCephPoolSpecs returns the specs of all the Ceph pools the operator
+// creates for the given StorageCluster, keyed by a descriptive pool name
+func (r *ReconcileStorageCluster) getCephPoolSpecs(sc *ocsv1.StorageCluster) (map[string]cephv1.PoolSpec, error) {
+	pools := map[string]cephv1.PoolSpec{}
+
+	cephBlockPools, err := r.newCephBlockPoolInstances(sc)
+	if err != nil {
+		return nil, err
+	}
+	for _, cephBlockPool := range cephBlockPools {
+		pools[cephBlockPool.Name] = cephBlockPool.Spec
+	}
+
+	cephFilesystems, err := r.newCephFilesystemInstances(sc)
+	if err != nil {
+		return nil, err
+	}
+	for _, cephFilesystem := range cephFilesystems {
+		pools[cephFilesystem.Name+"-metadata"] = cephFilesystem.Spec.MetadataPool
+		for i, dataPool := range cephFilesystem.Spec.DataPools {
+			pools[fmt.Sprintf("%s-data%d", cephFilesystem.Name, i)] = dataPool
+		}
+	}
+
+	cephObjectStores, err := r.newCephObjectStoreInstances(sc)
+	if err != nil {
+		return nil, err
+	}
+	for _, cephObjectStore := range cephObjectStores {
+		pools[cephObjectStore.Name+"-metadata"] = cephObjectStore.Spec.MetadataPool
+		pools[cephObjectStore.Name+"-data"] = cephObjectStore.Spec.DataPool
+	}
+
+	return pools, nil
+}
+
+// validatePoolsTopology checks that the node topology provides enough values
+// of the failure domain of every given pool for Ceph to satisfy its CRUSH
+// rule: one per replica for replicated pools, and one per chunk for erasure
+// coded pools. Replicated pools of size 1 have no redundancy, so they are
+// not checked and only a warning is logged.
+func validatePoolsTopology(sc *ocsv1.StorageCluster, pools map[string]cephv1.PoolSpec, reqLogger logr.Logger) error {
+	topologyMap := sc.Status.NodeTopologies
+	if topologyMap == nil {
+		topologyMap = ocsv1.NewNodeTopologyMap()
+	}
+
+	names := []string{}
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		pool := pools[name]
+		failureDomain := getAliasedFailureDomain(sc, pool.FailureDomain)
+		if failureDomain == "" {
+			failureDomain = determineFailureDomain(sc)
+		}
+		// host and osd buckets are not tracked in the node topology map
+		if failureDomain == "host" || failureDomain == "osd" {
+			continue
+		}
+
+		required := int(pool.Replicated.Size)
+		poolType := "replicated"
+		if pool.ErasureCoded.DataChunks+pool.ErasureCoded.CodingChunks > 0 {
+			required = int(pool.ErasureCoded.DataChunks + pool.ErasureCoded.CodingChunks)
+			poolType = "erasure coded"
+		} else if required == 1 {
+			reqLogger.Info("Pool has a single replica and does not survive the loss of any failure domain", "Pool", name)
+			continue
+		}
+
+		_, values := getTopologyKeyValues(topologyMap, failureDomain, getPreferredZoneKey(sc))
+		if len(values) < required {
+			return fmt.Errorf("%s pool %q requires %d distinct %s failure domains, but only %d were found %v",
+				poolType, name, required, failureDomain, len(values), values)
+		}
+	}
+
+	return nil
+}
+
+// failureDomainReason returns a human readable explanation of the failure
+// domain picked by determineFailureDomain
+func failureDomainReason(sc *ocsv1.StorageCluster) string {
+	if sc.Status.FailureDomain != "" {
+		return "failure domain already set in status"
+	}
+	if sc.Status.NodeTopologies != nil {
+		if determineFailureDomain(sc) == "datacenter" {
+			_, datacenters := sc.Status.NodeTopologies.GetKeyValues("datacenter")
+			return fmt.Sprintf("%d datacenters found", countDistinctValues(datacenters))
+		}
+		_, zones := getTopologyKeyValues(sc.Status.NodeTopologies, "zone", getPreferredZoneKey(sc))
+		if zoneCount := countDistinctValues(zones); zoneCount >= 3 {
+			return fmt.Sprintf("%d zones found", zoneCount)
+		} else if zoneCount > 0 {
+			return fmt.Sprintf("only %d zones found", zoneCount)
+		}
+	}
+
+	return "no zone labels found"
+}
+
+// minParentRegions is the number of distinct regions required for the
+// regions to form a failure domain level above the zones
+const minParentRegions = 2
+
+// determineParentFailureDomain returns the failure domain type above the
+// failure domain of the StorageCluster. It is region when the zone failure
+// domain holds at least three zones spread over at least minParentRegions
+// regions, and empty otherwise, keeping a single level failure domain.
+func determineParentFailureDomain(sc *ocsv1.StorageCluster) string {
+	if sc.Status.NodeTopologies == nil || determineFailureDomain(sc) != "zone" {
+		return ""
+	}
+
+	_, zones := getTopologyKeyValues(sc.Status.NodeTopologies, "zone", getPreferredZoneKey(sc))
+	_, regions := sc.Status.NodeTopologies.GetKeyValues("region")
+	if countDistinctValues(zones) < 3 || countDistinctValues(regions) < minParentRegions {
+		return ""
+	}
+
+	return "region"
+}
+
+// getFailureDomainReason explains why the failure domain of the StorageCluster
+// is used, including why the requested one is not when they differ
+func getFailureDomainReason(sc *ocsv1.StorageCluster) string {
+	reason := failureDomainReason(sc)
+	if sc.Spec.NodeTopologies == nil || sc.Spec.NodeTopologies.FailureDomain == "" {
+		return reason
+	}
+
+	requested := sc.Spec.NodeTopologies.FailureDomain
+	if requested == determineFailureDomain(sc) {
+		return "requested failure domain is available"
+	}
+
+	return fmt.Sprintf("requested %s failure domain is not available: %s", requested, reason)
+}
+
+// minFailureDomainBuckets is the number of distinct buckets a preferred
+// failure domain must provide to hold the replicas of the data
+const minFailureDomainBuckets = 3
+
+// countFailureDomainBuckets returns the number of distinct host, rack or zone
+// buckets of the given failure domain the given nodes are part of, see
+// nodesPerFailureDomain
+func countFailureDomainBuckets(nodes *corev1.NodeList, failureDomain, zoneKey string) int {
+	buckets := []string{}
+	for bucket := range nodesPerFailureDomain(nodes, failureDomain, zoneKey) {
+		buckets = append(buckets, bucket)
+	}
+
+	return countDistinctValues(buckets)
+}
+
+// nodesPerFailureDomain returns the number of the given nodes in each value
+// of the given failure domain. The value of a node is read from the label
+// holding the failure domain, nodes without it are not counted. The zone of
+// a node carrying the zoneKey label, if set, is read from it.
+func nodesPerFailureDomain(nodes *corev1.NodeList, failureDomain, zoneKey string) map[string]int {
+	counts := map[string]int{}
+	for _, node := range nodes.Items {
+		value := ""
+		switch failureDomain {
+		case "host":
+			value = node.Labels[corev1.LabelHostname]
+		case "rack":
+			value = node.Labels[defaults.RackTopologyKey]
+		case "zone":
+			value = nodePreferredZone(node, zoneKey)
+		case "datacenter":
+			value = nodeDatacenter(node)
+		}
+		if value != "" {
+			counts[value]++
+		}
+	}
+
+	return counts
+}
+
+// getEmptyFailureDomains returns the sorted values of the failure domain in
+// the topology map which hold none of the storage nodes counted in
+// failureDomainNodes. The zones are read from the zoneKey label if set, see
+// getTopologyKeyValues.
+func getEmptyFailureDomains(topologyMap *ocsv1.NodeTopologyMap, failureDomain, zoneKey string, failureDomainNodes map[string]int) []string {
+	empty := []string{}
+	_, values := getTopologyKeyValues(topologyMap, failureDomain, zoneKey)
+	for _, value := range values {
+		if failureDomainNodes[value] == 0 && !statusutil.ContainsString(empty, value) {
+			empty = append(empty, value)
+		}
+	}
+	sort.Strings(empty)
+
+	return empty
+}
+
+// validatePreferredFailureDomain checks that the given nodes provide enough
+// buckets of the preferred failure domain of the StorageCluster. The racks
+// are not checked unless the topology is managed by the admin, as the
+// operator generates the missing ones.
+func validatePreferredFailureDomain(sc *ocsv1.StorageCluster, nodes *corev1.NodeList) error {
+	preferred := getPreferredFailureDomain(sc)
+	if preferred == "" {
+		return nil
+	}
+
+	if preferred == "rack" && getTopologyMode(sc) != ocsv1.TopologyModeManual {
+		return nil
+	}
+	if count := countFailureDomainBuckets(nodes, preferred, getPreferredZoneKey(sc)); count < minFailureDomainBuckets {
+		return fmt.Errorf("preferred failure domain %s requires at least %d %s buckets, but the storage nodes provide %d", preferred, minFailureDomainBuckets, preferred, count)
+	}
+
+	return nil
+}
+
+// validateFailureDomainValues validates that the given failure domain of the
+// StorageCluster provides at least as many distinct values as the replica
+// count of its StorageDeviceSets, so that every replica can be placed in
+// its own failure domain
+func validateFailureDomainValues(sc *ocsv1.StorageCluster, nodes *corev1.NodeList, failureDomain string) error {
+	values := []string{}
+	if failureDomain == "host" {
+		// host buckets are not tracked in the node topology map
+		for _, node := range nodes.Items {
+			values = append(values, node.Labels[corev1.LabelHostname])
+		}
+	} else if sc.Status.NodeTopologies != nil {
+		_, values = getTopologyKeyValues(sc.Status.NodeTopologies, failureDomain, getPreferredZoneKey(sc))
+	}
+
+	replica := getDeviceSetReplica(sc)
+	if count := countDistinctValues(values); count < replica {
+		return newTopologyError(ErrInsufficientFailureDomains, fmt.Errorf("%w: the %s failure domain has %d values, at least %d are required for the replicas",
+			ErrInsufficientFailureDomains, failureDomain, count, replica))
+	}
+
+	return nil
+}
+
+// placementDecisionLogLevel is the verbosity of the placement decision log,
+// so that it can be suppressed
+const placementDecisionLogLevel = 1
+
+// getPlacementDecision returns the structured key/value pairs summing up
+// the placement decision of a reconcile of the node topology: the failure
+// domain and its label and values, the number of storage nodes and the
+// minimum required, and the number of racks created by the reconcile
+func getPlacementDecision(sc *ocsv1.StorageCluster, nodes *corev1.NodeList, failureDomain string, racksCreated int) []interface{} {
+	topologyKey, values := corev1.LabelHostname, []string{}
+	if failureDomain == "host" {
+		for _, node := range nodes.Items {
+			values = append(values, node.Labels[corev1.LabelHostname])
+		}
+		sort.Strings(values)
+	} else if sc.Status.NodeTopologies != nil {
+		topologyKey, values = getTopologyKeyValues(sc.Status.NodeTopologies, failureDomain, getPreferredZoneKey(sc))
+	}
+
+	return []interface{}{
+		"FailureDomain", failureDomain,
+		"TopologyKey", topologyKey,
+		"Values", values,
+		"Reason", getFailureDomainReason(sc),
+		"Nodes", len(nodes.Items),
+		"MinNodes", getMinimumNodes(sc),
+		"RacksCreated", racksCreated,
+	}
+}
+
+// getZoneFallbackMessage returns the reason and a warning explaining why the
+// rack failure domain is used although the storage nodes have zone labels,
+// or empty strings if the zone labels play no part in the failure domain
+// decision. A single zone gets its own reason, as it can't provide any
+// zone-level resilience.
+func getZoneFallbackMessage(sc *ocsv1.StorageCluster) (string, string) {
+	if sc.Status.NodeTopologies == nil || determineFailureDomain(sc) != "rack" {
+		return "", ""
+	}
+	_, zones := getTopologyKeyValues(sc.Status.NodeTopologies, "zone", getPreferredZoneKey(sc))
+	zoneCount := countDistinctValues(zones)
+	if zoneCount == 0 || zoneCount >= 3 {
+		return "", ""
+	}
+	if zoneCount == 1 {
+		return "SingleZone", fmt.Sprintf("all storage nodes are in zone %s, zone-level resilience is not possible — using rack failure domain", zones[0])
+	}
+
+	return "NotEnoughZones", fmt.Sprintf("zone labels present but only %d zones found; 3 required — using rack failure domain", zoneCount)
+}
+
+// traceFailureDomain determines the failure domain of the StorageCluster
+// within a span recording the decision, if a tracer is configured
+func (r *ReconcileStorageCluster) traceFailureDomain(ctx context.Context, sc *ocsv1.StorageCluster) string {
+	failureDomain := determineFailureDomain(sc)
+	if r.tracer == nil {
+		return failureDomain
+	}
+
+	_, span := r.tracer.Start(ctx, "determineFailureDomain")
+	defer span.End()
+
+	zoneCount, rackCount := 0, 0
+	if sc.Status.NodeTopologies != nil {
+		_, zones := getTopologyKeyValues(sc.Status.NodeTopologies, "zone", getPreferredZoneKey(sc))
+		_, racks := sc.Status.NodeTopologies.GetKeyValues("rack")
+		zoneCount, rackCount = countDistinctValues(zones), len(racks)
+	}
+	span.SetAttributes(map[string]interface{}{
+		"failureDomain.type": failureDomain,
+		"zoneCount":          zoneCount,
+		"rackCount":          rackCount,
+		"reason":             failureDomainReason(sc),
+	})
+
+	return failureDomain
+}
+
+// TopologyTable returns a flat representation of the topology of all nodes
+// in the cluster, suitable for consumption by CLI tools. The first row is a
+// header, followed by one row per node sorted by node name. The zone and rack
+// of a node are picked by nodePreferredZone and nodeRack.
+func (r *ReconcileStorageCluster) TopologyTable(ctx context.Context, sc *ocsv1.StorageCluster) ([][]string, error) {
+	eligibleNodes, err := r.getStorageClusterEligibleNodes(ctx, sc, r.reqLogger)
+	if err != nil {
+		return nil, err
+	}
+	eligible := map[string]bool{}
+	for _, node := range eligibleNodes.Items {
+		eligible[node.Name] = true
+	}
+
+	nodes := &corev1.NodeList{}
+	err = r.getTopologyClient().List(ctx, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	table := [][]string{topologyTableHeader}
+	for _, node := range nodes.Items {
+		table = append(table, []string{
+			node.Name,
+			nodePreferredZone(node, getPreferredZoneKey(sc)),
+			nodeRack(node),
+			node.Labels[corev1.LabelHostname],
+			strconv.FormatBool(eligible[node.Name]),
+		})
+	}
+	rows := table[1:]
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i][0] < rows[j][0]
+	})
+
+	return table, nil
+}
+
+// getTopologyStatus returns the view of the node topology exposed in the
+// StorageCluster status, with the storage nodes grouped by the values of the
+// given failure domain
+func getTopologyStatus(failureDomain string, nodes *corev1.NodeList, topologyMap, nodeRacks *ocsv1.NodeTopologyMap) *ocsv1.TopologyStatus {
+	status := &ocsv1.TopologyStatus{
+		FailureDomain: failureDomain,
+		Keys:          []string{},
+		ValueCounts:   map[string]int{},
+		Domains:       map[string][]string{},
+	}
+
+	for label, values := range topologyMap.Labels {
+		status.Keys = append(status.Keys, label)
+		status.ValueCounts[label] = countDistinctValues(values)
+	}
+	sort.Strings(status.Keys)
+
+	switch failureDomain {
+	case "datacenter":
+		for _, node := range nodes.Items {
+			if datacenter := nodeDatacenter(node); datacenter != "" {
+				status.Domains[datacenter] = append(status.Domains[datacenter], node.Name)
+			}
+		}
+	case "zone":
+		for _, node := range nodes.Items {
+			if zone := nodeZone(node); zone != "" {
+				status.Domains[zone] = append(status.Domains[zone], node.Name)
+			}
+		}
+	case "rack":
+		for rack, nodeNames := range nodeRacks.Labels {
+			if len(nodeNames) > 0 {
+				status.Domains[rack] = append([]string{}, nodeNames...)
+			}
+		}
+	}
+	for _, nodeNames := range status.Domains {
+		sort.Strings(nodeNames)
+	}
+
+	return status
+}
+
+// isNodeExcluded returns whether new storage Pods can not be scheduled on the
+// given node, because it is cordoned or has a taint not tolerated by them
+func isNodeExcluded(node corev1.Node) bool {
+	if node.Spec.Unschedulable {
+		return true
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == defaults.NodeTolerationKey {
+			continue
+		}
+		if taint.Effect == corev1.TaintEffectNoSchedule || taint.Effect == corev1.TaintEffectNoExecute {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getNodeExclusionReason returns why storage Pods can not run on the given
+// node selected for the StorageCluster, or an empty string if they can: the
+// node is not eligible, see getNodeIneligibleReason, or new Pods can not be
+// scheduled on it, see isNodeExcluded
+func getNodeExclusionReason(sc *ocsv1.StorageCluster, node corev1.Node) string {
+	if reason := getNodeIneligibleReason(sc, node); reason != "" {
+		return reason
+	}
+	if !isNodeExcluded(node) {
+		return ""
+	}
+	if node.Spec.Unschedulable {
+		return "cordoned"
+	}
+
+	return "tainted"
+}
+
+// formatExcludedNodes returns the given excluded nodes with the reason of
+// their exclusion, sorted by node name, e.g. "node1 (cordoned), node2
+// (tainted)"
+func formatExcludedNodes(excluded map[string]string) string {
+	nodeNames := []string{}
+	for nodeName := range excluded {
+		nodeNames = append(nodeNames, nodeName)
+	}
+	sort.Strings(nodeNames)
+	for i, nodeName := range nodeNames {
+		nodeNames[i] = fmt.Sprintf("%s (%s)", nodeName, excluded[nodeName])
+	}
+
+	return strings.Join(nodeNames, ", ")
+}
+
+// validateExcludedNodes checks that the nodes selected for the StorageCluster
+// which are not excluded, see getNodeExclusionReason, still provide
+// minValues distinct values of the failure domain. It returns the reason of
+// each excluded node and the sorted remaining values when they do not.
+func validateExcludedNodes(sc *ocsv1.StorageCluster, failureDomain string, minValues int, nodes *corev1.NodeList, nodeRacks *ocsv1.NodeTopologyMap) (map[string]string, []string) {
+	nodeValues := map[string]string{}
+	switch failureDomain {
+	case "datacenter":
+		for _, node := range nodes.Items {
+			nodeValues[node.Name] = nodeDatacenter(node)
+		}
+	case "zone":
+		for _, node := range nodes.Items {
+			nodeValues[node.Name] = nodeZone(node)
+		}
+	case "rack":
+		for rack, nodeNames := range nodeRacks.Labels {
+			for _, nodeName := range nodeNames {
+				nodeValues[nodeName] = rack
+			}
+		}
+	default:
+		return nil, nil
+	}
+
+	excluded := map[string]string{}
+	remaining := map[string]bool{}
+	for _, node := range nodes.Items {
+		if reason := getNodeExclusionReason(sc, node); reason != "" {
+			excluded[node.Name] = reason
+		} else if value := nodeValues[node.Name]; value != "" {
+			remaining[value] = true
+		}
+	}
+	if len(excluded) == 0 || len(remaining) >= minValues {
+		return nil, nil
+	}
+
+	values := []string{}
+	for value := range remaining {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	return excluded, values
+}
+
+// TopologyReport is the diagnostic view of the topology of a StorageCluster
+// returned by GatherTopologyReport
+type TopologyReport struct {
+	StorageCluster      string                   `json:"storageCluster"`
+	Nodes               []TopologyReportNode     `json:"nodes"`
+	NodeTopologies      *ocsv1.NodeTopologyMap   `json:"nodeTopologies,omitempty"`
+	FailureDomain       string                   `json:"failureDomain"`
+	FailureDomainReason string                   `json:"failureDomainReason"`
+	Racks               map[string][]string      `json:"racks"`
+	PendingRacks        map[string]string        `json:"pendingRacks"`
+	Warnings            []string                 `json:"warnings"`
+	Conditions          []conditionsv1.Condition `json:"conditions"`
+}
+
+// TopologyReportNode is a node selected for the StorageCluster in a
+// TopologyReport. Eligible is whether it is one of the storage nodes, see
+// getStorageClusterEligibleNodes, and ExclusionReason why storage Pods can
+// not run on it, see getNodeExclusionReason.
+type TopologyReportNode struct {
+	Name            string            `json:"name"`
+	Labels          map[string]string `json:"labels"`
+	CrushLocation   string            `json:"crushLocation"`
+	Eligible        bool              `json:"eligible"`
+	ExclusionReason string            `json:"exclusionReason,omitempty"`
+}
+
+// GatherTopologyReport returns a JSON document describing the nodes selected
+// for the StorageCluster, their topology labels, the failure domain decision
+// and the topology issues found, for inclusion in support bundles. The
+// decision and the issues are based on the storage nodes, as in the
+// reconcile. It only reads from the cluster.
+func (r *ReconcileStorageCluster) GatherTopologyReport(ctx context.Context, sc *ocsv1.StorageCluster) ([]byte, error) {
+	nodes, err := r.getStorageClusterNodes(ctx, sc)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(nodes.Items, func(i, j int) bool {
+		return nodes.Items[i].Name < nodes.Items[j].Name
+	})
+	eligibleNodes := getEligibleNodes(sc, nodes, r.reqLogger)
+
+	report := TopologyReport{
+		StorageCluster:      fmt.Sprintf("%s/%s", sc.Namespace, sc.Name),
+		Nodes:               []TopologyReportNode{},
+		NodeTopologies:      sc.Status.NodeTopologies,
+		FailureDomain:       determineFailureDomain(sc),
+		FailureDomainReason: failureDomainReason(sc),
+		Racks:               map[string][]string{},
+		Warnings:            []string{},
+		Conditions:          sc.Status.Conditions,
+	}
+
+	snapshot := TopologySnapshot{NodeLabels: map[string]map[string]string{}}
+	nodeRacks := ocsv1.NewNodeTopologyMap()
+	for _, node := range nodes.Items {
+		report.Nodes = append(report.Nodes, TopologyReportNode{
+			Name:            node.Name,
+			Labels:          TopologyLabels(node),
+			CrushLocation:   getNodeCrushLocation(sc, node),
+			Eligible:        getNodeIneligibleReason(sc, node) == "",
+			ExclusionReason: getNodeExclusionReason(sc, node),
+		})
+	}
+	for _, node := range eligibleNodes.Items {
+		snapshot.NodeLabels[node.Name] = node.Labels
+		if rack, ok := node.Labels[defaults.RackTopologyKey]; ok {
+			nodeRacks.Add(rack, node.Name)
+			report.Racks[rack] = append(report.Racks[rack], node.Name)
+		}
+	}
+
+	decision, err := AnalyzeTopologySnapshot(snapshot, sc)
+	if err != nil {
+		report.Warnings = append(report.Warnings, err.Error())
+	}
+	report.PendingRacks = decision.NodeRacks
+
+	if zones := validateZoneRacks(eligibleNodes, nodeRacks); len(zones) > 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("no rack was found in zones %v", zones))
+	}
+	if rack, zones := validateRackZones(eligibleNodes, nodeRacks); rack != "" {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("rack %q contains nodes from multiple zones %v", rack, zones))
+	}
+	if zoneRegions := validateZoneRegions(eligibleNodes); len(zoneRegions) > 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("zones were found in multiple regions %v", zoneRegions))
+	}
+	if excluded, values := validateExcludedNodes(sc, report.FailureDomain, getDeviceSetReplica(sc), nodes, nodeRacks); len(excluded) > 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("nodes %s can not schedule storage Pods, leaving only %s failure domains %v", formatExcludedNodes(excluded), report.FailureDomain, values))
+	}
+
+	return json.MarshalIndent(report, "", "  ")
+}
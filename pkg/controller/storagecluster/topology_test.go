@@ -0,0 +1,4347 @@
+package storagecluster
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	conditionsv1 "github.com/openshift/custom-resource-status/conditions/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	rookCephv1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+
+	api "github.com/openshift/ocs-operator/pkg/apis/ocs/v1"
+	"github.com/openshift/ocs-operator/pkg/controller/defaults"
+)
+
+func TestTopologyTable(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	nodeList := &corev1.NodeList{}
+	mockNodeList.DeepCopyInto(nodeList)
+	nodeList.Items[1].Labels[defaults.RackTopologyKey] = "rack1"
+	nodeList.Items = append(nodeList.Items, corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "node0",
+			Labels: map[string]string{
+				hostnameLabel:     "node0",
+				zoneTopologyLabel: "zone1",
+			},
+		},
+	})
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	table, err := reconciler.TopologyTable(context.TODO(), sc)
+	assert.NoError(t, err)
+
+	expected := [][]string{
+		{"node", "zone", "rack", "host", "eligible"},
+		{"node0", "zone1", "", "node0", "false"},
+		{"node1", "zone1", "", "node1", "true"},
+		{"node2", "zone2", "rack1", "node2", "true"},
+		{"node3", "zone3", "", "node3", "true"},
+	}
+	assert.Equal(t, expected, table)
+
+	// the zone and rack are picked the same way whatever the order of the
+	// labels
+	nodeList = mockNodeList.DeepCopy()
+	nodeList.Items = nodeList.Items[:1]
+	nodeList.Items[0].Labels["failure-domain.beta.kubernetes.io/zone"] = "old-zone"
+	nodeList.Items[0].Labels[corev1.LabelZoneFailureDomainStable] = "zone4"
+	nodeList.Items[0].Labels["failure-domain.beta.kubernetes.io/rack"] = "old-rack"
+	nodeList.Items[0].Labels[defaults.RackTopologyKey] = "rack4"
+	reconciler = createFakeStorageClusterReconciler(t, sc, nodeList)
+	for i := 0; i < 20; i++ {
+		table, err = reconciler.TopologyTable(context.TODO(), sc)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"node1", "zone4", "rack4", "node1", "true"}, table[1])
+	}
+
+	// the preferred zone key wins
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{PreferredZoneKey: "acme.io/zone"}
+	nodeList.Items[0].Labels["acme.io/zone"] = "a"
+	reconciler = createFakeStorageClusterReconciler(t, sc, nodeList)
+	table, err = reconciler.TopologyTable(context.TODO(), sc)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node1", "a", "rack4", "node1", "true"}, table[1])
+}
+
+func TestValidateZoneRacks(t *testing.T) {
+	nodeList := &corev1.NodeList{}
+	mockNodeList.DeepCopyInto(nodeList)
+	nodeRacks := api.NewNodeTopologyMap()
+
+	zones := validateZoneRacks(nodeList, nodeRacks)
+	assert.Empty(t, zones)
+
+	nodeRacks.Add("rack0", "node1")
+	nodeRacks.Add("rack1", "node2")
+	zones = validateZoneRacks(nodeList, nodeRacks)
+	assert.Equal(t, []string{"zone3"}, zones)
+
+	nodeRacks.Add("rack1", "node3")
+	zones = validateZoneRacks(nodeList, nodeRacks)
+	assert.Empty(t, zones)
+}
+
+func TestNodeTopologyMapZoneWithoutRack(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.FailureDomain = "zone"
+	nodeList := &corev1.NodeList{}
+	mockNodeList.DeepCopyInto(nodeList)
+	nodeList.Items[0].Labels[defaults.RackTopologyKey] = "rack0"
+	nodeList.Items[1].Labels[defaults.RackTopologyKey] = "rack1"
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+
+	condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionTopologyValid)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, "ZoneWithoutRack", condition.Reason)
+	assert.Contains(t, condition.Message, "zone3")
+}
+
+func TestValidateDeviceSetPlacement(t *testing.T) {
+	sc := &api.StorageCluster{}
+	sc.Spec.StorageDeviceSets = []api.StorageDeviceSet{{Name: "mock-sds"}}
+	sc.Status.NodeTopologies = &api.NodeTopologyMap{
+		Labels: map[string]api.TopologyLabelValues{
+			zoneTopologyLabel: []string{"zone1", "zone2", "zone3"},
+		},
+	}
+
+	err := validateDeviceSetPlacement(sc)
+	assert.NoError(t, err)
+
+	sc.Spec.StorageDeviceSets[0].Replica = 4
+	err = validateDeviceSetPlacement(sc)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "mock-sds")
+	assert.Contains(t, err.Error(), zoneTopologyLabel)
+
+	sc.Spec.StorageDeviceSets[0].Placement.PodAntiAffinity = &corev1.PodAntiAffinity{}
+	err = validateDeviceSetPlacement(sc)
+	assert.NoError(t, err)
+
+	sc.Spec.StorageDeviceSets = []api.StorageDeviceSet{{Name: "mock-sds", TopologyKey: hostnameLabel}}
+	err = validateDeviceSetPlacement(sc)
+	assert.Error(t, err)
+}
+
+func TestCrushLocation(t *testing.T) {
+	node := corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "node1",
+			Labels: map[string]string{
+				hostnameLabel:            "node1",
+				zoneTopologyLabel:        "zone1",
+				defaults.RackTopologyKey: "rack0",
+			},
+		},
+	}
+	assert.Equal(t, "root=default zone=zone1 rack=rack0 host=node1", CrushLocation(node))
+
+	node.Labels = map[string]string{}
+	assert.Equal(t, "root=default", CrushLocation(node))
+
+	// the stable labels win over the deprecated ones while both are set
+	node.Labels = map[string]string{
+		hostnameLabel:                              "node1",
+		"failure-domain.beta.kubernetes.io/zone":   "old-zone",
+		corev1.LabelZoneFailureDomainStable:        "zone1",
+		"failure-domain.beta.kubernetes.io/region": "old-region",
+		corev1.LabelZoneRegionStable:               "region1",
+	}
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, "root=default region=region1 zone=zone1 host=node1", CrushLocation(node))
+	}
+}
+
+func TestNodeTopologyMapAnnotateCrushLocation(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{AnnotateCrushLocation: true}
+	nodeList := &corev1.NodeList{}
+	mockNodeList.DeepCopyInto(nodeList)
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+
+	resourceVersions := map[string]string{}
+	for _, n := range nodeList.Items {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+		assert.NoError(t, err)
+		expected := fmt.Sprintf("root=default zone=%s host=%s", n.Labels[zoneTopologyLabel], n.Name)
+		assert.Equal(t, expected, node.Annotations[crushLocationAnnotation])
+		resourceVersions[node.Name] = node.ResourceVersion
+	}
+
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+
+	for _, n := range nodeList.Items {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+		assert.NoError(t, err)
+		assert.Equal(t, resourceVersions[node.Name], node.ResourceVersion)
+	}
+}
+
+func TestNodeTopologyMapOverlappingStorageClusters(t *testing.T) {
+	sc1 := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc1)
+	sc1.Status.FailureDomain = "rack"
+	sc2 := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc2)
+	sc2.Namespace = "storage-test-ns2"
+	sc2.Status.FailureDomain = "rack"
+	nodeList := &corev1.NodeList{}
+	mockNodeList.DeepCopyInto(nodeList)
+
+	reconciler := createFakeStorageClusterReconciler(t, sc1, sc2, nodeList)
+	recorder := record.NewFakeRecorder(100)
+	reconciler.recorder = recorder
+
+	overlaps, err := reconciler.getOverlappingStorageClusters(context.TODO(), sc1, nodeList)
+	assert.NoError(t, err)
+	assert.Len(t, overlaps, len(nodeList.Items))
+	for _, node := range nodeList.Items {
+		assert.Equal(t, []string{"storage-test-ns2/storage-test"}, overlaps[node.Name])
+	}
+
+	err = reconcileTestNodeTopologyMap(&reconciler, sc1)
+	assert.NoError(t, err)
+	events := []string{}
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	for _, node := range nodeList.Items {
+		assert.Contains(t, events, fmt.Sprintf("Warning NodeSelectedByMultipleStorageClusters Node %s is selected by StorageCluster %s/%s and by StorageClusters [storage-test-ns2/storage-test], its rack label is shared with them", node.Name, sc1.Namespace, sc1.Name))
+	}
+	racks := map[string]string{}
+	for _, n := range nodeList.Items {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+		assert.NoError(t, err)
+		racks[node.Name] = node.Labels[defaults.RackTopologyKey]
+		assert.NotEmpty(t, racks[node.Name])
+	}
+
+	err = reconcileTestNodeTopologyMap(&reconciler, sc2)
+	assert.NoError(t, err)
+	for _, n := range nodeList.Items {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+		assert.NoError(t, err)
+		assert.Equal(t, racks[node.Name], node.Labels[defaults.RackTopologyKey])
+	}
+	assert.Equal(t, sc1.Status.NodeTopologies.Labels[defaults.RackTopologyKey], sc2.Status.NodeTopologies.Labels[defaults.RackTopologyKey])
+}
+
+func TestFailureDomainSpreadFactor(t *testing.T) {
+	cases := []struct {
+		label    string
+		values   []string
+		replica  int
+		expected float64
+	}{
+		{label: zoneTopologyLabel, values: []string{"zone1", "zone2", "zone3"}, replica: 3, expected: 1},
+		{label: zoneTopologyLabel, values: []string{"zone1", "zone2", "zone3", "zone4", "zone5", "zone6"}, replica: 3, expected: 2},
+		{label: defaults.RackTopologyKey, values: []string{"rack0", "rack1", "rack2"}, replica: 4, expected: 0.75},
+		{label: defaults.RackTopologyKey, values: []string{}, replica: 3, expected: 0},
+	}
+
+	for _, c := range cases {
+		sc := &api.StorageCluster{}
+		sc.Spec.StorageDeviceSets = []api.StorageDeviceSet{{Replica: c.replica}}
+		sc.Status.NodeTopologies = &api.NodeTopologyMap{
+			Labels: map[string]api.TopologyLabelValues{
+				c.label: c.values,
+			},
+		}
+		assert.Equal(t, c.expected, getFailureDomainSpreadFactor(sc))
+	}
+}
+
+func TestNodeTopologyMapSpreadFactor(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	nodeList := &corev1.NodeList{}
+	mockNodeList.DeepCopyInto(nodeList)
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.00", sc.Status.FailureDomainSpreadFactor)
+}
+
+func TestPruneTopologyValues(t *testing.T) {
+	sc := &api.StorageCluster{}
+	sc.Status.NodeTopologies = &api.NodeTopologyMap{
+		Labels: map[string]api.TopologyLabelValues{
+			zoneTopologyLabel: []string{"zone1", "zone2", "zone3"},
+		},
+	}
+	stale := []string{zoneTopologyLabel + "=zone3"}
+	gracePeriod := 10 * time.Minute
+	start := metav1.Now()
+	reqLogger := logf.Log.WithName("topology_test")
+
+	// a value which just went missing is kept until the grace period elapses
+	changed := pruneTopologyValues(sc, stale, gracePeriod, start, reqLogger)
+	assert.True(t, changed)
+	assert.Equal(t, api.TopologyLabelValues{"zone1", "zone2", "zone3"}, sc.Status.NodeTopologies.Labels[zoneTopologyLabel])
+	assert.Equal(t, start, sc.Status.TopologyValuesLastSeen[zoneTopologyLabel+"=zone3"])
+
+	changed = pruneTopologyValues(sc, stale, gracePeriod, metav1.NewTime(start.Add(5*time.Minute)), reqLogger)
+	assert.False(t, changed)
+	assert.Len(t, sc.Status.NodeTopologies.Labels[zoneTopologyLabel], 3)
+
+	// a transient absence is forgotten once the value is observed again
+	stale = []string{}
+	changed = pruneTopologyValues(sc, stale, gracePeriod, metav1.NewTime(start.Add(6*time.Minute)), reqLogger)
+	assert.True(t, changed)
+	assert.Len(t, sc.Status.NodeTopologies.Labels[zoneTopologyLabel], 3)
+	assert.Empty(t, sc.Status.TopologyValuesLastSeen)
+
+	// a persistent absence is pruned after the grace period
+	stale = []string{zoneTopologyLabel + "=zone3"}
+	pruneTopologyValues(sc, stale, gracePeriod, start, reqLogger)
+	changed = pruneTopologyValues(sc, stale, gracePeriod, metav1.NewTime(start.Add(gracePeriod)), reqLogger)
+	assert.True(t, changed)
+	assert.Equal(t, api.TopologyLabelValues{"zone1", "zone2"}, sc.Status.NodeTopologies.Labels[zoneTopologyLabel])
+	assert.Empty(t, sc.Status.TopologyValuesLastSeen)
+}
+
+func TestValidatePoolsTopology(t *testing.T) {
+	sc := &api.StorageCluster{}
+	sc.Status.NodeTopologies = &api.NodeTopologyMap{
+		Labels: map[string]api.TopologyLabelValues{
+			zoneTopologyLabel: []string{"zone1", "zone2", "zone3"},
+		},
+	}
+
+	pools := map[string]rookCephv1.PoolSpec{
+		"replicated": rookCephv1.PoolSpec{
+			FailureDomain: "zone",
+			Replicated:    rookCephv1.ReplicatedSpec{Size: 3},
+		},
+	}
+	err := validatePoolsTopology(sc, pools, logt)
+	assert.NoError(t, err)
+
+	pools["replicated"] = rookCephv1.PoolSpec{
+		FailureDomain: "zone",
+		Replicated:    rookCephv1.ReplicatedSpec{Size: 4},
+	}
+	err = validatePoolsTopology(sc, pools, logt)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `replicated pool "replicated" requires 4 distinct zone failure domains`)
+
+	pools = map[string]rookCephv1.PoolSpec{
+		"ec": rookCephv1.PoolSpec{
+			FailureDomain: "zone",
+			ErasureCoded:  rookCephv1.ErasureCodedSpec{DataChunks: 2, CodingChunks: 1},
+		},
+	}
+	err = validatePoolsTopology(sc, pools, logt)
+	assert.NoError(t, err)
+
+	pools["ec"] = rookCephv1.PoolSpec{
+		FailureDomain: "zone",
+		ErasureCoded:  rookCephv1.ErasureCodedSpec{DataChunks: 4, CodingChunks: 2},
+	}
+	err = validatePoolsTopology(sc, pools, logt)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `erasure coded pool "ec" requires 6 distinct zone failure domains`)
+
+	// replica-1 pools are not checked against the failure domain
+	pools = map[string]rookCephv1.PoolSpec{
+		"replica1": rookCephv1.PoolSpec{
+			FailureDomain: "rack",
+			Replicated:    rookCephv1.ReplicatedSpec{Size: 1},
+		},
+	}
+	err = validatePoolsTopology(sc, pools, logt)
+	assert.NoError(t, err)
+
+	pools["replica2"] = rookCephv1.PoolSpec{
+		FailureDomain: "rack",
+		Replicated:    rookCephv1.ReplicatedSpec{Size: 2},
+	}
+	err = validatePoolsTopology(sc, pools, logt)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `replicated pool "replica2" requires 2 distinct rack failure domains`)
+}
+
+func TestFailureDomainAlias(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{FailureDomainAlias: map[string]string{"zone": "room"}}
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	// the failure domain and its values are still read from the zone label
+	assert.Equal(t, "zone", determineFailureDomain(sc))
+	assert.Equal(t, "room", getCrushFailureDomain(sc, "zone"))
+	assert.Equal(t, "rack", getCrushFailureDomain(sc, "rack"))
+	_, values := getTopologyKeyValues(sc.Status.NodeTopologies, "zone", "")
+	assert.Equal(t, []string{"zone1", "zone2", "zone3"}, values)
+
+	sc.Status.FailureDomain = determineFailureDomain(sc)
+	cephBlockPools, err := reconciler.newCephBlockPoolInstances(sc)
+	assert.NoError(t, err)
+	assert.Equal(t, "room", cephBlockPools[0].Spec.FailureDomain)
+
+	pools := map[string]rookCephv1.PoolSpec{
+		"replicated": cephBlockPools[0].Spec,
+	}
+	assert.NoError(t, validatePoolsTopology(sc, pools, logt))
+
+	location := getNodeCrushLocation(sc, mockNodeList.Items[0])
+	assert.Equal(t, strings.Replace(CrushLocation(mockNodeList.Items[0]), "zone=", "room=", 1), location)
+	assert.Contains(t, location, "room=zone1")
+}
+
+func TestValidateFailureDomainAliases(t *testing.T) {
+	sc := &api.StorageCluster{}
+	assert.NoError(t, validateFailureDomainAliases(sc))
+
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{FailureDomainAlias: map[string]string{"zone": "room", "rack": "chassis"}}
+	assert.NoError(t, validateFailureDomainAliases(sc))
+
+	sc.Spec.NodeTopologies.FailureDomainAlias = map[string]string{"region": "room"}
+	assert.EqualError(t, validateFailureDomainAliases(sc), `invalid failure domain alias: unknown failure domain "region"`)
+
+	sc.Spec.NodeTopologies.FailureDomainAlias = map[string]string{"zone": "building"}
+	assert.Error(t, validateFailureDomainAliases(sc))
+	assert.Contains(t, validateFailureDomainAliases(sc).Error(), `"building" of failure domain "zone" is not a Ceph bucket type`)
+
+	sc.Spec.NodeTopologies.FailureDomainAlias = map[string]string{"zone": "room", "datacenter": "room"}
+	assert.EqualError(t, validateFailureDomainAliases(sc), `invalid failure domain alias: failure domains "datacenter" and "zone" are both aliased to "room"`)
+}
+
+func TestValidateStorageClusterPoolsTopology(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.FailureDomain = "zone"
+	sc.Status.NodeTopologies = &api.NodeTopologyMap{
+		Labels: map[string]api.TopologyLabelValues{
+			zoneTopologyLabel: []string{"zone1", "zone2", "zone3"},
+		},
+	}
+
+	reconciler := createFakeStorageClusterReconciler(t, sc)
+	pools, err := reconciler.getCephPoolSpecs(sc)
+	assert.NoError(t, err)
+	assert.Len(t, pools, 5)
+	assert.NoError(t, validatePoolsTopology(sc, pools, logt))
+
+	sc.Status.NodeTopologies.Labels[zoneTopologyLabel] = []string{"zone1", "zone2"}
+	assert.Error(t, validatePoolsTopology(sc, pools, logt))
+}
+
+// forbiddenPatchClient is a client which is not allowed to patch any object
+type forbiddenPatchClient struct {
+	client.Client
+}
+
+func (c *forbiddenPatchClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return errors.NewForbidden(schema.GroupResource{Resource: "nodes"}, "", fmt.Errorf("patch not allowed"))
+}
+
+func TestNodeTopologyMapNodePatchForbidden(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.FailureDomain = "rack"
+	nodeList := &corev1.NodeList{}
+	mockNodeList.DeepCopyInto(nodeList)
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	reconciler.client = &forbiddenPatchClient{Client: reconciler.client}
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.True(t, stderrors.Is(err, ErrRackAssignment))
+	assert.True(t, errors.IsForbidden(stderrors.Unwrap(err)))
+
+	actual := &api.StorageCluster{}
+	err = reconciler.client.Get(nil, mockStorageClusterRequest.NamespacedName, actual)
+	assert.NoError(t, err)
+	condition := conditionsv1.FindStatusCondition(actual.Status.Conditions, api.ConditionReconcileComplete)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, "NodePatchForbidden", condition.Reason)
+	assert.Contains(t, condition.Message, "missing RBAC: nodes patch permission required for rack labeling")
+
+	// the forbidden patch is not the first to fail
+	sc = &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.FailureDomain = "rack"
+	reconciler = createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+	reconciler.nodeClient = &nodePatchRecordingClient{
+		topologyClient: reconciler.client,
+		patches:        map[string][]string{},
+		failures:       map[string]bool{"node1": true},
+		forbidden:      map[string]bool{"node3": true},
+	}
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.True(t, stderrors.Is(err, ErrRackAssignment))
+	assert.False(t, errors.IsForbidden(stderrors.Unwrap(err)))
+
+	actual = &api.StorageCluster{}
+	err = reconciler.client.Get(nil, mockStorageClusterRequest.NamespacedName, actual)
+	assert.NoError(t, err)
+	condition = conditionsv1.FindStatusCondition(actual.Status.Conditions, api.ConditionReconcileComplete)
+	assert.NotNil(t, condition)
+	assert.Equal(t, "NodePatchForbidden", condition.Reason)
+}
+
+func TestNodeTopologyMapExcludeFromStorage(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+	}
+	excluded := nodeList.Items[0].DeepCopy()
+	excluded.Name = "node4"
+	excluded.Labels[hostnameLabel] = "node4"
+	excluded.Annotations = map[string]string{excludeFromStorageAnnotation: "true"}
+	nodeList.Items = append(nodeList.Items, *excluded)
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, reconciler.nodeCount)
+	node := &corev1.Node{}
+	err = reconciler.client.Get(nil, types.NamespacedName{Name: "node4"}, node)
+	assert.NoError(t, err)
+	assert.NotContains(t, node.Labels, defaults.RackTopologyKey)
+
+	// the node is included again once the annotation is removed
+	delete(node.Annotations, excludeFromStorageAnnotation)
+	err = reconciler.client.Update(nil, node)
+	assert.NoError(t, err)
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, reconciler.nodeCount)
+	node = &corev1.Node{}
+	err = reconciler.client.Get(nil, types.NamespacedName{Name: "node4"}, node)
+	assert.NoError(t, err)
+	assert.Contains(t, node.Labels, defaults.RackTopologyKey)
+
+	// excluded nodes do not count towards the minimum number of nodes
+	node.Annotations = map[string]string{excludeFromStorageAnnotation: "true"}
+	err = reconciler.client.Update(nil, node)
+	assert.NoError(t, err)
+	node = &corev1.Node{}
+	err = reconciler.client.Get(nil, types.NamespacedName{Name: "node1"}, node)
+	assert.NoError(t, err)
+	node.Annotations = map[string]string{excludeFromStorageAnnotation: "true"}
+	err = reconciler.client.Update(nil, node)
+	assert.NoError(t, err)
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.True(t, stderrors.Is(err, ErrInsufficientNodes))
+}
+
+// nodeListCountingClient is a client counting the lists of nodes
+type nodeListCountingClient struct {
+	client.Client
+	nodeLists int
+}
+
+func (c *nodeListCountingClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	if _, ok := list.(*corev1.NodeList); ok {
+		c.nodeLists++
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestReconcileListsNodesOnce(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{AnnotateCrushLocation: true}
+	cc := &rookCephv1.CephCluster{}
+	mockCephCluster.DeepCopyInto(cc)
+	cc.Status.State = rookCephv1.ClusterStateCreated
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, mockStorageClusterInit, cc, mockNodeList.DeepCopy())
+	counter := &nodeListCountingClient{Client: reconciler.client}
+	reconciler.client = counter
+	_, err := reconciler.Reconcile(mockStorageClusterRequest)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, counter.nodeLists)
+}
+
+// fakeTopologySpan records the attributes set on it
+type fakeTopologySpan struct {
+	name       string
+	attributes map[string]interface{}
+	ended      bool
+}
+
+func (s *fakeTopologySpan) SetAttributes(attributes map[string]interface{}) {
+	for k, v := range attributes {
+		s.attributes[k] = v
+	}
+}
+
+func (s *fakeTopologySpan) End() {
+	s.ended = true
+}
+
+// fakeTopologyTracer records the spans it starts
+type fakeTopologyTracer struct {
+	spans []*fakeTopologySpan
+}
+
+func (t *fakeTopologyTracer) Start(ctx context.Context, spanName string) (context.Context, topologySpan) {
+	span := &fakeTopologySpan{name: spanName, attributes: map[string]interface{}{}}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func TestTraceFailureDomain(t *testing.T) {
+	sc := &api.StorageCluster{}
+	sc.Status.NodeTopologies = &api.NodeTopologyMap{
+		Labels: map[string]api.TopologyLabelValues{
+			zoneTopologyLabel: []string{"zone1", "zone2", "zone3"},
+		},
+	}
+
+	reconciler := createFakeStorageClusterReconciler(t)
+	assert.Equal(t, "zone", reconciler.traceFailureDomain(context.TODO(), sc))
+
+	tracer := &fakeTopologyTracer{}
+	reconciler.tracer = tracer
+	assert.Equal(t, "zone", reconciler.traceFailureDomain(context.TODO(), sc))
+	assert.Len(t, tracer.spans, 1)
+	span := tracer.spans[0]
+	assert.Equal(t, "determineFailureDomain", span.name)
+	assert.True(t, span.ended)
+	assert.Equal(t, map[string]interface{}{
+		"failureDomain.type": "zone",
+		"zoneCount":          3,
+		"rackCount":          0,
+		"reason":             "3 zones found",
+	}, span.attributes)
+}
+
+func TestNodeTopologyMapRequiredTopologyKeys(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	nodeList.Items[0].Labels[defaults.RackTopologyKey] = "rack0"
+	nodeList.Items[2].Labels[defaults.RackTopologyKey] = "rack2"
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{
+		RequiredTopologyKeys: []string{zoneTopologyLabel, defaults.RackTopologyKey},
+	}
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "node2 (missing "+defaults.RackTopologyKey+")")
+	assert.NotContains(t, err.Error(), "node1")
+	assert.NotContains(t, err.Error(), "node3")
+
+	nodeList.Items[1].Labels[defaults.RackTopologyKey] = "rack1"
+	reconciler = createFakeStorageClusterReconciler(t, sc, nodeList)
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+}
+
+func TestPlanZoneMigration(t *testing.T) {
+	newNodes := func(zones ...string) *corev1.NodeList {
+		nodes := &corev1.NodeList{}
+		for i, zone := range zones {
+			node := corev1.Node{}
+			node.Name = fmt.Sprintf("node%d", i)
+			node.Labels = map[string]string{}
+			if zone != "" {
+				node.Labels[zoneTopologyLabel] = zone
+			}
+			nodes.Items = append(nodes.Items, node)
+		}
+		return nodes
+	}
+	newTopologyMap := func(nodes *corev1.NodeList) *api.NodeTopologyMap {
+		topologyMap := api.NewNodeTopologyMap()
+		for _, node := range nodes.Items {
+			if zone, ok := node.Labels[zoneTopologyLabel]; ok && !topologyMap.Contains(zoneTopologyLabel, zone) {
+				topologyMap.Add(zoneTopologyLabel, zone)
+			}
+		}
+		return topologyMap
+	}
+
+	cases := []struct {
+		label        string
+		zones        []string
+		desiredZones int
+		expected     []NodeLabelSuggestion
+	}{
+		{
+			label:        "Case 1: no nodes",
+			zones:        []string{},
+			desiredZones: 3,
+			expected:     nil,
+		},
+		{
+			label:        "Case 2: unlabeled nodes are spread over new zones",
+			zones:        []string{"", "", ""},
+			desiredZones: 3,
+			expected: []NodeLabelSuggestion{
+				{Node: "node0", Label: corev1.LabelZoneFailureDomain, Value: "zone0"},
+				{Node: "node1", Label: corev1.LabelZoneFailureDomain, Value: "zone1"},
+				{Node: "node2", Label: corev1.LabelZoneFailureDomain, Value: "zone2"},
+			},
+		},
+		{
+			label:        "Case 3: already spread nodes are left alone",
+			zones:        []string{"zone1", "zone2", "zone3", "zone1"},
+			desiredZones: 3,
+			expected:     []NodeLabelSuggestion{},
+		},
+		{
+			label:        "Case 4: a single zone is split",
+			zones:        []string{"zone1", "zone1", "zone1", "zone1", "zone1", "zone1"},
+			desiredZones: 3,
+			expected: []NodeLabelSuggestion{
+				{Node: "node2", Label: zoneTopologyLabel, Value: "zone2"},
+				{Node: "node3", Label: zoneTopologyLabel, Value: "zone0"},
+				{Node: "node4", Label: zoneTopologyLabel, Value: "zone2"},
+				{Node: "node5", Label: zoneTopologyLabel, Value: "zone0"},
+			},
+		},
+		{
+			label:        "Case 5: extra zones are merged into the kept ones",
+			zones:        []string{"a", "a", "b", "b", "c", "d"},
+			desiredZones: 3,
+			expected: []NodeLabelSuggestion{
+				{Node: "node5", Label: zoneTopologyLabel, Value: "c"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf(c.label)
+		nodes := newNodes(c.zones...)
+		actual := PlanZoneMigration(newTopologyMap(nodes), nodes, c.desiredZones)
+		assert.Equal(t, c.expected, actual)
+	}
+}
+
+func TestFailureDomainCaseVariantZones(t *testing.T) {
+	sc := &api.StorageCluster{}
+	sc.Status.NodeTopologies = &api.NodeTopologyMap{
+		Labels: map[string]api.TopologyLabelValues{
+			zoneTopologyLabel: []string{"zone-a", "Zone-A", "zone-b"},
+		},
+	}
+
+	assert.Equal(t, 2, countDistinctValues(sc.Status.NodeTopologies.Labels[zoneTopologyLabel]))
+	assert.Equal(t, map[string][]string{"zone-a": {"zone-a", "Zone-A"}}, caseVariantValues(sc.Status.NodeTopologies.Labels[zoneTopologyLabel]))
+	assert.Equal(t, "rack", determineFailureDomain(sc))
+
+	sc.Status.NodeTopologies.Labels[zoneTopologyLabel] = append(sc.Status.NodeTopologies.Labels[zoneTopologyLabel], "zone-c")
+	assert.Equal(t, "zone", determineFailureDomain(sc))
+	// The original values are kept for CRUSH
+	assert.Equal(t, api.TopologyLabelValues{"zone-a", "Zone-A", "zone-b", "zone-c"}, sc.Status.NodeTopologies.Labels[zoneTopologyLabel])
+}
+
+func TestVerifyTopologyMapCompleteness(t *testing.T) {
+	topologyMap := &api.NodeTopologyMap{
+		Labels: map[string]api.TopologyLabelValues{
+			zoneTopologyLabel: []string{"zone1", "zone2", "zone3"},
+		},
+	}
+
+	missing, extra := VerifyTopologyMapCompleteness(topologyMap, mockNodeList, validTopologyLabelKeys)
+	assert.Empty(t, missing)
+	assert.Empty(t, extra)
+
+	// a node with a value absent from the map is missing
+	nodes := mockNodeList.DeepCopy()
+	nodes.Items[1].Labels[defaults.RackTopologyKey] = "rack1"
+	missing, extra = VerifyTopologyMapCompleteness(topologyMap, nodes, validTopologyLabelKeys)
+	assert.Equal(t, []string{"node2"}, missing)
+	assert.Empty(t, extra)
+
+	// a value no longer carried by any node is extra
+	nodes = mockNodeList.DeepCopy()
+	nodes.Items = nodes.Items[:2]
+	missing, extra = VerifyTopologyMapCompleteness(topologyMap, nodes, validTopologyLabelKeys)
+	assert.Empty(t, missing)
+	assert.Equal(t, []string{zoneTopologyLabel + "=zone3"}, extra)
+}
+
+func TestNodeTopologyMapTopologyMode(t *testing.T) {
+	cases := []struct {
+		mode             api.TopologyMode
+		expectedErr      bool
+		expectedRacks    bool
+		expectedLocation string
+	}{
+		{mode: "", expectedErr: false, expectedRacks: true, expectedLocation: "root=default rack=rack0 host=node1"},
+		{mode: api.TopologyModeAuto, expectedErr: false, expectedRacks: true, expectedLocation: "root=default rack=rack0 host=node1"},
+		{mode: api.TopologyModeHybrid, expectedErr: false, expectedRacks: true, expectedLocation: "custom"},
+		{mode: api.TopologyModeManual, expectedErr: true, expectedRacks: false, expectedLocation: "custom"},
+	}
+
+	for _, c := range cases {
+		t.Logf("Mode: %q", c.mode)
+		nodeList := mockNodeList.DeepCopy()
+		for i := range nodeList.Items {
+			delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+		}
+		nodeList.Items[0].Labels[defaults.RackTopologyKey] = "rack0"
+		nodeList.Items[0].Annotations = map[string]string{crushLocationAnnotation: "custom"}
+
+		sc := &api.StorageCluster{}
+		mockStorageCluster.DeepCopyInto(sc)
+		sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+		sc.Spec.NodeTopologies = &api.NodeTopologySpec{
+			AnnotateCrushLocation: true,
+			Mode:                  c.mode,
+		}
+
+		reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+		err := reconcileTestNodeTopologyMap(&reconciler, sc)
+		if c.expectedErr {
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "[node2 node3]")
+		} else {
+			assert.NoError(t, err)
+		}
+
+		for _, n := range nodeList.Items {
+			node := &corev1.Node{}
+			err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+			assert.NoError(t, err)
+			_, hasRack := node.Labels[defaults.RackTopologyKey]
+			assert.Equal(t, c.expectedRacks || node.Name == "node1", hasRack)
+			if node.Name == "node1" {
+				assert.Equal(t, c.expectedLocation, node.Annotations[crushLocationAnnotation])
+			}
+		}
+	}
+}
+
+func TestDetectTopologyRebalance(t *testing.T) {
+	newTopologyMap := func(zones, racks []string) *api.NodeTopologyMap {
+		topologyMap := api.NewNodeTopologyMap()
+		for _, zone := range zones {
+			topologyMap.Add(zoneTopologyLabel, zone)
+		}
+		for _, rack := range racks {
+			topologyMap.Add(defaults.RackTopologyKey, rack)
+		}
+		return topologyMap
+	}
+
+	cases := []struct {
+		label           string
+		committedDomain string
+		committed       *api.NodeTopologyMap
+		current         *api.NodeTopologyMap
+		rebalance       bool
+	}{
+		{
+			label:           "Case 1: nothing committed yet",
+			committedDomain: "zone",
+			committed:       api.NewNodeTopologyMap(),
+			current:         newTopologyMap([]string{"zone1", "zone2", "zone3"}, nil),
+			rebalance:       false,
+		},
+		{
+			label:           "Case 2: unchanged topology",
+			committedDomain: "zone",
+			committed:       newTopologyMap([]string{"zone1", "zone2", "zone3"}, nil),
+			current:         newTopologyMap([]string{"zone1", "zone2", "zone3"}, nil),
+			rebalance:       false,
+		},
+		{
+			label:           "Case 3: racks added within zones",
+			committedDomain: "zone",
+			committed:       newTopologyMap([]string{"zone1", "zone2", "zone3"}, nil),
+			current:         newTopologyMap([]string{"zone1", "zone2", "zone3"}, []string{"rack0"}),
+			rebalance:       false,
+		},
+		{
+			label:           "Case 4: new zone",
+			committedDomain: "zone",
+			committed:       newTopologyMap([]string{"zone1", "zone2", "zone3"}, nil),
+			current:         newTopologyMap([]string{"zone1", "zone2", "zone3", "zone4"}, nil),
+			rebalance:       true,
+		},
+		{
+			label:           "Case 5: rack removed",
+			committedDomain: "rack",
+			committed:       newTopologyMap(nil, []string{"rack0", "rack1", "rack2", "rack3"}),
+			current:         newTopologyMap(nil, []string{"rack0", "rack1", "rack2"}),
+			rebalance:       true,
+		},
+		{
+			label:           "Case 6: failure domain type changes",
+			committedDomain: "rack",
+			committed:       newTopologyMap([]string{"zone1"}, []string{"rack0", "rack1", "rack2"}),
+			current:         newTopologyMap([]string{"zone1", "zone2", "zone3"}, []string{"rack0", "rack1", "rack2"}),
+			rebalance:       true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf(c.label)
+		message := detectTopologyRebalance(c.committedDomain, c.committed, c.current, defaultFailureDomainWeights, "", false)
+		assert.Equal(t, c.rebalance, message != "", message)
+	}
+}
+
+func TestNodeTopologyMapTopologyRebalancing(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	nodeList := mockNodeList.DeepCopy()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Nil(t, conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionTopologyRebalancing))
+
+	node := nodeList.Items[0].DeepCopy()
+	node.Name = "node4"
+	node.Labels[hostnameLabel] = "node4"
+	node.Labels[zoneTopologyLabel] = "zone4"
+	err = reconciler.client.Create(nil, node)
+	assert.NoError(t, err)
+
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.True(t, conditionsv1.IsStatusConditionTrue(sc.Status.Conditions, api.ConditionTopologyRebalancing))
+
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.True(t, conditionsv1.IsStatusConditionFalse(sc.Status.Conditions, api.ConditionTopologyRebalancing))
+}
+
+func TestGetTopologyPhase(t *testing.T) {
+	threeZones := api.TopologyLabelValues{"zone1", "zone2", "zone3"}
+	unbalanced := mockNodeList.DeepCopy()
+	for _, name := range []string{"node4", "node5"} {
+		node := unbalanced.Items[0].DeepCopy()
+		node.Name = name
+		unbalanced.Items = append(unbalanced.Items, *node)
+	}
+
+	cases := []struct {
+		label         string
+		nodes         *corev1.NodeList
+		zones         api.TopologyLabelValues
+		topologyValid corev1.ConditionStatus
+		topologyErr   error
+		expected      api.TopologyPhase
+	}{
+		{
+			label:    "Case 1: evenly spread nodes",
+			nodes:    mockNodeList,
+			zones:    threeZones,
+			expected: api.TopologyPhaseHealthy,
+		},
+		{
+			label:    "Case 2: not enough nodes",
+			nodes:    &corev1.NodeList{Items: mockNodeList.Items[:2]},
+			zones:    threeZones,
+			expected: api.TopologyPhaseInsufficient,
+		},
+		{
+			label:    "Case 3: not enough failure domain values",
+			nodes:    mockNodeList,
+			zones:    api.TopologyLabelValues{"zone1", "zone2"},
+			expected: api.TopologyPhaseInsufficient,
+		},
+		{
+			label:       "Case 4: topology error",
+			nodes:       mockNodeList,
+			zones:       threeZones,
+			topologyErr: fmt.Errorf("nodes do not carry the required topology keys"),
+			expected:    api.TopologyPhaseMisconfigured,
+		},
+		{
+			label:         "Case 5: invalid topology",
+			nodes:         mockNodeList,
+			zones:         threeZones,
+			topologyValid: corev1.ConditionFalse,
+			expected:      api.TopologyPhaseMisconfigured,
+		},
+		{
+			label:    "Case 6: unevenly spread nodes",
+			nodes:    unbalanced,
+			zones:    threeZones,
+			expected: api.TopologyPhaseDegraded,
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf(c.label)
+		sc := &api.StorageCluster{}
+		sc.Status.FailureDomain = "zone"
+		sc.Status.NodeTopologies = &api.NodeTopologyMap{
+			Labels: map[string]api.TopologyLabelValues{
+				zoneTopologyLabel: c.zones,
+			},
+		}
+		if c.topologyValid != "" {
+			conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+				Type:    api.ConditionTopologyValid,
+				Status:  c.topologyValid,
+				Reason:  "ZoneWithoutRack",
+				Message: "no rack was found in zones [zone1]",
+			})
+		}
+
+		phase, summary := getTopologyPhase(sc, c.nodes, c.topologyErr)
+		assert.Equal(t, c.expected, phase)
+		assert.NotEmpty(t, summary)
+	}
+}
+
+func TestReconcileTopologyPhase(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	err = reconcileTestTopologyPhase(&reconciler, sc, nil)
+	assert.NoError(t, err)
+
+	actual := &api.StorageCluster{}
+	err = reconciler.client.Get(nil, types.NamespacedName{Name: sc.Name, Namespace: sc.Namespace}, actual)
+	assert.NoError(t, err)
+	assert.Equal(t, api.TopologyPhaseHealthy, actual.Status.TopologyPhase)
+	assert.Equal(t, "3 storage nodes spread over 3 values of the zone failure domain", actual.Status.TopologySummary)
+}
+
+func TestNodeTopologyMapBootstrap(t *testing.T) {
+	reqLogger := logf.Log.WithName("topology_test")
+	now := time.Now()
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	assert.False(t, isBootstrapping(sc, now, reqLogger))
+	sc.Annotations = map[string]string{bootstrapUntilAnnotation: "tomorrow"}
+	assert.False(t, isBootstrapping(sc, now, reqLogger))
+	sc.Annotations[bootstrapUntilAnnotation] = now.Add(-time.Hour).Format(time.RFC3339)
+	assert.False(t, isBootstrapping(sc, now, reqLogger))
+	sc.Annotations[bootstrapUntilAnnotation] = now.Add(time.Hour).Format(time.RFC3339)
+	assert.True(t, isBootstrapping(sc, now, reqLogger))
+
+	// fewer nodes than required are accepted while bootstrapping
+	nodeList := mockNodeList.DeepCopy()
+	nodeList.Items = nodeList.Items[:2]
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Contains(t, sc.Annotations, bootstrapUntilAnnotation)
+
+	// but not once the bootstrap window has passed
+	expired := sc.DeepCopy()
+	expired.Annotations[bootstrapUntilAnnotation] = now.Add(-time.Hour).Format(time.RFC3339)
+	err = reconcileTestNodeTopologyMap(&reconciler, expired)
+	assert.Error(t, err)
+
+	// the bootstrap annotation is removed once enough nodes have joined
+	node := mockNodeList.Items[2].DeepCopy()
+	err = reconciler.client.Create(nil, node)
+	assert.NoError(t, err)
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	actual := &api.StorageCluster{}
+	err = reconciler.client.Get(nil, types.NamespacedName{Name: sc.Name, Namespace: sc.Namespace}, actual)
+	assert.NoError(t, err)
+	assert.NotContains(t, actual.Annotations, bootstrapUntilAnnotation)
+}
+
+func TestValidateTopologyKeys(t *testing.T) {
+	sc := &api.StorageCluster{}
+	sc.Spec.StorageDeviceSets = []api.StorageDeviceSet{
+		{Name: "mock-sds", TopologyKey: "rack"},
+	}
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{
+		RequiredTopologyKeys: []string{zoneTopologyLabel, defaults.RackTopologyKey},
+	}
+	assert.NoError(t, validateTopologyKeys(sc))
+
+	sc.Spec.NodeTopologies.RequiredTopologyKeys = append(sc.Spec.NodeTopologies.RequiredTopologyKeys, "topology.rook.io/rack/")
+	err := validateTopologyKeys(sc)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid required topology key "topology.rook.io/rack/"`)
+
+	sc.Spec.NodeTopologies.RequiredTopologyKeys = nil
+	sc.Spec.StorageDeviceSets[0].TopologyKey = "-rack"
+	err = validateTopologyKeys(sc)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `failed to validate StorageDeviceSet "mock-sds": invalid topology key "-rack"`)
+
+	cases := []struct {
+		label          string
+		nodeTopologies api.NodeTopologySpec
+		expected       string
+	}{
+		{label: "valid preferred zone key", nodeTopologies: api.NodeTopologySpec{PreferredZoneKey: "acme.io/zone"}},
+		{label: "invalid preferred zone key", nodeTopologies: api.NodeTopologySpec{PreferredZoneKey: "acme.io/zone/"}, expected: `invalid preferred zone key "acme.io/zone/"`},
+		{label: "valid additional label keys", nodeTopologies: api.NodeTopologySpec{AdditionalLabelKeys: []string{"acme.io", "acme.io/powerzone"}}},
+		{label: "invalid additional label key", nodeTopologies: api.NodeTopologySpec{AdditionalLabelKeys: []string{"acme.io", "acme io/zone"}}, expected: `invalid additional label key "acme io/zone"`},
+		{label: "valid rack capacity label", nodeTopologies: api.NodeTopologySpec{RackCapacityKey: "ocs.openshift.io/storage-capacity"}},
+		{label: "valid rack capacity resource", nodeTopologies: api.NodeTopologySpec{RackCapacityKey: "ephemeral-storage"}},
+		{label: "invalid rack capacity key", nodeTopologies: api.NodeTopologySpec{RackCapacityKey: "storage capacity"}, expected: `invalid rack capacity key "storage capacity"`},
+	}
+	sc.Spec.StorageDeviceSets = nil
+	for _, c := range cases {
+		sc.Spec.NodeTopologies = c.nodeTopologies.DeepCopy()
+		err = validateTopologyKeys(sc)
+		if c.expected == "" {
+			assert.NoError(t, err, c.label)
+		} else {
+			assert.Error(t, err, c.label)
+			assert.Contains(t, err.Error(), c.expected, c.label)
+		}
+	}
+}
+
+func TestNodeTopologyMapSingleFailureDomain(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		nodeList.Items[i].Labels[zoneTopologyLabel] = "zone1"
+		nodeList.Items[i].Labels[defaults.RackTopologyKey] = "rack0"
+	}
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.True(t, conditionsv1.IsStatusConditionTrue(sc.Status.Conditions, api.ConditionSingleFailureDomain))
+
+	sc = &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler = createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Nil(t, conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionSingleFailureDomain))
+}
+
+func TestAnalyzeTopologySnapshot(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+
+	// three zones
+	snapshot := TopologySnapshot{NodeLabels: map[string]map[string]string{
+		"node1": {zoneTopologyLabel: "zone1"},
+		"node2": {zoneTopologyLabel: "zone2"},
+		"node3": {zoneTopologyLabel: "zone3"},
+	}}
+	decision, err := AnalyzeTopologySnapshot(snapshot, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, "zone", decision.FailureDomain)
+	assert.Empty(t, decision.NodeRacks)
+	assert.ElementsMatch(t, []string{"zone1", "zone2", "zone3"}, decision.TopologyMap.Labels[zoneTopologyLabel])
+
+	// a single zone falls back to generated racks
+	snapshot = TopologySnapshot{NodeLabels: map[string]map[string]string{
+		"node1": {zoneTopologyLabel: "zone1"},
+		"node2": {zoneTopologyLabel: "zone1"},
+		"node3": {zoneTopologyLabel: "zone1"},
+	}}
+	decision, err = AnalyzeTopologySnapshot(snapshot, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, "rack", decision.FailureDomain)
+	assert.Equal(t, map[string]string{"node1": "rack0", "node2": "rack1", "node3": "rack2"}, decision.NodeRacks)
+	assert.ElementsMatch(t, []string{"rack0", "rack1", "rack2"}, decision.TopologyMap.Labels[defaults.RackTopologyKey])
+
+	// existing racks are kept
+	snapshot.NodeLabels["node1"][defaults.RackTopologyKey] = "rack-a"
+	decision, err = AnalyzeTopologySnapshot(snapshot, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, "rack", decision.FailureDomain)
+	assert.NotContains(t, decision.NodeRacks, "node1")
+	assert.Len(t, decision.NodeRacks, 2)
+
+	// too few nodes
+	delete(snapshot.NodeLabels, "node3")
+	_, err = AnalyzeTopologySnapshot(snapshot, sc)
+	assert.Error(t, err)
+
+	// the live StorageCluster is left untouched
+	assert.Equal(t, mockStorageCluster.Status, sc.Status)
+}
+
+func TestGetTopologyKeyValuesPreferredZoneKey(t *testing.T) {
+	topologyMap := api.NewNodeTopologyMap()
+	topologyMap.Labels["acme.io/zone"] = api.TopologyLabelValues{"c", "a", "b"}
+	topologyMap.Labels[corev1.LabelZoneFailureDomain] = api.TopologyLabelValues{"zone1", "zone2"}
+
+	// the deprecated well-known label is preferred over a vendor one
+	label, values := getTopologyKeyValues(topologyMap, "zone", "")
+	assert.Equal(t, corev1.LabelZoneFailureDomain, label)
+	assert.Equal(t, []string{"zone1", "zone2"}, values)
+
+	// and the current one over the deprecated one, whatever the map order
+	topologyMap.Labels[corev1.LabelZoneFailureDomainStable] = api.TopologyLabelValues{"zone1", "zone2"}
+	for i := 0; i < 10; i++ {
+		label, _ = getTopologyKeyValues(topologyMap, "zone", "")
+		assert.Equal(t, corev1.LabelZoneFailureDomainStable, label)
+	}
+
+	label, values = getTopologyKeyValues(topologyMap, "zone", "acme.io/zone")
+	assert.Equal(t, "acme.io/zone", label)
+	assert.Equal(t, []string{"a", "b", "c"}, values)
+
+	// a preferred zone key missing from the nodes is ignored
+	label, _ = getTopologyKeyValues(topologyMap, "zone", "example.com/zone")
+	assert.Equal(t, corev1.LabelZoneFailureDomainStable, label)
+
+	// the preferred zone key only applies to the zones
+	label, _ = getTopologyKeyValues(topologyMap, "region", "acme.io/zone")
+	assert.Equal(t, "region", label)
+}
+
+func TestDetermineFailureDomainPreferredZoneKey(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.FailureDomain = ""
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	sc.Status.NodeTopologies.Labels["acme.io/zone"] = api.TopologyLabelValues{"a", "b", "c"}
+	sc.Status.NodeTopologies.Labels[corev1.LabelZoneFailureDomainStable] = api.TopologyLabelValues{"zone1", "zone1", "zone2"}
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "rack", determineFailureDomain(sc))
+	}
+
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{PreferredZoneKey: "acme.io/zone"}
+	assert.Equal(t, "zone", determineFailureDomain(sc))
+	_, zones := getTopologyKeyValues(sc.Status.NodeTopologies, "zone", getPreferredZoneKey(sc))
+	assert.Equal(t, []string{"a", "b", "c"}, zones)
+}
+
+func TestGetPlacementDecision(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+
+	decision := getPlacementDecision(sc, mockNodeList, "zone", 0)
+	assert.Equal(t, []interface{}{
+		"FailureDomain", "zone",
+		"TopologyKey", zoneTopologyLabel,
+		"Values", []string{"zone1", "zone2", "zone3"},
+		"Reason", "3 zones found",
+		"Nodes", 3,
+		"MinNodes", 3,
+		"RacksCreated", 0,
+	}, decision)
+
+	decision = getPlacementDecision(sc, mockNodeList, "host", 2)
+	assert.Equal(t, corev1.LabelHostname, decision[3])
+	assert.Equal(t, []string{"node1", "node2", "node3"}, decision[5])
+	assert.Equal(t, 2, decision[13])
+}
+
+func TestNodeTopologyMapZoneFallback(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	nodeList.Items[2].Labels[zoneTopologyLabel] = "zone1"
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionFailureDomainFallback)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionTrue, condition.Status)
+	assert.Equal(t, "zone labels present but only 2 zones found; 3 required — using rack failure domain", condition.Message)
+
+	sc = &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler = createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Nil(t, conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionFailureDomainFallback))
+}
+
+func TestNodeTopologyMapSingleZoneFallback(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		nodeList.Items[i].Labels[zoneTopologyLabel] = "zone1"
+	}
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	recorder := record.NewFakeRecorder(10)
+	reconciler.recorder = recorder
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, "rack", determineFailureDomain(sc))
+	condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionFailureDomainFallback)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionTrue, condition.Status)
+	assert.Equal(t, "SingleZone", condition.Reason)
+	message := "all storage nodes are in zone zone1, zone-level resilience is not possible — using rack failure domain"
+	assert.Equal(t, message, condition.Message)
+
+	events := []string{}
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	assert.Contains(t, events, "Warning SingleZone "+message)
+
+	// the event is only recorded when falling back
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	for len(recorder.Events) > 0 {
+		assert.NotContains(t, <-recorder.Events, "SingleZone")
+	}
+}
+
+func TestGetTopologyStabilityDelay(t *testing.T) {
+	sc := &api.StorageCluster{}
+	assert.Equal(t, time.Duration(0), getTopologyStabilityDelay(sc, time.Hour))
+	changed := metav1.NewTime(time.Now().Add(-10 * time.Minute))
+	sc.Status.TopologyLastChangeTime = &changed
+	delay := getTopologyStabilityDelay(sc, time.Hour)
+	assert.True(t, delay > 49*time.Minute && delay <= 50*time.Minute)
+	assert.Equal(t, time.Duration(0), getTopologyStabilityDelay(sc, 5*time.Minute))
+}
+
+func TestIsTopologyStable(t *testing.T) {
+	sc := &api.StorageCluster{}
+	assert.True(t, IsTopologyStable(sc, time.Hour))
+
+	changed := metav1.NewTime(time.Now().Add(-10 * time.Minute))
+	sc.Status.TopologyLastChangeTime = &changed
+	assert.False(t, IsTopologyStable(sc, time.Hour))
+	assert.True(t, IsTopologyStable(sc, 5*time.Minute))
+}
+
+func TestNodeTopologyMapTopologyHash(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, sc.Status.TopologyHash)
+	assert.NotNil(t, sc.Status.TopologyLastChangeTime)
+
+	hash, changed := sc.Status.TopologyHash, sc.Status.TopologyLastChangeTime
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, sc.Status.TopologyHash)
+	assert.Equal(t, changed, sc.Status.TopologyLastChangeTime)
+}
+
+func TestEnsureCephClusterExpansionStability(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	ds := mockDeviceSets[0].DeepCopy()
+	ds.DataPVCTemplate.Spec.StorageClassName = &storageClassName
+	sc.Spec.StorageDeviceSets = []api.StorageDeviceSet{*ds}
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{
+		ExpansionStabilityWindow: &metav1.Duration{Duration: time.Hour},
+	}
+	changed := metav1.NewTime(time.Now().Add(-10 * time.Minute))
+	sc.Status.TopologyLastChangeTime = &changed
+
+	storageClassEBS := &storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "gp2",
+		},
+		Provisioner: string(EBS),
+	}
+	expected := newCephCluster(sc, "", 0, log)
+	cc := expected.DeepCopy()
+	cc.Spec.Storage.StorageClassDeviceSets[0].Count = 0
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, cc, storageClassEBS)
+	err := reconciler.ensureCephCluster(sc, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.True(t, reconciler.requeueAfter > 45*time.Minute && reconciler.requeueAfter <= 50*time.Minute)
+	assert.Len(t, reconciler.conditions, 1)
+	assert.Equal(t, conditionsv1.ConditionProgressing, reconciler.conditions[0].Type)
+	assert.Equal(t, corev1.ConditionTrue, reconciler.conditions[0].Status)
+	assert.Equal(t, "WaitingForTopologyStability", reconciler.conditions[0].Reason)
+	assert.Equal(t, "", reconciler.phase)
+	actual := &rookCephv1.CephCluster{}
+	err = reconciler.client.Get(nil, mockCephClusterNamespacedName, actual)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, actual.Spec.Storage.StorageClassDeviceSets[0].Count)
+
+	changed = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	err = reconciler.ensureCephCluster(sc, reconciler.reqLogger)
+	assert.NoError(t, err)
+	err = reconciler.client.Get(nil, mockCephClusterNamespacedName, actual)
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Spec.Storage.StorageClassDeviceSets[0].Count, actual.Spec.Storage.StorageClassDeviceSets[0].Count)
+}
+
+func TestParseProviderIDTopology(t *testing.T) {
+	cases := []struct {
+		platform   CloudPlatformType
+		providerID string
+		region     string
+		zone       string
+		ok         bool
+	}{
+		{PlatformAWS, "aws:///us-east-1a/i-0123456789abcdef0", "us-east-1", "us-east-1a", true},
+		{PlatformAWS, "aws:///eu-central-1b/i-0123456789abcdef0", "eu-central-1", "eu-central-1b", true},
+		{PlatformAWS, "aws:///i-0123456789abcdef0", "", "", false},
+		{PlatformAWS, "aws:///not-a-zone/i-0123456789abcdef0", "", "", false},
+		{PlatformGCP, "gce://my-project/us-central1-a/my-instance", "us-central1", "us-central1-a", true},
+		{PlatformGCP, "gce://my-project/my-instance", "", "", false},
+		{PlatformAzure, "azure:///subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm", "", "", false},
+		{PlatformUnknown, "aws:///us-east-1a/i-0123456789abcdef0", "", "", false},
+		{PlatformAWS, "gce://my-project/us-central1-a/my-instance", "", "", false},
+	}
+
+	for _, c := range cases {
+		region, zone, ok := parseProviderIDTopology(c.platform, c.providerID)
+		assert.Equal(t, c.ok, ok, c.providerID)
+		assert.Equal(t, c.region, region, c.providerID)
+		assert.Equal(t, c.zone, zone, c.providerID)
+	}
+}
+
+func TestNodeTopologyMapDiscoverFromProviderID(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+		nodeList.Items[i].Spec.ProviderID = fmt.Sprintf("aws:///us-east-1%c/i-%d", 'a'+i, i)
+	}
+	nodeList.Items[2].Labels[zoneTopologyLabel] = "custom-zone"
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	// no discovery unless enabled, node3 alone carrying a zone label
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{AllowPartialZoneLabels: true}
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList.DeepCopy())
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.NotContains(t, sc.Status.NodeTopologies.Labels, corev1.LabelZoneFailureDomainStable)
+
+	sc = &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{DiscoverFromProviderID: true}
+
+	reconciler = createFakeStorageClusterReconciler(t, sc, nodeList.DeepCopy())
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"us-east-1a", "us-east-1b"}, sc.Status.NodeTopologies.Labels[corev1.LabelZoneFailureDomainStable])
+	assert.ElementsMatch(t, []string{"us-east-1"}, sc.Status.NodeTopologies.Labels[corev1.LabelZoneRegionStable])
+
+	for _, n := range nodeList.Items {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+		assert.NoError(t, err)
+		assert.Equal(t, "us-east-1", node.Labels[corev1.LabelZoneRegionStable])
+		// the deprecated labels are not used
+		assert.NotContains(t, node.Labels, corev1.LabelZoneRegion)
+		assert.NotContains(t, node.Labels, corev1.LabelZoneFailureDomain)
+		if node.Name == "node3" {
+			// existing zone labels are kept
+			assert.Equal(t, "custom-zone", node.Labels[zoneTopologyLabel])
+			assert.NotContains(t, node.Labels, corev1.LabelZoneFailureDomainStable)
+		}
+	}
+}
+
+func TestNodeTopologyMapPartialZoneLabels(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	delete(nodeList.Items[0].Labels, zoneTopologyLabel)
+	delete(nodeList.Items[2].Labels, zoneTopologyLabel)
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "[node1 node3]")
+	condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionTopologyValid)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, "PartialZoneLabels", condition.Reason)
+
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{AllowPartialZoneLabels: true}
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.True(t, conditionsv1.IsStatusConditionTrue(sc.Status.Conditions, api.ConditionTopologyValid))
+}
+
+func TestGetNodesWithoutZone(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	assert.Nil(t, getNodesWithoutZone(nodeList))
+	delete(nodeList.Items[1].Labels, zoneTopologyLabel)
+	assert.Equal(t, []string{"node2"}, getNodesWithoutZone(nodeList))
+	delete(nodeList.Items[0].Labels, zoneTopologyLabel)
+	delete(nodeList.Items[2].Labels, zoneTopologyLabel)
+	assert.Nil(t, getNodesWithoutZone(nodeList))
+}
+
+func TestEnsureNodeRacksAssignments(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+	}
+	nodeList.Items[0].Labels[defaults.RackTopologyKey] = "rack0"
+
+	original := nodeList.DeepCopy()
+	reconciler := createFakeStorageClusterReconciler(t, nodeList.DeepCopy())
+	nodeRacks := api.NewNodeTopologyMap()
+	nodeRacks.Add("rack0", "node1")
+	topologyMap := api.NewNodeTopologyMap()
+	topologyMap.Add(defaults.RackTopologyKey, "rack0")
+
+	assignments, err := reconciler.ensureNodeRacks(context.TODO(), nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, nodeRacks, topologyMap, defaultNodePatchConcurrency, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.Len(t, assignments, 2)
+
+	patched := map[string]string{}
+	for _, n := range original.Items {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+		assert.NoError(t, err)
+		if n.Labels[defaults.RackTopologyKey] == "" {
+			patched[node.Name] = node.Labels[defaults.RackTopologyKey]
+		}
+	}
+	for _, assignment := range assignments {
+		assert.Equal(t, patched[assignment.Node], assignment.Rack)
+	}
+	assert.Len(t, patched, len(assignments))
+
+	// nothing is patched once every node has a rack
+	assignments, err = reconciler.ensureNodeRacks(context.TODO(), nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, nodeRacks, topologyMap, defaultNodePatchConcurrency, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.Empty(t, assignments)
+}
+
+func TestEnsureNodeRacksPreferredRack(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	nodeList.Items[1].Labels[zoneTopologyLabel] = "zone1"
+	nodeList.Items[0].Labels[defaults.RackTopologyKey] = "rack0"
+	nodeList.Items[2].Annotations = map[string]string{preferredRackAnnotation: "rack2"}
+
+	reconciler := createFakeStorageClusterReconciler(t, nodeList.DeepCopy())
+	nodeRacks := api.NewNodeTopologyMap()
+	nodeRacks.Add("rack0", "node1")
+	topologyMap := api.NewNodeTopologyMap()
+	topologyMap.Add(defaults.RackTopologyKey, "rack0")
+
+	assignments, err := reconciler.ensureNodeRacks(context.TODO(), nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, nodeRacks, topologyMap, defaultNodePatchConcurrency, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.Contains(t, assignments, nodeRackAssignment{Node: "node3", Rack: "rack2"})
+	assert.True(t, topologyMap.Contains(defaults.RackTopologyKey, "rack2"))
+	node := &corev1.Node{}
+	err = reconciler.client.Get(nil, types.NamespacedName{Name: "node3"}, node)
+	assert.NoError(t, err)
+	assert.Equal(t, "rack2", node.Labels[defaults.RackTopologyKey])
+
+	// a preferred rack holding nodes of another zone is rejected
+	nodeList = mockNodeList.DeepCopy()
+	nodeList.Items[0].Labels[defaults.RackTopologyKey] = "rack0"
+	nodeList.Items[1].Annotations = map[string]string{preferredRackAnnotation: "rack0"}
+
+	reconciler = createFakeStorageClusterReconciler(t, nodeList.DeepCopy())
+	nodeRacks = api.NewNodeTopologyMap()
+	nodeRacks.Add("rack0", "node1")
+	topologyMap = api.NewNodeTopologyMap()
+
+	_, err = reconciler.ensureNodeRacks(context.TODO(), nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, nodeRacks, topologyMap, defaultNodePatchConcurrency, reconciler.reqLogger)
+	assert.Error(t, err)
+	assert.True(t, stderrors.Is(err, ErrRackAssignment))
+	assert.Equal(t, `preferred rack "rack0" of node "node2" in zone "zone2" contains nodes from other zones`, err.Error())
+	node = &corev1.Node{}
+	err = reconciler.client.Get(nil, types.NamespacedName{Name: "node2"}, node)
+	assert.NoError(t, err)
+	assert.NotContains(t, node.Labels, defaults.RackTopologyKey)
+}
+
+func TestValidateZoneRegions(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		nodeList.Items[i].Labels[corev1.LabelZoneRegion] = "region1"
+	}
+	assert.Empty(t, validateZoneRegions(nodeList))
+
+	nodeList.Items[2].Labels[zoneTopologyLabel] = "zone1"
+	nodeList.Items[2].Labels[corev1.LabelZoneRegion] = "region2"
+	assert.Equal(t, map[string][]string{"zone1": {"region1", "region2"}}, validateZoneRegions(nodeList))
+}
+
+func TestNodeTopologyMapZoneInMultipleRegions(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		nodeList.Items[i].Labels[corev1.LabelZoneRegion] = "region1"
+	}
+	nodeList.Items[1].Labels[zoneTopologyLabel] = "zone1"
+	nodeList.Items[1].Labels[corev1.LabelZoneRegion] = "region2"
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionTopologyValid)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, "ZoneInMultipleRegions", condition.Reason)
+	assert.Contains(t, condition.Message, "zone1:[region1 region2]")
+}
+
+func TestFailureDomainWeights(t *testing.T) {
+	sc := &api.StorageCluster{}
+	sc.Status.NodeTopologies = &api.NodeTopologyMap{
+		Labels: map[string]api.TopologyLabelValues{
+			zoneTopologyLabel: []string{"zone1", "zone2", "zone3"},
+		},
+	}
+	assert.NoError(t, validateFailureDomainWeights(sc))
+	assert.Equal(t, "zone", determineFailureDomain(sc))
+
+	// preferring racks flips the decision
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{
+		FailureDomainWeights: map[string]int{"rack": 3},
+	}
+	assert.NoError(t, validateFailureDomainWeights(sc))
+	assert.Equal(t, "rack", determineFailureDomain(sc))
+
+	// zones are only used when there are enough of them
+	sc.Spec.NodeTopologies.FailureDomainWeights = map[string]int{"zone": 5, "rack": 0}
+	assert.Equal(t, "zone", determineFailureDomain(sc))
+	sc.Status.NodeTopologies.Labels[zoneTopologyLabel] = []string{"zone1", "zone2"}
+	assert.Equal(t, "rack", determineFailureDomain(sc))
+
+	sc.Spec.NodeTopologies.FailureDomainWeights = map[string]int{"room": 1}
+	assert.Error(t, validateFailureDomainWeights(sc))
+	sc.Spec.NodeTopologies.FailureDomainWeights = map[string]int{"zone": -1}
+	assert.Error(t, validateFailureDomainWeights(sc))
+}
+
+func TestPreferredFailureDomain(t *testing.T) {
+	sufficient := mockNodeList.DeepCopy()
+	for i := range sufficient.Items {
+		sufficient.Items[i].Labels[defaults.RackTopologyKey] = fmt.Sprintf("rack%d", i)
+	}
+	insufficient := sufficient.DeepCopy()
+	insufficient.Items[1].Labels[hostnameLabel] = "node1"
+	insufficient.Items[1].Labels[zoneTopologyLabel] = "zone1"
+	insufficient.Items[1].Labels[defaults.RackTopologyKey] = "rack0"
+
+	cases := []struct {
+		failureDomain string
+		mode          api.TopologyMode
+	}{
+		{failureDomain: "host"},
+		{failureDomain: "rack", mode: api.TopologyModeManual},
+		{failureDomain: "zone"},
+	}
+	for _, c := range cases {
+		sc := &api.StorageCluster{}
+		sc.Spec.NodeTopologies = &api.NodeTopologySpec{PreferredFailureDomain: c.failureDomain, Mode: c.mode}
+		sc.Status.NodeTopologies = &api.NodeTopologyMap{
+			Labels: map[string]api.TopologyLabelValues{
+				zoneTopologyLabel: []string{"zone1", "zone2", "zone3"},
+			},
+		}
+
+		assert.Equal(t, c.failureDomain, determineFailureDomain(sc))
+		assert.NoError(t, validatePreferredFailureDomain(sc, sufficient), c.failureDomain)
+		err := validatePreferredFailureDomain(sc, insufficient)
+		assert.Error(t, err, c.failureDomain)
+		assert.Contains(t, err.Error(), "preferred failure domain "+c.failureDomain)
+		assert.Contains(t, err.Error(), "storage nodes provide 2")
+	}
+
+	// the operator generates the missing racks
+	sc := &api.StorageCluster{}
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{PreferredFailureDomain: "rack"}
+	assert.NoError(t, validatePreferredFailureDomain(sc, insufficient))
+
+	// the committed failure domain is kept
+	sc.Status.FailureDomain = "zone"
+	assert.Equal(t, "zone", determineFailureDomain(sc))
+
+	// unlike the preferred failure domain, the requested one falls back
+	sc = &api.StorageCluster{}
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{FailureDomain: "datacenter"}
+	sc.Status.NodeTopologies = &api.NodeTopologyMap{
+		Labels: map[string]api.TopologyLabelValues{
+			zoneTopologyLabel: []string{"zone1", "zone2", "zone3"},
+		},
+	}
+	assert.Equal(t, "zone", determineFailureDomain(sc))
+	assert.NoError(t, validatePreferredFailureDomain(sc, insufficient))
+
+	// the preferred failure domain wins over the requested one
+	sc.Spec.NodeTopologies.PreferredFailureDomain = "host"
+	assert.Equal(t, "host", determineFailureDomain(sc))
+	sc.Spec.NodeTopologies.PreferredFailureDomain = "zone"
+	err := validatePreferredFailureDomain(sc, insufficient)
+	assert.Error(t, err)
+	assert.Equal(t, "zone", determineFailureDomain(sc))
+}
+
+func TestNodeTopologyMapPreferredFailureDomain(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	nodeList.Items[1].Labels[zoneTopologyLabel] = "zone1"
+
+	// the nodes only provide two zones, the rack failure domain is not
+	// used instead
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{PreferredFailureDomain: "zone"}
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "preferred failure domain zone requires at least 3 zone buckets, but the storage nodes provide 2")
+	assert.Empty(t, sc.Status.FailureDomain)
+
+	sc = &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{PreferredFailureDomain: "host"}
+	reconciler = createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, "host", determineFailureDomain(sc))
+
+	placement := getPlacement(sc, "mon")
+	assert.Equal(t, corev1.LabelHostname, placement.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution[0].PodAffinityTerm.TopologyKey)
+}
+
+func TestNodeTopologyMapFailureDomainPromotion(t *testing.T) {
+	for _, allowPromotion := range []bool{false, true} {
+		nodeList := mockNodeList.DeepCopy()
+		for i := range nodeList.Items {
+			delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+		}
+
+		sc := &api.StorageCluster{}
+		mockStorageCluster.DeepCopyInto(sc)
+		sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+		sc.Status.FailureDomain = "rack"
+		sc.Spec.NodeTopologies = &api.NodeTopologySpec{AllowFailureDomainPromotion: allowPromotion}
+
+		reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+		err := reconcileTestNodeTopologyMap(&reconciler, sc)
+		assert.NoError(t, err)
+		assert.Equal(t, "rack", sc.Status.FailureDomain)
+
+		// zone labels show up on every node
+		for i, n := range nodeList.Items {
+			node := &corev1.Node{}
+			err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+			assert.NoError(t, err)
+			node.Labels[zoneTopologyLabel] = fmt.Sprintf("zone%d", i)
+			err = reconciler.client.Update(nil, node)
+			assert.NoError(t, err)
+		}
+
+		err = reconcileTestNodeTopologyMap(&reconciler, sc)
+		assert.NoError(t, err)
+		if allowPromotion {
+			assert.Equal(t, "zone", sc.Status.FailureDomain)
+		} else {
+			assert.Equal(t, "rack", sc.Status.FailureDomain)
+		}
+	}
+}
+
+func TestNodeTopologyMapRemoveDuplicates(t *testing.T) {
+	nodeRacks := &api.NodeTopologyMap{
+		Labels: map[string]api.TopologyLabelValues{
+			"rack0": []string{"node1", "node2", "node1"},
+			"rack1": []string{"node3"},
+		},
+	}
+	duplicates := nodeRacks.RemoveDuplicates()
+	assert.Equal(t, map[string][]string{"rack0": {"node1"}}, duplicates)
+	assert.Equal(t, api.TopologyLabelValues{"node1", "node2"}, nodeRacks.Labels["rack0"])
+	assert.Equal(t, api.TopologyLabelValues{"node3"}, nodeRacks.Labels["rack1"])
+	assert.Empty(t, nodeRacks.RemoveDuplicates())
+
+	// duplicates from a manual status edit are removed on reconcile
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = &api.NodeTopologyMap{
+		Labels: map[string]api.TopologyLabelValues{
+			zoneTopologyLabel: []string{"zone1", "zone2", "zone1", "zone3"},
+		},
+	}
+	reconciler := createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, api.TopologyLabelValues{"zone1", "zone2", "zone3"}, sc.Status.NodeTopologies.Labels[zoneTopologyLabel])
+}
+
+func TestNodeTopologyMapRequestedFailureDomain(t *testing.T) {
+	cases := []struct {
+		label     string
+		requested string
+		zones     []string
+		actual    string
+		reason    string
+	}{
+		{
+			label:     "Case 1: requested zone is available",
+			requested: "zone",
+			zones:     []string{"zone1", "zone2", "zone3"},
+			actual:    "zone",
+			reason:    "requested failure domain is available",
+		},
+		{
+			label:     "Case 2: requested zone is not available",
+			requested: "zone",
+			zones:     []string{"zone1", "zone1", "zone2"},
+			actual:    "rack",
+			reason:    "requested zone failure domain is not available: only 2 zones found",
+		},
+		{
+			label:     "Case 3: requested rack is preferred over zones",
+			requested: "rack",
+			zones:     []string{"zone1", "zone2", "zone3"},
+			actual:    "rack",
+			reason:    "requested failure domain is available",
+		},
+		{
+			label:  "Case 4: nothing requested",
+			zones:  []string{"zone1", "zone2", "zone3"},
+			actual: "zone",
+			reason: "3 zones found",
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf(c.label)
+		nodeList := mockNodeList.DeepCopy()
+		for i := range nodeList.Items {
+			nodeList.Items[i].Labels[zoneTopologyLabel] = c.zones[i]
+		}
+
+		sc := &api.StorageCluster{}
+		mockStorageCluster.DeepCopyInto(sc)
+		sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+		sc.Spec.NodeTopologies = &api.NodeTopologySpec{FailureDomain: c.requested}
+
+		reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+		err := reconcileTestNodeTopologyMap(&reconciler, sc)
+		assert.NoError(t, err)
+		assert.Equal(t, c.requested, sc.Status.RequestedFailureDomain)
+		assert.Equal(t, c.actual, determineFailureDomain(sc))
+		assert.Equal(t, c.reason, sc.Status.FailureDomainReason)
+	}
+}
+
+func TestValidateRackZones(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	nodeRacks := api.NewNodeTopologyMap()
+	nodeRacks.Add("rack0", "node1")
+	nodeRacks.Add("rack1", "node2")
+	nodeRacks.Add("rack2", "node3")
+	rack, zones := validateRackZones(nodeList, nodeRacks)
+	assert.Equal(t, "", rack)
+	assert.Empty(t, zones)
+
+	nodeRacks.Add("rack1", "node3")
+	rack, zones = validateRackZones(nodeList, nodeRacks)
+	assert.Equal(t, "rack1", rack)
+	assert.Equal(t, []string{"zone2", "zone3"}, zones)
+}
+
+func TestNodeTopologyMapCrossZoneRack(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	nodeList.Items[2].Labels[zoneTopologyLabel] = "zone2"
+	nodeList.Items[0].Labels[defaults.RackTopologyKey] = "rack0"
+	nodeList.Items[1].Labels[defaults.RackTopologyKey] = "rack0"
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `rack "rack0" contains nodes from multiple zones [zone1 zone2]`)
+}
+
+func TestNodeTopologyMapTopologyStatus(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	expected := &api.TopologyStatus{
+		FailureDomain: "zone",
+		Keys:          []string{zoneTopologyLabel},
+		ValueCounts:   map[string]int{zoneTopologyLabel: 3},
+		Domains: map[string][]string{
+			"zone1": {"node1"},
+			"zone2": {"node2"},
+			"zone3": {"node3"},
+		},
+	}
+	assert.Equal(t, expected, sc.Status.Topology)
+
+	// the racks generated for the nodes are reported as failure domains
+	nodeList = mockNodeList.DeepCopy()
+	nodeList.Items[2].Labels[zoneTopologyLabel] = "zone2"
+	nodeList.Items[0].Labels[defaults.RackTopologyKey] = "rack0"
+	sc = &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler = createFakeStorageClusterReconciler(t, sc, nodeList)
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, "rack", sc.Status.Topology.FailureDomain)
+	assert.Equal(t, []string{zoneTopologyLabel, defaults.RackTopologyKey}, sc.Status.Topology.Keys)
+	assert.Equal(t, map[string]int{defaults.RackTopologyKey: 3, zoneTopologyLabel: 2}, sc.Status.Topology.ValueCounts)
+	nodeCount := 0
+	for rack, nodeNames := range sc.Status.Topology.Domains {
+		assert.True(t, sc.Status.NodeTopologies.Contains(defaults.RackTopologyKey, rack))
+		nodeCount += len(nodeNames)
+	}
+	assert.Equal(t, 3, nodeCount)
+	assert.Equal(t, []string{"node1"}, sc.Status.Topology.Domains["rack0"])
+
+	// the view is unchanged when the topology is unchanged
+	topology := sc.Status.Topology.DeepCopy()
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, topology, sc.Status.Topology)
+}
+
+func TestValidateDistinctHosts(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	assert.NoError(t, validateDistinctHosts(nodeList, 3))
+	assert.Error(t, validateDistinctHosts(nodeList, 4))
+
+	// nodes without a hostname label are counted by name
+	delete(nodeList.Items[0].Labels, hostnameLabel)
+	assert.NoError(t, validateDistinctHosts(nodeList, 3))
+}
+
+func TestNodeTopologyMapNotEnoughHosts(t *testing.T) {
+	// zones are sufficient, but two nodes share a host
+	nodeList := mockNodeList.DeepCopy()
+	nodeList.Items[2].Labels[hostnameLabel] = "node2"
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.Error(t, err)
+	assert.Equal(t, "Not enough distinct hosts found: Expected 3, found 2", err.Error())
+}
+
+func TestNodeTopologyMapMinRacksPerZone(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{MinRacksPerZone: 2}
+
+	nodeList := &corev1.NodeList{}
+	for i := 1; i <= 6; i++ {
+		name := fmt.Sprintf("node%d", i)
+		zone := "zone1"
+		if i > 4 {
+			zone = "zone2"
+		}
+		nodeList.Items = append(nodeList.Items, corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					hostnameLabel:            name,
+					zoneTopologyLabel:        zone,
+					defaults.NodeAffinityKey: "",
+				},
+			},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{
+					{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+				},
+			},
+		})
+	}
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+
+	zoneRacks := map[string]map[string]bool{}
+	rackZones := map[string]string{}
+	for _, n := range nodeList.Items {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+		assert.NoError(t, err)
+		zone, rack := node.Labels[zoneTopologyLabel], node.Labels[defaults.RackTopologyKey]
+		assert.NotEmpty(t, rack)
+		if zoneRacks[zone] == nil {
+			zoneRacks[zone] = map[string]bool{}
+		}
+		zoneRacks[zone][rack] = true
+		// racks never span zones
+		if other, ok := rackZones[rack]; ok {
+			assert.Equal(t, other, zone)
+		}
+		rackZones[rack] = zone
+	}
+	assert.Len(t, zoneRacks, 2)
+	for zone, racks := range zoneRacks {
+		assert.True(t, len(racks) >= 2, "zone %s has racks %v", zone, racks)
+	}
+}
+
+func TestPlanNodeRacksMaxRackCountMinRacksPerZone(t *testing.T) {
+	nodeList := &corev1.NodeList{}
+	for i := 1; i <= 6; i++ {
+		name := fmt.Sprintf("node%d", i)
+		zone := "zone1"
+		if i > 3 {
+			zone = "zone2"
+		}
+		nodeList.Items = append(nodeList.Items, corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					hostnameLabel:            name,
+					zoneTopologyLabel:        zone,
+					defaults.NodeAffinityKey: "",
+				},
+			},
+		})
+	}
+
+	plan, err := planNodeRacks(nodeList, 3, 4, 2, defaultRackPrefix, validTopologyLabelKeys, "", nil, api.NewNodeTopologyMap(), logt)
+	assert.NoError(t, err)
+	assert.Len(t, plan, 6)
+	racks := map[string]bool{}
+	for _, rack := range plan {
+		racks[rack] = true
+	}
+	assert.True(t, len(racks) <= 4, "racks %v exceed the maximum rack count", racks)
+
+	// all the racks hold nodes of another zone
+	nodeRacks := api.NewNodeTopologyMap()
+	nodeRacks.Add("rack0", "node1")
+	nodeRacks.Add("rack1", "node2")
+	rack := determinePlacementRack(getNodesByName(nodeList), nodeList.Items[3], 2, 2, defaultRackPrefix, validTopologyLabelKeys, "", nodeRacks)
+	assert.Equal(t, "rack0", rack)
+	assert.Len(t, nodeRacks.Labels, 2)
+}
+
+func TestValidateMinRacksPerZone(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	assert.NoError(t, validateMinRacksPerZone(nodeList, 0, 0))
+	assert.NoError(t, validateMinRacksPerZone(nodeList, 1, 3))
+
+	err := validateMinRacksPerZone(nodeList, 1, 2)
+	assert.Error(t, err)
+	assert.Equal(t, "1 racks per zone in 3 zones exceed the maximum rack count 2", err.Error())
+
+	nodeList.Items[1].Labels[zoneTopologyLabel] = "zone1"
+	err = validateMinRacksPerZone(nodeList, 2, 0)
+	assert.Error(t, err)
+	assert.Equal(t, `Not enough nodes found in zone "zone3": Expected at least 2 to spread them across 2 racks, found 1`, err.Error())
+}
+
+func TestNodeTopologyMapConvergence(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	for i := 0; i < topologyConvergenceThreshold; i++ {
+		err := reconcileTestNodeTopologyMap(&reconciler, sc)
+		assert.NoError(t, err)
+		assert.Equal(t, i, sc.Status.TopologyStableReconciles)
+		assert.Nil(t, conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionTopologyConverged))
+	}
+
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, topologyConvergenceThreshold, sc.Status.TopologyStableReconciles)
+	assert.True(t, conditionsv1.IsStatusConditionTrue(sc.Status.Conditions, api.ConditionTopologyConverged))
+
+	// the count stops at the threshold
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, topologyConvergenceThreshold, sc.Status.TopologyStableReconciles)
+
+	// a topology change resets the convergence
+	node := &corev1.Node{}
+	err = reconciler.client.Get(nil, types.NamespacedName{Name: "node3"}, node)
+	assert.NoError(t, err)
+	node.Labels[zoneTopologyLabel] = "zone4"
+	err = reconciler.client.Update(nil, node)
+	assert.NoError(t, err)
+
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, sc.Status.TopologyStableReconciles)
+	condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionTopologyConverged)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+}
+
+func TestNodeTopologyMapExcludedNodes(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	nodeList.Items[2].Spec.Taints = []corev1.Taint{{Key: "example.com/maintenance", Effect: corev1.TaintEffectNoSchedule}}
+	// the OCS taint is tolerated by the storage Pods
+	nodeList.Items[1].Spec.Taints = []corev1.Taint{{Key: defaults.NodeTolerationKey, Effect: corev1.TaintEffectNoSchedule}}
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, "zone", determineFailureDomain(sc))
+	condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionFailureDomainStranded)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionTrue, condition.Status)
+	assert.Equal(t, "Nodes node3 (tainted) can not schedule storage Pods, leaving only 2 zone failure domains [zone1 zone2] for 3 replicas", condition.Message)
+
+	node := &corev1.Node{}
+	err = reconciler.client.Get(nil, types.NamespacedName{Name: "node3"}, node)
+	assert.NoError(t, err)
+	node.Spec.Taints = nil
+	err = reconciler.client.Update(nil, node)
+	assert.NoError(t, err)
+
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	condition = conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionFailureDomainStranded)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+}
+
+func TestNodeTopologyMapExcludedNodesNotEligible(t *testing.T) {
+	cases := []struct {
+		label   string
+		exclude func(node *corev1.Node)
+		reason  string
+	}{
+		{
+			label:   "cordoned",
+			exclude: func(node *corev1.Node) { node.Spec.Unschedulable = true },
+			reason:  "cordoned",
+		},
+		{
+			label: "annotated",
+			exclude: func(node *corev1.Node) {
+				node.Annotations = map[string]string{excludeFromStorageAnnotation: "true"}
+			},
+			reason: "excluded by annotation",
+		},
+	}
+
+	for _, c := range cases {
+		nodeList := mockNodeList.DeepCopy()
+		node4 := nodeList.Items[0].DeepCopy()
+		node4.Name = "node4"
+		node4.Labels[hostnameLabel] = "node4"
+		nodeList.Items = append(nodeList.Items, *node4)
+		c.exclude(&nodeList.Items[2])
+
+		sc := &api.StorageCluster{}
+		mockStorageCluster.DeepCopyInto(sc)
+		sc.Status.FailureDomain = "zone"
+		sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+		reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+		err := reconcileTestNodeTopologyMap(&reconciler, sc)
+		assert.NoError(t, err, c.label)
+		condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionFailureDomainStranded)
+		assert.NotNil(t, condition, c.label)
+		assert.Equal(t, corev1.ConditionTrue, condition.Status, c.label)
+		assert.Equal(t, "Nodes node3 ("+c.reason+") can not schedule storage Pods, leaving only 2 zone failure domains [zone1 zone2] for 3 replicas", condition.Message, c.label)
+	}
+}
+
+func TestGetNodeExclusionReason(t *testing.T) {
+	ready := corev1.Node{
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		},
+	}
+	cordoned := *ready.DeepCopy()
+	cordoned.Spec.Unschedulable = true
+	annotated := *cordoned.DeepCopy()
+	annotated.Annotations = map[string]string{excludeFromStorageAnnotation: "true"}
+	tainted := *ready.DeepCopy()
+	tainted.Spec.Taints = []corev1.Taint{{Key: "example.com/maintenance", Effect: corev1.TaintEffectNoSchedule}}
+
+	cases := []struct {
+		label           string
+		node            corev1.Node
+		includeNotReady bool
+		ineligible      string
+		excluded        string
+	}{
+		{label: "ready", node: ready},
+		{label: "not ready", node: corev1.Node{}, ineligible: "not ready", excluded: "not ready"},
+		{label: "not ready included", node: corev1.Node{}, includeNotReady: true},
+		{label: "cordoned", node: cordoned, ineligible: "cordoned", excluded: "cordoned"},
+		{label: "cordoned included", node: cordoned, includeNotReady: true, excluded: "cordoned"},
+		{label: "annotated", node: annotated, includeNotReady: true, ineligible: "excluded by annotation", excluded: "excluded by annotation"},
+		{label: "tainted", node: tainted, excluded: "tainted"},
+	}
+
+	for _, c := range cases {
+		sc := &api.StorageCluster{}
+		sc.Spec.NodeTopologies = &api.NodeTopologySpec{IncludeNotReadyNodes: c.includeNotReady}
+		assert.Equal(t, c.ineligible, getNodeIneligibleReason(sc, c.node), c.label)
+		assert.Equal(t, c.excluded, getNodeExclusionReason(sc, c.node), c.label)
+	}
+}
+
+func TestIsNodeExcluded(t *testing.T) {
+	node := corev1.Node{}
+	assert.False(t, isNodeExcluded(node))
+
+	node.Spec.Taints = []corev1.Taint{{Key: "dedicated", Effect: corev1.TaintEffectPreferNoSchedule}}
+	assert.False(t, isNodeExcluded(node))
+
+	node.Spec.Taints = append(node.Spec.Taints, corev1.Taint{Key: "dedicated", Effect: corev1.TaintEffectNoExecute})
+	assert.True(t, isNodeExcluded(node))
+
+	node.Spec.Taints = nil
+	node.Spec.Unschedulable = true
+	assert.True(t, isNodeExcluded(node))
+}
+
+func TestGatherTopologyReport(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	nodeList.Items[2].Labels[zoneTopologyLabel] = "zone2"
+	nodeList.Items[2].Spec.Unschedulable = true
+	nodeList.Items[0].Labels[defaults.RackTopologyKey] = "rack0"
+	original := nodeList.DeepCopy()
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	sc.Status.NodeTopologies.Add(zoneTopologyLabel, "zone1")
+	sc.Status.NodeTopologies.Add(zoneTopologyLabel, "zone2")
+	sc.Status.NodeTopologies.Add(defaults.RackTopologyKey, "rack0")
+	conditionsv1.SetStatusCondition(&sc.Status.Conditions, conditionsv1.Condition{
+		Type:   api.ConditionTopologyValid,
+		Status: corev1.ConditionTrue,
+		Reason: "TopologyValid",
+	})
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	data, err := reconciler.GatherTopologyReport(context.TODO(), sc)
+	assert.NoError(t, err)
+
+	report := TopologyReport{}
+	err = json.Unmarshal(data, &report)
+	assert.NoError(t, err)
+	assert.Equal(t, mockStorageClusterRequest.NamespacedName.String(), report.StorageCluster)
+	assert.Equal(t, "rack", report.FailureDomain)
+	assert.Equal(t, "only 2 zones found", report.FailureDomainReason)
+	assert.Len(t, report.Nodes, 3)
+	assert.Equal(t, "node1", report.Nodes[0].Name)
+	assert.Equal(t, "rack0", report.Nodes[0].Labels[defaults.RackTopologyKey])
+	assert.Equal(t, "root=default zone=zone1 rack=rack0 host=node1", report.Nodes[0].CrushLocation)
+	assert.True(t, report.Nodes[0].Eligible)
+	assert.Empty(t, report.Nodes[0].ExclusionReason)
+	assert.False(t, report.Nodes[2].Eligible)
+	assert.Equal(t, "cordoned", report.Nodes[2].ExclusionReason)
+	assert.Equal(t, map[string][]string{"rack0": {"node1"}}, report.Racks)
+	// the cordoned node is not a storage node, as in the reconcile
+	assert.Empty(t, report.PendingRacks)
+	assert.Contains(t, report.Warnings, "Not enough nodes found: Expected 3, found 2")
+	assert.Contains(t, report.Warnings, "nodes node3 (cordoned) can not schedule storage Pods, leaving only rack failure domains [rack0]")
+	assert.Contains(t, report.Warnings, "no rack was found in zones [zone2]")
+	assert.Len(t, report.Conditions, 1)
+	assert.Equal(t, api.ConditionTopologyValid, report.Conditions[0].Type)
+
+	// the report does not change the nodes
+	for _, n := range original.Items {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+		assert.NoError(t, err)
+		assert.Equal(t, n.Labels, node.Labels)
+		assert.Equal(t, n.Annotations, node.Annotations)
+	}
+}
+
+func TestGatherTopologyReportExclusionReasons(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	nodeList.Items[0].Annotations = map[string]string{excludeFromStorageAnnotation: "true"}
+	nodeList.Items[1].Status.Conditions = nil
+	nodeList.Items[2].Spec.Taints = []corev1.Taint{{Key: "example.com/maintenance", Effect: corev1.TaintEffectNoExecute}}
+
+	cases := []struct {
+		label           string
+		includeNotReady bool
+		eligible        []bool
+		reasons         []string
+	}{
+		{
+			label:    "default",
+			eligible: []bool{false, false, true},
+			reasons:  []string{"excluded by annotation", "not ready", "tainted"},
+		},
+		{
+			label:           "NotReady nodes included",
+			includeNotReady: true,
+			eligible:        []bool{false, true, true},
+			reasons:         []string{"excluded by annotation", "", "tainted"},
+		},
+	}
+
+	for _, c := range cases {
+		sc := &api.StorageCluster{}
+		mockStorageCluster.DeepCopyInto(sc)
+		sc.Spec.NodeTopologies = &api.NodeTopologySpec{IncludeNotReadyNodes: c.includeNotReady}
+
+		reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+		data, err := reconciler.GatherTopologyReport(context.TODO(), sc)
+		assert.NoError(t, err, c.label)
+		report := TopologyReport{}
+		assert.NoError(t, json.Unmarshal(data, &report), c.label)
+
+		assert.Len(t, report.Nodes, 3, c.label)
+		for i, node := range report.Nodes {
+			assert.Equal(t, c.eligible[i], node.Eligible, "%s: %s", c.label, node.Name)
+			assert.Equal(t, c.reasons[i], node.ExclusionReason, "%s: %s", c.label, node.Name)
+		}
+	}
+}
+
+func TestNodeTopologyMapPersistRackAssignments(t *testing.T) {
+	racks := map[string]string{"node1": "rack2", "node2": "rack0", "node3": "rack1"}
+
+	for _, persist := range []bool{true, false} {
+		nodeList := mockNodeList.DeepCopy()
+		for i := range nodeList.Items {
+			delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+			nodeList.Items[i].Labels[defaults.RackTopologyKey] = racks[nodeList.Items[i].Name]
+		}
+
+		sc := &api.StorageCluster{}
+		mockStorageCluster.DeepCopyInto(sc)
+		sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+		sc.Spec.NodeTopologies = &api.NodeTopologySpec{PersistRackAssignments: persist}
+
+		reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+		err := reconcileTestNodeTopologyMap(&reconciler, sc)
+		assert.NoError(t, err)
+		if persist {
+			assert.Equal(t, racks, sc.Status.NodeRacks)
+		} else {
+			assert.Empty(t, sc.Status.NodeRacks)
+		}
+
+		// node1 and node2 are reprovisioned and lose their rack label
+		for _, name := range []string{"node1", "node2"} {
+			node := &corev1.Node{}
+			err = reconciler.client.Get(nil, types.NamespacedName{Name: name}, node)
+			assert.NoError(t, err)
+			delete(node.Labels, defaults.RackTopologyKey)
+			err = reconciler.client.Update(nil, node)
+			assert.NoError(t, err)
+		}
+
+		err = reconcileTestNodeTopologyMap(&reconciler, sc)
+		assert.NoError(t, err)
+
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: "node1"}, node)
+		assert.NoError(t, err)
+		if persist {
+			assert.Equal(t, "rack2", node.Labels[defaults.RackTopologyKey])
+			assert.Equal(t, racks, sc.Status.NodeRacks)
+		} else {
+			assert.Equal(t, "rack0", node.Labels[defaults.RackTopologyKey])
+		}
+	}
+}
+
+func TestEnsureNodeRacksEvents(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+	}
+	reconciler := createFakeStorageClusterReconciler(t, nodeList.DeepCopy())
+	recorder := record.NewFakeRecorder(10)
+	reconciler.recorder = recorder
+
+	nodeRacks := api.NewNodeTopologyMap()
+	_, err := reconciler.ensureNodeRacks(context.TODO(), nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, nodeRacks, api.NewNodeTopologyMap(), defaultNodePatchConcurrency, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.Len(t, recorder.Events, 3)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, fmt.Sprintf("Normal NodeRackLabeled Labeled node with %s=rack%d, a new rack", defaults.RackTopologyKey, i), <-recorder.Events)
+	}
+
+	// a flapping rack label is only recorded once per interval
+	node := &corev1.Node{}
+	err = reconciler.client.Get(nil, types.NamespacedName{Name: nodeList.Items[0].Name}, node)
+	assert.NoError(t, err)
+	delete(node.Labels, defaults.RackTopologyKey)
+	err = reconciler.client.Update(nil, node)
+	assert.NoError(t, err)
+	nodeList, err = reconciler.getStorageClusterNodes(context.TODO(), mockStorageCluster)
+	assert.NoError(t, err)
+	nodeRacks.Labels["rack0"] = api.TopologyLabelValues{}
+	assignments, err := reconciler.ensureNodeRacks(context.TODO(), nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, nodeRacks, api.NewNodeTopologyMap(), defaultNodePatchConcurrency, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.Len(t, assignments, 1)
+	assert.Empty(t, recorder.Events)
+
+	reconciler.nodeRackEvents[node.Name+"/rack0"] = time.Now().Add(-nodeRackEventInterval)
+	reconciler.recordNodeRackEvent(node, "", "rack0", false)
+	assert.Equal(t, fmt.Sprintf("Normal NodeRackLabeled Labeled node with %s=rack0", defaults.RackTopologyKey), <-recorder.Events)
+	reconciler.recordNodeRackEvent(node, "rack0", "rack1", false)
+	assert.Equal(t, fmt.Sprintf("Normal NodeRackLabeled Labeled node with %s=rack1, previously rack0", defaults.RackTopologyKey), <-recorder.Events)
+
+	// no event is recorded when the label already matches
+	reconciler.recordNodeRackEvent(node, "rack2", "rack2", false)
+	assert.Empty(t, recorder.Events)
+}
+
+// nodePatchRecordingClient is a topologyClient recording the node patches
+type nodePatchRecordingClient struct {
+	topologyClient
+	lock    sync.Mutex
+	patches map[string][]string
+	// failures are the names of the nodes whose patch fails
+	failures map[string]bool
+	// forbidden are the names of the nodes whose patch is forbidden
+	forbidden map[string]bool
+}
+
+func (c *nodePatchRecordingClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	data, err := patch.Data(obj)
+	if err != nil {
+		return err
+	}
+	if node, ok := obj.(*corev1.Node); ok {
+		c.lock.Lock()
+		c.patches[node.Name] = append(c.patches[node.Name], string(data))
+		c.lock.Unlock()
+		if c.failures[node.Name] {
+			return stderrors.New("patch failed")
+		}
+		if c.forbidden[node.Name] {
+			return errors.NewForbidden(schema.GroupResource{Resource: "nodes"}, node.Name, fmt.Errorf("patch not allowed"))
+		}
+	}
+	return c.topologyClient.Patch(ctx, obj, patch, opts...)
+}
+
+func TestEnsureNodeRacksIdempotent(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+	}
+	reconciler := createFakeStorageClusterReconciler(t, nodeList.DeepCopy())
+	recorder := &nodePatchRecordingClient{topologyClient: reconciler.client, patches: map[string][]string{}}
+	reconciler.nodeClient = recorder
+
+	nodeRacks := api.NewNodeTopologyMap()
+	_, err := reconciler.ensureNodeRacks(context.TODO(), nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, nodeRacks, api.NewNodeTopologyMap(), defaultNodePatchConcurrency, reconciler.reqLogger)
+	assert.NoError(t, err)
+	// every node is patched once, with its own rack
+	assert.Len(t, recorder.patches, 3)
+	for i, node := range nodeList.Items {
+		assert.Equal(t, []string{fmt.Sprintf(`{"metadata":{"annotations":{"%s":"rack%d"},"labels":{"%s":"rack%d"}}}`, operatorRackAnnotation, i, defaults.RackTopologyKey, i)}, recorder.patches[node.Name])
+	}
+
+	// the labeled nodes are not patched again
+	recorder.patches = map[string][]string{}
+	nodeList, err = reconciler.getStorageClusterNodes(context.TODO(), mockStorageCluster)
+	assert.NoError(t, err)
+	assignments, err := reconciler.ensureNodeRacks(context.TODO(), nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, nodeRacks, api.NewNodeTopologyMap(), defaultNodePatchConcurrency, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.Empty(t, assignments)
+	assert.Empty(t, recorder.patches)
+}
+
+func TestEnsureNodeRacksConcurrent(t *testing.T) {
+	nodeList := &corev1.NodeList{}
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("node%d", i)
+		nodeList.Items = append(nodeList.Items, corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{hostnameLabel: name},
+			},
+		})
+	}
+	plan, err := planNodeRacks(nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, api.NewNodeTopologyMap(), logt)
+	assert.NoError(t, err)
+
+	reconciler := createFakeStorageClusterReconciler(t, nodeList.DeepCopy())
+	recorder := &nodePatchRecordingClient{topologyClient: reconciler.client, patches: map[string][]string{}}
+	reconciler.nodeClient = recorder
+	nodeRacks := api.NewNodeTopologyMap()
+	assignments, err := reconciler.ensureNodeRacks(context.TODO(), nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, nodeRacks, api.NewNodeTopologyMap(), 8, reconciler.reqLogger)
+	assert.NoError(t, err)
+
+	// the racks are assigned as planned, in the order of the nodes
+	assert.Len(t, assignments, 30)
+	for i, assignment := range assignments {
+		assert.Equal(t, nodeList.Items[i].Name, assignment.Node)
+		assert.Equal(t, plan[assignment.Node], assignment.Rack)
+		assert.Len(t, recorder.patches[assignment.Node], 1)
+		assert.Contains(t, nodeRacks.Labels[assignment.Rack], assignment.Node)
+
+		node := &corev1.Node{}
+		err = reconciler.client.Get(context.TODO(), types.NamespacedName{Name: assignment.Node}, node)
+		assert.NoError(t, err)
+		assert.Equal(t, assignment.Rack, node.Labels[defaults.RackTopologyKey])
+	}
+
+	// a forbidden patch is found even if another patch failed first
+	reconciler = createFakeStorageClusterReconciler(t, nodeList.DeepCopy())
+	reconciler.nodeClient = &nodePatchRecordingClient{
+		topologyClient: reconciler.client,
+		patches:        map[string][]string{},
+		failures:       map[string]bool{"node2": true},
+		forbidden:      map[string]bool{"node17": true},
+	}
+	assignments, err = reconciler.ensureNodeRacks(context.TODO(), nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, api.NewNodeTopologyMap(), api.NewNodeTopologyMap(), 8, reconciler.reqLogger)
+	assert.True(t, stderrors.Is(err, ErrRackAssignment))
+	assert.Len(t, assignments, 28)
+	assert.False(t, errors.IsForbidden(stderrors.Unwrap(err)))
+	assert.True(t, anyTopologyError(err, errors.IsForbidden))
+}
+
+func TestEnsureNodeRacksPatchErrors(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+	}
+	reconciler := createFakeStorageClusterReconciler(t, nodeList.DeepCopy())
+	recorder := &nodePatchRecordingClient{
+		topologyClient: reconciler.client,
+		patches:        map[string][]string{},
+		failures:       map[string]bool{"node1": true, "node3": true},
+	}
+	reconciler.nodeClient = recorder
+
+	nodeRacks := api.NewNodeTopologyMap()
+	assignments, err := reconciler.ensureNodeRacks(context.TODO(), nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, nodeRacks, api.NewNodeTopologyMap(), 2, reconciler.reqLogger)
+	assert.True(t, stderrors.Is(err, ErrRackAssignment))
+	assert.EqualError(t, err, "2 errors: [patch failed, patch failed]")
+	// the failed patches do not stop the others
+	assert.Len(t, recorder.patches, 3)
+	assert.Equal(t, []nodeRackAssignment{{Node: "node2", Rack: "rack1"}}, assignments)
+	assert.Equal(t, map[string]api.TopologyLabelValues{"rack1": {"node2"}}, nodeRacks.Labels)
+}
+
+func TestRemoveDeselectedNodeRacks(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		nodeList.Items[i].Labels[defaults.RackTopologyKey] = fmt.Sprintf("rack%d", i)
+		nodeList.Items[i].Annotations = map[string]string{operatorRackAnnotation: fmt.Sprintf("rack%d", i)}
+	}
+	// the rack label of the second node was changed by an admin
+	nodeList.Items[1].Labels[defaults.RackTopologyKey] = "admin-rack"
+	// the rack label of the third node was set by an admin
+	delete(nodeList.Items[2].Annotations, operatorRackAnnotation)
+	reconciler := createFakeStorageClusterReconciler(t, nodeList.DeepCopy())
+	recorder := &nodePatchRecordingClient{topologyClient: reconciler.client, patches: map[string][]string{}}
+	reconciler.nodeClient = recorder
+
+	// the first node is still a storage node
+	storageNodes := &corev1.NodeList{Items: []corev1.Node{nodeList.Items[0]}}
+	err := reconciler.removeDeselectedNodeRacks(context.TODO(), storageNodes, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.Len(t, recorder.patches, 1)
+
+	node := &corev1.Node{}
+	err = reconciler.client.Get(context.TODO(), types.NamespacedName{Name: nodeList.Items[1].Name}, node)
+	assert.NoError(t, err)
+	assert.Equal(t, "admin-rack", node.Labels[defaults.RackTopologyKey])
+	assert.NotContains(t, node.Annotations, operatorRackAnnotation)
+
+	// the operator rack label is removed once the node is deselected
+	storageNodes.Items = []corev1.Node{}
+	err = reconciler.removeDeselectedNodeRacks(context.TODO(), storageNodes, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.Len(t, recorder.patches, 2)
+	node = &corev1.Node{}
+	err = reconciler.client.Get(context.TODO(), types.NamespacedName{Name: nodeList.Items[0].Name}, node)
+	assert.NoError(t, err)
+	assert.NotContains(t, node.Labels, defaults.RackTopologyKey)
+	assert.NotContains(t, node.Annotations, operatorRackAnnotation)
+
+	node = &corev1.Node{}
+	err = reconciler.client.Get(context.TODO(), types.NamespacedName{Name: nodeList.Items[2].Name}, node)
+	assert.NoError(t, err)
+	assert.Equal(t, "rack2", node.Labels[defaults.RackTopologyKey])
+}
+
+func TestNodeTopologyMapTopologyChangedEvent(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	nodeList.Items[2].Labels[zoneTopologyLabel] = "zone2"
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	recorder := record.NewFakeRecorder(10)
+	reconciler.recorder = recorder
+
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	// the nodes are labeled with racks first
+	assert.Len(t, recorder.Events, 4)
+	for i := 0; i < 3; i++ {
+		assert.Contains(t, <-recorder.Events, "Normal NodeRackLabeled")
+	}
+	event := <-recorder.Events
+	assert.Contains(t, event, "Normal TopologyChanged Node topology changed: failure domain rack")
+
+	// no event is recorded when nothing changed
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Empty(t, recorder.Events)
+
+	// a third zone changes the failure domain
+	node := &corev1.Node{}
+	err = reconciler.client.Get(nil, types.NamespacedName{Name: "node3"}, node)
+	assert.NoError(t, err)
+	node.Labels[zoneTopologyLabel] = "zone3"
+	err = reconciler.client.Update(nil, node)
+	assert.NoError(t, err)
+
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	// the change of the failure domain is not also recorded as a
+	// TopologyChanged event
+	assert.Len(t, recorder.Events, 1)
+	event = <-recorder.Events
+	assert.Equal(t, "Normal FailureDomainChanged Failure domain changed from rack to zone with 3 storage nodes", event)
+}
+
+func TestNodeTopologyMapRackPrefix(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+	}
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{RackPrefix: "dc1-r"}
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	_, racks := sc.Status.NodeTopologies.GetKeyValues(defaults.RackTopologyKey)
+	assert.ElementsMatch(t, []string{"dc1-r0", "dc1-r1", "dc1-r2"}, racks)
+
+	// switching the prefix keeps the existing racks
+	sc.Spec.NodeTopologies.RackPrefix = "dc2-r"
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node4",
+			Labels: map[string]string{hostnameLabel: "node4", defaults.NodeAffinityKey: ""},
+		},
+		Status: mockNodeList.Items[0].Status,
+	}
+	err = reconciler.client.Create(nil, node)
+	assert.NoError(t, err)
+
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	_, racks = sc.Status.NodeTopologies.GetKeyValues(defaults.RackTopologyKey)
+	assert.ElementsMatch(t, []string{"dc1-r0", "dc1-r1", "dc1-r2", "dc2-r0"}, racks)
+	err = reconciler.client.Get(nil, types.NamespacedName{Name: "node4"}, node)
+	assert.NoError(t, err)
+	assert.Equal(t, "dc2-r0", node.Labels[defaults.RackTopologyKey])
+}
+
+func TestValidateRackPrefix(t *testing.T) {
+	sc := &api.StorageCluster{}
+	assert.NoError(t, validateRackPrefix(sc))
+	assert.Equal(t, "rack", getRackPrefix(sc))
+
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{RackPrefix: "dc1-r"}
+	assert.NoError(t, validateRackPrefix(sc))
+	assert.Equal(t, "dc1-r", getRackPrefix(sc))
+
+	sc.Spec.NodeTopologies.RackPrefix = "dc1/r"
+	err := validateRackPrefix(sc)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid rack prefix "dc1/r"`)
+}
+
+func TestNodeTopologyMapMinRackCount(t *testing.T) {
+	for _, minRacks := range []int{0, 5} {
+		sc := &api.StorageCluster{}
+		mockStorageCluster.DeepCopyInto(sc)
+		sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+		sc.Spec.NodeTopologies = &api.NodeTopologySpec{MinRackCount: minRacks}
+
+		nodeList := &corev1.NodeList{}
+		for i := 1; i <= 5; i++ {
+			name := fmt.Sprintf("node%d", i)
+			nodeList.Items = append(nodeList.Items, corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name,
+					Labels: map[string]string{
+						hostnameLabel:            name,
+						defaults.NodeAffinityKey: "",
+					},
+				},
+				Status: corev1.NodeStatus{
+					Conditions: []corev1.NodeCondition{
+						{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+					},
+				},
+			})
+		}
+
+		reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+		err := reconcileTestNodeTopologyMap(&reconciler, sc)
+		assert.NoError(t, err)
+		_, racks := sc.Status.NodeTopologies.GetKeyValues(defaults.RackTopologyKey)
+		if minRacks == 0 {
+			assert.Len(t, racks, getDeviceSetReplica(sc))
+		} else {
+			assert.Len(t, racks, minRacks)
+		}
+	}
+}
+
+func TestValidateMinRackCount(t *testing.T) {
+	sc := &api.StorageCluster{}
+	assert.NoError(t, validateMinRackCount(sc))
+	assert.Equal(t, 3, getMinRackCount(sc))
+
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{MinRackCount: 5}
+	assert.NoError(t, validateMinRackCount(sc))
+	assert.Equal(t, 5, getMinRackCount(sc))
+
+	sc.Spec.NodeTopologies.MinRackCount = 2
+	err := validateMinRackCount(sc)
+	assert.Error(t, err)
+	assert.Equal(t, "invalid minimum rack count 2: at least 3 racks are required by the StorageDeviceSets", err.Error())
+
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{MinRackCount: 5, MaxRackCount: 4}
+	err = validateMinRackCount(sc)
+	assert.Error(t, err)
+	assert.Equal(t, "invalid minimum rack count 5: it exceeds the maximum rack count 4", err.Error())
+}
+
+func TestNodeTopologyMapDatacenterFailureDomain(t *testing.T) {
+	datacenterLabel := "topology.kubernetes.io/datacenter"
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		nodeList.Items[i].Labels[datacenterLabel] = fmt.Sprintf("dc%d", i+1)
+	}
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, "datacenter", determineFailureDomain(sc))
+	assert.Equal(t, "3 datacenters found", sc.Status.FailureDomainReason)
+	key, values := sc.Status.NodeTopologies.GetKeyValues("datacenter")
+	assert.Equal(t, datacenterLabel, key)
+	assert.ElementsMatch(t, []string{"dc1", "dc2", "dc3"}, values)
+	assert.Equal(t, []string{"node1"}, sc.Status.Topology.Domains["dc1"])
+	assert.Equal(t, "root=default zone=zone1 datacenter=dc1 host=node1", CrushLocation(nodeList.Items[0]))
+
+	// the failure domain set in status still wins
+	sc.Status.FailureDomain = "zone"
+	assert.Equal(t, "zone", determineFailureDomain(sc))
+
+	// fewer than three datacenters fall back to the zones
+	sc.Status.FailureDomain = ""
+	sc.Status.NodeTopologies.Labels[datacenterLabel] = api.TopologyLabelValues{"dc1", "dc2"}
+	assert.Equal(t, "zone", determineFailureDomain(sc))
+}
+
+func TestNodeTopologyMapAdditionalLabelKeys(t *testing.T) {
+	powerZoneLabel := "acme.io/powerzone"
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+		nodeList.Items[i].Labels[powerZoneLabel] = fmt.Sprintf("pz%d", i+1)
+	}
+
+	// vendor labels are ignored by default
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{}
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList.DeepCopy())
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.NotContains(t, sc.Status.NodeTopologies.Labels, powerZoneLabel)
+	assert.Equal(t, "rack", determineFailureDomain(sc))
+
+	// additional label keys drive the failure domain
+	sc = &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{
+		AdditionalLabelKeys: []string{powerZoneLabel},
+	}
+
+	reconciler = createFakeStorageClusterReconciler(t, sc, nodeList.DeepCopy())
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"pz1", "pz2", "pz3"}, sc.Status.NodeTopologies.Labels[powerZoneLabel])
+	assert.Equal(t, "zone", determineFailureDomain(sc))
+
+	// and the rack placement
+	node := corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node4",
+			Labels: map[string]string{hostnameLabel: "node4", powerZoneLabel: "pz2"},
+		},
+	}
+	nodeList.Items = append(nodeList.Items, node)
+	nodeRacks := api.NewNodeTopologyMap()
+	for i := 0; i < 3; i++ {
+		nodeRacks.Add(fmt.Sprintf("rack%d", i), nodeList.Items[i].Name)
+	}
+	rack := determinePlacementRack(getNodesByName(nodeList), node, 3, 0, defaultRackPrefix, getTopologyLabelKeys(sc), "", nodeRacks)
+	assert.Equal(t, "rack1", rack)
+}
+
+func TestIsTopologyLabelOf(t *testing.T) {
+	cases := []struct {
+		label        string
+		topologyType string
+		expected     bool
+	}{
+		{"failure-domain.kubernetes.io/zone", "zone", true},
+		{"topology.rook.io/rack", "rack", true},
+		{"acme.io/powerzone", "zone", true},
+		{"topology.kubernetes.io/datacenter", "datacenter", true},
+		{"myapp.io/brackets", "rack", false},
+		{"failure-domain.kubernetes.io/dezoned", "zone", false},
+		{"zone.acme.io/name", "zone", false},
+		{"rack.example.com/slot", "rack", false},
+		{"rack", "rack", true},
+		{"acme.io/zone", "acme.io/zone", true},
+	}
+
+	for _, c := range cases {
+		assert.Equalf(t, c.expected, api.IsTopologyLabelOf(c.label, c.topologyType), "label %q", c.label)
+	}
+}
+
+func TestMatchesTopologyLabelKey(t *testing.T) {
+	assert.True(t, matchesTopologyLabelKey("topology.rook.io/rack", "topology.rook.io"))
+	assert.True(t, matchesTopologyLabelKey("acme.io/powerzone", "acme.io/powerzone"))
+	assert.False(t, matchesTopologyLabelKey("example.topology.rook.io/rack", "topology.rook.io"))
+	assert.False(t, matchesTopologyLabelKey("topology.rook.io.example/rack", "topology.rook.io"))
+	assert.False(t, matchesTopologyLabelKey("acme.io/powerzones", "acme.io/powerzone"))
+}
+
+func TestNodeTopologyMapAdversarialLabels(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+		nodeList.Items[i].Labels["myapp.io/brackets"] = "b1"
+		nodeList.Items[i].Labels["topology.rook.io/brackets"] = fmt.Sprintf("b%d", i)
+		nodeList.Items[i].Labels["failure-domain.kubernetes.io/dezoned"] = fmt.Sprintf("d%d", i)
+	}
+	assert.Equal(t, "", nodeZone(nodeList.Items[0]))
+	assert.Equal(t, "root=default host=node1", CrushLocation(nodeList.Items[0]))
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, "rack", determineFailureDomain(sc))
+
+	// the racks are generated instead of taken from the brackets labels
+	key, racks := sc.Status.NodeTopologies.GetKeyValues(defaults.RackTopologyKey)
+	assert.Equal(t, defaults.RackTopologyKey, key)
+	assert.ElementsMatch(t, []string{"rack0", "rack1", "rack2"}, racks)
+}
+
+func TestPublishTopologyMetrics(t *testing.T) {
+	gaugeValue := func(gauge *prometheus.GaugeVec, labels ...string) float64 {
+		metric := &dto.Metric{}
+		assert.NoError(t, gauge.WithLabelValues(labels...).Write(metric))
+		return metric.GetGauge().GetValue()
+	}
+	countMetrics := func(gauge *prometheus.GaugeVec) int {
+		ch := make(chan prometheus.Metric, 64)
+		gauge.Collect(ch)
+		close(ch)
+		count := 0
+		for m := range ch {
+			metric := &dto.Metric{}
+			assert.NoError(t, m.Write(metric))
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["namespace"] == mockStorageCluster.Namespace && labels["storagecluster"] == mockStorageCluster.Name {
+				count++
+			}
+		}
+		return count
+	}
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+
+	publishTopologyMetrics(sc, reconciler.failureDomainNodes)
+	defer deleteTopologyMetrics(sc)
+	assert.Equal(t, 1.0, gaugeValue(failureDomainTypeGauge, sc.Namespace, sc.Name, "zone"))
+	assert.Equal(t, 0.0, gaugeValue(failureDomainTypeGauge, sc.Namespace, sc.Name, "rack"))
+	assert.Equal(t, 3, countMetrics(failureDomainMembersGauge))
+	assert.Equal(t, 1.0, gaugeValue(failureDomainMembersGauge, sc.Namespace, sc.Name, "zone1"))
+
+	// a zone disappearing is removed from the metrics
+	sc.Status.FailureDomain = "zone"
+	sc.Status.NodeTopologies.Labels[zoneTopologyLabel] = api.TopologyLabelValues{"zone1", "zone2"}
+	publishTopologyMetrics(sc, reconciler.failureDomainNodes)
+	assert.Equal(t, 2, countMetrics(failureDomainMembersGauge))
+
+	// the members of the host failure domain are the hosts of the storage
+	// nodes
+	sc.Status.FailureDomain = "host"
+	publishTopologyMetrics(sc, nodesPerFailureDomain(mockNodeList, "host", ""))
+	assert.Equal(t, 1.0, gaugeValue(failureDomainTypeGauge, sc.Namespace, sc.Name, "host"))
+	assert.Equal(t, 0.0, gaugeValue(failureDomainTypeGauge, sc.Namespace, sc.Name, "zone"))
+	assert.Equal(t, 3, countMetrics(failureDomainMembersGauge))
+	assert.Equal(t, 1.0, gaugeValue(failureDomainMembersGauge, sc.Namespace, sc.Name, "node2"))
+
+	deleteTopologyMetrics(sc)
+	assert.Equal(t, 0, countMetrics(failureDomainMembersGauge))
+	assert.Equal(t, 0, countMetrics(failureDomainTypeGauge))
+}
+
+func TestGetStorageClusterNodesFieldSelector(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	nodeList.Items[2].Labels["example.com/tier"] = "storage"
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Spec.LabelSelector = &metav1.LabelSelector{MatchLabels: map[string]string{defaults.NodeAffinityKey: ""}}
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{
+		LabelSelectors: []*metav1.LabelSelector{{MatchLabels: map[string]string{"example.com/tier": "storage"}}},
+		FieldSelector:  "metadata.name!=node1,metadata.name!=node3",
+	}
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	nodes, err := reconciler.getStorageClusterNodes(context.TODO(), sc)
+	assert.NoError(t, err)
+	assert.Len(t, nodes.Items, 1)
+	assert.Equal(t, "node2", nodes.Items[0].Name)
+
+	sc.Spec.NodeTopologies.FieldSelector = "metadata.name=node3,spec.unschedulable=false"
+	nodes, err = reconciler.getStorageClusterEligibleNodes(context.TODO(), sc, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.Len(t, nodes.Items, 1)
+	assert.Equal(t, "node3", nodes.Items[0].Name)
+}
+
+func TestGetMinimumNodes(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	assert.Equal(t, defaults.DeviceSetReplica, getMinimumNodes(sc))
+
+	// the failure domain is not known yet
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{MinimumNodes: map[string]int{"zone": 6, "host": 4}}
+	assert.Equal(t, defaults.DeviceSetReplica, getMinimumNodes(sc))
+
+	// the preferred failure domain applies until one is determined
+	sc.Spec.NodeTopologies.PreferredFailureDomain = "host"
+	assert.Equal(t, 4, getMinimumNodes(sc))
+	sc.Status.FailureDomain = "zone"
+	assert.Equal(t, 6, getMinimumNodes(sc))
+	sc.Status.FailureDomain = "rack"
+	assert.Equal(t, defaults.DeviceSetReplica, getMinimumNodes(sc))
+
+	// an override can't lower the replica count
+	sc.Spec.NodeTopologies.MinimumNodes["rack"] = 2
+	assert.Equal(t, defaults.DeviceSetReplica, getMinimumNodes(sc))
+	sc.Spec.StorageDeviceSets = []api.StorageDeviceSet{{Replica: 5}}
+	assert.Equal(t, 5, getMinimumNodes(sc))
+	assert.Equal(t, 5, getDeviceSetReplica(sc))
+}
+
+func TestGetMinimumNodesFailureDomain(t *testing.T) {
+	zones := api.NewNodeTopologyMap()
+	for _, zone := range []string{"zone1", "zone2", "zone3", "zone4"} {
+		zones.Add(zoneTopologyLabel, zone)
+	}
+
+	cases := []struct {
+		label           string
+		failureDomain   string
+		preferred       string
+		flexibleScaling bool
+		replica         int
+		minRackCount    int
+		minRacksPerZone int
+		minimumNodes    map[string]int
+		expected        int
+	}{
+		{
+			label:    "Case 1: unknown failure domain",
+			expected: defaults.DeviceSetReplica,
+		},
+		{
+			label:         "Case 2: zone failure domain",
+			failureDomain: "zone",
+			expected:      defaults.DeviceSetReplica,
+		},
+		{
+			label:         "Case 3: zone failure domain with more replicas",
+			failureDomain: "zone",
+			replica:       4,
+			expected:      4,
+		},
+		{
+			label:         "Case 4: rack failure domain",
+			failureDomain: "rack",
+			expected:      defaults.DeviceSetReplica,
+		},
+		{
+			label:         "Case 5: rack failure domain with a minimum rack count",
+			failureDomain: "rack",
+			minRackCount:  5,
+			expected:      5,
+		},
+		{
+			label:           "Case 6: rack failure domain with racks in each zone",
+			failureDomain:   "rack",
+			minRacksPerZone: 2,
+			expected:        8,
+		},
+		{
+			label:        "Case 7: preferred rack failure domain",
+			preferred:    "rack",
+			minRackCount: 6,
+			expected:     6,
+		},
+		{
+			label:           "Case 8: flexible scaling with single replica device sets",
+			flexibleScaling: true,
+			replica:         1,
+			expected:        defaults.DeviceSetReplica,
+		},
+		{
+			label:           "Case 9: flexible scaling with a host override",
+			flexibleScaling: true,
+			minimumNodes:    map[string]int{"host": 5, "rack": 7},
+			expected:        5,
+		},
+		{
+			label:           "Case 10: flexible scaling does not override the preferred failure domain",
+			flexibleScaling: true,
+			preferred:       "rack",
+			minimumNodes:    map[string]int{"host": 5, "rack": 7},
+			expected:        7,
+		},
+		{
+			label:           "Case 11: flexible scaling once the failure domain is determined",
+			failureDomain:   "zone",
+			flexibleScaling: true,
+			minimumNodes:    map[string]int{"host": 5},
+			expected:        defaults.DeviceSetReplica,
+		},
+		{
+			label:         "Case 12: override below the racks required",
+			failureDomain: "rack",
+			minRackCount:  5,
+			minimumNodes:  map[string]int{"rack": 4},
+			expected:      5,
+		},
+	}
+
+	for _, c := range cases {
+		sc := &api.StorageCluster{}
+		mockStorageCluster.DeepCopyInto(sc)
+		sc.Spec.StorageDeviceSets = []api.StorageDeviceSet{{Replica: c.replica}}
+		sc.Spec.FlexibleScaling = c.flexibleScaling
+		sc.Spec.NodeTopologies = &api.NodeTopologySpec{
+			PreferredFailureDomain: c.preferred,
+			MinRackCount:           c.minRackCount,
+			MinRacksPerZone:        c.minRacksPerZone,
+			MinimumNodes:           c.minimumNodes,
+		}
+		sc.Status.FailureDomain = c.failureDomain
+		sc.Status.NodeTopologies = zones.DeepCopy()
+
+		assert.Equalf(t, c.expected, getMinimumNodes(sc), "[%s]: unexpected minimum nodes", c.label)
+	}
+}
+
+func TestNodeTopologyMapFlexibleScaling(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.FailureDomain = ""
+	sc.Status.NodeTopologies = nil
+	sc.Spec.NodeTopologies = nil
+	sc.Spec.FlexibleScaling = true
+	sc.Spec.StorageDeviceSets = []api.StorageDeviceSet{{Replica: 1}}
+
+	nodes := mockNodeList.DeepCopy()
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodes)
+	assert.NoError(t, reconcileTestNodeTopologyMap(&reconciler, sc))
+	assert.Equal(t, "host", determineFailureDomain(sc))
+
+	// the three replicas of the pools still need three hosts
+	nodes.Items = nodes.Items[:2]
+	reconciler = createFakeStorageClusterReconciler(t, sc, nodes)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.EqualError(t, err, "Not enough nodes found: Expected 3, found 2")
+	assert.True(t, stderrors.Is(err, ErrInsufficientNodes))
+}
+
+func TestNodeTopologyMapMinimumNodes(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.FailureDomain = "zone"
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{MinimumNodes: map[string]int{"zone": 4}}
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.EqualError(t, err, "Not enough nodes found: Expected 4, found 3")
+	assert.True(t, stderrors.Is(err, ErrInsufficientNodes))
+
+	// the override of another failure domain does not apply
+	sc.Spec.NodeTopologies.MinimumNodes = map[string]int{"rack": 4}
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+}
+
+func TestValidateFailureDomainValues(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	for _, zone := range []string{"zone1", "zone2", "zone2"} {
+		sc.Status.NodeTopologies.Add(zoneTopologyLabel, zone)
+	}
+
+	err := validateFailureDomainValues(sc, mockNodeList, "zone")
+	assert.EqualError(t, err, "Not enough failure domain values found: the zone failure domain has 2 values, at least 3 are required for the replicas")
+	assert.True(t, stderrors.Is(err, ErrInsufficientFailureDomains))
+	assert.True(t, stderrors.Is(err, ErrTopologyReconcile))
+
+	sc.Status.NodeTopologies.Add(zoneTopologyLabel, "zone3")
+	assert.NoError(t, validateFailureDomainValues(sc, mockNodeList, "zone"))
+	assert.NoError(t, validateFailureDomainValues(sc, mockNodeList, "host"))
+	assert.Error(t, validateFailureDomainValues(sc, mockNodeList, "datacenter"))
+}
+
+func TestNodeTopologyMapInsufficientFailureDomains(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	node := nodeList.Items[0].DeepCopy()
+	node.Name = "node4"
+	node.Labels[hostnameLabel] = "node4"
+	nodeList.Items = append(nodeList.Items, *node)
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Spec.StorageDeviceSets = []api.StorageDeviceSet{{Replica: 4}}
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.EqualError(t, err, "Not enough failure domain values found: the zone failure domain has 3 values, at least 4 are required for the replicas")
+	condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionTopologyReady)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, "InsufficientFailureDomains", condition.Reason)
+
+	// a committed failure domain is not validated again
+	sc.Status.FailureDomain = "zone"
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+}
+
+func TestNodesPerFailureDomain(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	nodeList.Items[2].Labels[zoneTopologyLabel] = "zone1"
+	for i, rack := range []string{"rack0", "rack1", ""} {
+		if rack != "" {
+			nodeList.Items[i].Labels[defaults.RackTopologyKey] = rack
+		}
+	}
+
+	assert.Equal(t, map[string]int{"zone1": 2, "zone2": 1}, nodesPerFailureDomain(nodeList, "zone", ""))
+	// nodes without a rack are not counted
+	assert.Equal(t, map[string]int{"rack0": 1, "rack1": 1}, nodesPerFailureDomain(nodeList, "rack", ""))
+	assert.Equal(t, map[string]int{"node1": 1, "node2": 1, "node3": 1}, nodesPerFailureDomain(nodeList, "host", ""))
+	assert.Empty(t, nodesPerFailureDomain(nodeList, "datacenter", ""))
+
+	topologyMap := api.NewNodeTopologyMap()
+	for _, zone := range []string{"zone3", "zone1", "zone2", "zone0"} {
+		topologyMap.Add(zoneTopologyLabel, zone)
+	}
+	assert.Equal(t, []string{"zone0", "zone3"}, getEmptyFailureDomains(topologyMap, "zone", "", nodesPerFailureDomain(nodeList, "zone", "")))
+	assert.Empty(t, getEmptyFailureDomains(topologyMap, "host", "", nodesPerFailureDomain(nodeList, "host", "")))
+
+	// the zones of the preferred zone label are used by both
+	vendorZoneLabel := "acme.io/zone"
+	for i, zone := range []string{"a", "b", "a"} {
+		nodeList.Items[i].Labels[vendorZoneLabel] = zone
+	}
+	topologyMap.Add(vendorZoneLabel, "a")
+	topologyMap.Add(vendorZoneLabel, "b")
+	topologyMap.Add(vendorZoneLabel, "c")
+	assert.Equal(t, map[string]int{"a": 2, "b": 1}, nodesPerFailureDomain(nodeList, "zone", vendorZoneLabel))
+	assert.Equal(t, []string{"c"}, getEmptyFailureDomains(topologyMap, "zone", vendorZoneLabel, nodesPerFailureDomain(nodeList, "zone", vendorZoneLabel)))
+}
+
+func TestGetStorageClusterFieldSelector(t *testing.T) {
+	sc := &api.StorageCluster{}
+	selector, err := getStorageClusterFieldSelector(sc)
+	assert.NoError(t, err)
+	assert.True(t, selector.Empty())
+
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{FieldSelector: "metadata.name=node1"}
+	selector, err = getStorageClusterFieldSelector(sc)
+	assert.NoError(t, err)
+	assert.True(t, selector.Matches(getNodeFields(mockNodeList.Items[0])))
+	assert.False(t, selector.Matches(getNodeFields(mockNodeList.Items[1])))
+
+	sc.Spec.NodeTopologies.FieldSelector = "metadata.name"
+	_, err = getStorageClusterFieldSelector(sc)
+	assert.EqualError(t, err, `invalid node field selector "metadata.name": invalid selector: 'metadata.name'; can't understand 'metadata.name'`)
+
+	sc.Spec.NodeTopologies.FieldSelector = "metadata.name=node1,spec.providerID=aws"
+	_, err = getStorageClusterFieldSelector(sc)
+	assert.EqualError(t, err, `invalid node field selector "metadata.name=node1,spec.providerID=aws": field "spec.providerID" is not supported for nodes, only [metadata.name spec.unschedulable] are`)
+}
+
+func TestGetStorageClusterNodesLabelSelectors(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, defaults.NodeAffinityKey)
+	}
+	nodeList.Items[0].Labels["example.com/storage"] = "ssd"
+	nodeList.Items[1].Labels["example.com/storage"] = "nvme"
+	nodeList.Items[1].Labels["example.com/tier"] = "storage"
+	nodeList.Items[2].Labels["example.com/tier"] = "storage"
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{
+		LabelSelectors: []*metav1.LabelSelector{
+			{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "example.com/storage", Operator: metav1.LabelSelectorOpExists},
+			}},
+			{MatchLabels: map[string]string{"example.com/tier": "storage"}},
+		},
+	}
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	nodes, err := reconciler.getStorageClusterNodes(context.TODO(), sc)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, node := range nodes.Items {
+		names = append(names, node.Name)
+	}
+	// node2 matches both selectors, but is listed once
+	assert.ElementsMatch(t, []string{"node1", "node2", "node3"}, names)
+
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, reconciler.nodeCount)
+	assert.Equal(t, "example.com/storage || example.com/tier=storage", sc.Status.NodeLabelSelector)
+
+	// the label selector of the StorageCluster adds to the selectors
+	sc.Spec.LabelSelector = &metav1.LabelSelector{MatchLabels: map[string]string{hostnameLabel: "node1"}}
+	sc.Spec.NodeTopologies.LabelSelectors = sc.Spec.NodeTopologies.LabelSelectors[1:]
+	nodes, err = reconciler.getStorageClusterNodes(context.TODO(), sc)
+	assert.NoError(t, err)
+	assert.Len(t, nodes.Items, 3)
+
+	// without any selector, the default storage node label is used
+	sc.Spec.LabelSelector = nil
+	sc.Spec.NodeTopologies = nil
+	nodes, err = reconciler.getStorageClusterNodes(context.TODO(), sc)
+	assert.NoError(t, err)
+	assert.Empty(t, nodes.Items)
+}
+
+func TestGetStorageClusterEligibleNodes(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+	}
+	for i := 4; i <= 6; i++ {
+		node := nodeList.Items[0].DeepCopy()
+		node.Name = fmt.Sprintf("node%d", i)
+		node.Labels[hostnameLabel] = node.Name
+		nodeList.Items = append(nodeList.Items, *node)
+	}
+	nodeList.Items[3].Spec.Unschedulable = true
+	nodeList.Items[4].Status.Conditions[0].Status = corev1.ConditionFalse
+	nodeList.Items[5].Status.Conditions = nil
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	nodes, err := reconciler.getStorageClusterEligibleNodes(context.TODO(), sc, reconciler.reqLogger)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, node := range nodes.Items {
+		names = append(names, node.Name)
+	}
+	assert.ElementsMatch(t, []string{"node1", "node2", "node3"}, names)
+
+	// the nodes left out are not given a rack
+	err = reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, reconciler.nodeCount)
+	for _, name := range []string{"node4", "node5", "node6"} {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: name}, node)
+		assert.NoError(t, err)
+		assert.NotContains(t, node.Labels, defaults.RackTopologyKey)
+	}
+
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{IncludeNotReadyNodes: true}
+	nodes, err = reconciler.getStorageClusterEligibleNodes(context.TODO(), sc, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.Len(t, nodes.Items, 6)
+}
+
+func TestNodeTopologyMapParentFailureDomain(t *testing.T) {
+	regionLabel := "topology.kubernetes.io/region"
+	nodeList := mockNodeList.DeepCopy()
+	for i, region := range []string{"region1", "region1", "region2"} {
+		nodeList.Items[i].Labels[regionLabel] = region
+	}
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, "zone", determineFailureDomain(sc))
+	assert.Equal(t, "region", sc.Status.ParentFailureDomain)
+
+	// a single region keeps a single level failure domain
+	sc.Status.NodeTopologies.Labels[regionLabel] = api.TopologyLabelValues{"region1"}
+	assert.Equal(t, "", determineParentFailureDomain(sc))
+
+	// so do racks
+	sc.Status.NodeTopologies.Labels[regionLabel] = api.TopologyLabelValues{"region1", "region2"}
+	sc.Status.FailureDomain = "rack"
+	assert.Equal(t, "", determineParentFailureDomain(sc))
+}
+
+func TestNodeTopologyMapAdminManagedRacks(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+	}
+	for i := 4; i <= 5; i++ {
+		node := nodeList.Items[0].DeepCopy()
+		node.Name = fmt.Sprintf("node%d", i)
+		node.Labels[hostnameLabel] = node.Name
+		nodeList.Items = append(nodeList.Items, *node)
+	}
+	nodeList.Items[0].Labels[defaults.RackTopologyKey] = "rack-a"
+	nodeList.Items[1].Labels[defaults.RackTopologyKey] = "east17"
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	for i := 0; i < 3; i++ {
+		err := reconcileTestNodeTopologyMap(&reconciler, sc)
+		assert.NoError(t, err)
+
+		racks := map[string][]string{}
+		for _, n := range nodeList.Items {
+			node := &corev1.Node{}
+			err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+			assert.NoError(t, err)
+			rack := node.Labels[defaults.RackTopologyKey]
+			racks[rack] = append(racks[rack], node.Name)
+		}
+		assert.Equal(t, map[string][]string{
+			"rack-a": {"node1"},
+			"east17": {"node2"},
+			"rack0":  {"node3"},
+			"rack1":  {"node4"},
+			"rack2":  {"node5"},
+		}, racks, "reconcile %d", i)
+	}
+}
+
+func TestIsGeneratedRack(t *testing.T) {
+	assert.True(t, isGeneratedRack("rack0", "rack"))
+	assert.True(t, isGeneratedRack("rack12", "rack"))
+	assert.True(t, isGeneratedRack("dc1-r3", "dc1-r"))
+	assert.False(t, isGeneratedRack("rack", "rack"))
+	assert.False(t, isGeneratedRack("rack-a", "rack"))
+	assert.False(t, isGeneratedRack("rack-1", "rack"))
+	assert.False(t, isGeneratedRack("east17", "rack"))
+	assert.False(t, isGeneratedRack("dc1-r3", "rack"))
+}
+
+func TestNodeTopologyMapRebuildTopologyMap(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{RebuildTopologyMap: true}
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	sc.Status.NodeTopologies.Add(zoneTopologyLabel, "zone4")
+	sc.Status.NodeTopologies.Add(defaults.RackTopologyKey, "rack0")
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	_, zones := sc.Status.NodeTopologies.GetKeyValues(zoneTopologyLabel)
+	assert.ElementsMatch(t, []string{"zone1", "zone2", "zone3"}, zones)
+	assert.NotContains(t, sc.Status.NodeTopologies.Labels, defaults.RackTopologyKey)
+
+	// the racks generated for the nodes are kept
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+	}
+	sc = &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{RebuildTopologyMap: true}
+	reconciler = createFakeStorageClusterReconciler(t, sc, nodeList)
+	for i := 0; i < 2; i++ {
+		err = reconcileTestNodeTopologyMap(&reconciler, sc)
+		assert.NoError(t, err)
+		_, racks := sc.Status.NodeTopologies.GetKeyValues(defaults.RackTopologyKey)
+		assert.ElementsMatch(t, []string{"rack0", "rack1", "rack2"}, racks)
+	}
+}
+
+func TestDiffTopologyMaps(t *testing.T) {
+	previous := api.NewNodeTopologyMap()
+	previous.Add(zoneTopologyLabel, "zone1")
+	previous.Add(zoneTopologyLabel, "zone2")
+	current := api.NewNodeTopologyMap()
+	current.Add(zoneTopologyLabel, "zone2")
+	current.Add(defaults.RackTopologyKey, "rack0")
+
+	added, removed := diffTopologyMaps(previous, current)
+	assert.Equal(t, []string{defaults.RackTopologyKey + "=rack0"}, added)
+	assert.Equal(t, []string{zoneTopologyLabel + "=zone1"}, removed)
+}
+
+func TestEnsureNodeRacksPatchesEveryNode(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+	}
+
+	reconciler := createFakeStorageClusterReconciler(t, nodeList.DeepCopy())
+	nodeRacks := api.NewNodeTopologyMap()
+	topologyMap := api.NewNodeTopologyMap()
+
+	assignments, err := reconciler.ensureNodeRacks(context.TODO(), nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, nodeRacks, topologyMap, defaultNodePatchConcurrency, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.Len(t, assignments, 3)
+
+	racks := map[string]bool{}
+	for i, assignment := range assignments {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: assignment.Node}, node)
+		assert.NoError(t, err)
+		assert.Equal(t, assignment.Rack, node.Labels[defaults.RackTopologyKey])
+		// the patched node of the list is the one which was assigned
+		assert.Equal(t, assignment.Node, nodeList.Items[i].Name)
+		assert.Equal(t, assignment.Rack, nodeList.Items[i].Labels[defaults.RackTopologyKey])
+		racks[assignment.Rack] = true
+	}
+	assert.Len(t, racks, 3)
+}
+
+func TestDeterminePlacementRackZoneSpread(t *testing.T) {
+	newNodeList := func(names []string) *corev1.NodeList {
+		nodeList := &corev1.NodeList{}
+		for _, name := range names {
+			zone := "zone1"
+			if strings.HasPrefix(name, "b") {
+				zone = "zone2"
+			}
+			nodeList.Items = append(nodeList.Items, corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   name,
+					Labels: map[string]string{hostnameLabel: name, zoneTopologyLabel: zone},
+				},
+			})
+		}
+		return nodeList
+	}
+
+	for _, names := range [][]string{
+		{"a0", "a1", "a2", "a3", "b0", "b1"},
+		{"a0", "b0", "a1", "b1", "a2", "a3"},
+		{"b1", "b0", "a3", "a2", "a1", "a0"},
+	} {
+		nodeList := newNodeList(names)
+		plan, err := planNodeRacks(nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, api.NewNodeTopologyMap(), logt)
+		assert.NoError(t, err)
+		again, err := planNodeRacks(nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, api.NewNodeTopologyMap(), logt)
+		assert.NoError(t, err)
+		assert.Equalf(t, plan, again, "%v: rack placement is not deterministic", names)
+
+		// 3 racks for 4 nodes of zone1 and 2 nodes of zone2, every
+		// rack holds 2 nodes of a single zone
+		rackNodes := map[string][]string{}
+		for _, name := range names {
+			rackNodes[plan[name]] = append(rackNodes[plan[name]], name)
+		}
+		assert.Lenf(t, rackNodes, 3, "%v: unexpected racks %v", names, rackNodes)
+		for rack, nodeNames := range rackNodes {
+			assert.Lenf(t, nodeNames, 2, "%v: uneven rack %s", names, rack)
+			assert.Equalf(t, nodeNames[0][0], nodeNames[1][0], "%v: rack %s spans zones", names, rack)
+		}
+	}
+}
+
+func TestGetZoneRackShares(t *testing.T) {
+	nodesByName := map[string]corev1.Node{}
+	for i, zone := range []string{"zone1", "zone1", "zone1", "zone2", "zone2", "zone2", ""} {
+		name := fmt.Sprintf("node%d", i)
+		node := corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{hostnameLabel: name}}}
+		if zone != "" {
+			node.Labels[zoneTopologyLabel] = zone
+		}
+		nodesByName[name] = node
+	}
+
+	assert.Equal(t, map[string]int{"zone1": 2, "zone2": 1}, getZoneRackShares(nodesByName, 3, validTopologyLabelKeys))
+	assert.Equal(t, map[string]int{"zone1": 2, "zone2": 2}, getZoneRackShares(nodesByName, 4, validTopologyLabelKeys))
+	assert.Equal(t, map[string]int{"zone1": 1, "zone2": 0}, getZoneRackShares(nodesByName, 1, validTopologyLabelKeys))
+	assert.Empty(t, getZoneRackShares(map[string]corev1.Node{}, 3, validTopologyLabelKeys))
+}
+
+func TestPlanNodeRacksMatchesEnsureNodeRacks(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+	}
+	nodeList.Items[1].Labels[defaults.RackTopologyKey] = "rack0"
+	nodeRacks := api.NewNodeTopologyMap()
+	nodeRacks.Add("rack0", nodeList.Items[1].Name)
+
+	reconciler := createFakeStorageClusterReconciler(t, nodeList.DeepCopy())
+	plan, err := planNodeRacks(nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, nodeRacks, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.Len(t, plan, 2)
+	assert.NotContains(t, plan, nodeList.Items[1].Name)
+	// planning leaves the racks untouched
+	assert.Len(t, nodeRacks.Labels, 1)
+
+	assignments, err := reconciler.ensureNodeRacks(context.TODO(), nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, nodeRacks, api.NewNodeTopologyMap(), defaultNodePatchConcurrency, reconciler.reqLogger)
+	assert.NoError(t, err)
+	applied := map[string]string{}
+	for _, assignment := range assignments {
+		applied[assignment.Node] = assignment.Rack
+	}
+	assert.Equal(t, plan, applied)
+}
+
+func TestNodeTopologyMapDryRunRackAssignment(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+	}
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{DryRunRackAssignment: true}
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.NotContains(t, sc.Status.NodeTopologies.Labels, defaults.RackTopologyKey)
+
+	for _, n := range nodeList.Items {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+		assert.NoError(t, err)
+		assert.NotContains(t, node.Labels, defaults.RackTopologyKey)
+	}
+}
+
+func TestIsCSITopologyLabel(t *testing.T) {
+	assert.True(t, isCSITopologyLabel("topology.rbd.csi.ceph.com/rack"))
+	assert.True(t, isCSITopologyLabel("topology.ebs.csi.aws.com/zone"))
+	assert.False(t, isCSITopologyLabel("topology.rook.io/rack"))
+	assert.False(t, isCSITopologyLabel("topology.kubernetes.io/zone"))
+	assert.False(t, isCSITopologyLabel("csi.example.com/rack"))
+	assert.False(t, isCSITopologyLabel("rack"))
+}
+
+func TestNodeTopologyMapCSIRackLabel(t *testing.T) {
+	csiRackLabel := "topology.rbd.csi.ceph.com/rack"
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+	}
+	nodeList.Items[0].Labels[csiRackLabel] = "r7"
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	assert.True(t, sc.Status.NodeTopologies.Contains(csiRackLabel, "r7"))
+	assert.True(t, sc.Status.NodeTopologies.Contains(defaults.RackTopologyKey, "r7"))
+
+	node := &corev1.Node{}
+	err = reconciler.client.Get(nil, types.NamespacedName{Name: nodeList.Items[0].Name}, node)
+	assert.NoError(t, err)
+	assert.Equal(t, "r7", node.Labels[defaults.RackTopologyKey])
+
+	for _, n := range nodeList.Items[1:] {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+		assert.NoError(t, err)
+		assert.Contains(t, node.Labels, defaults.RackTopologyKey)
+		assert.NotEqual(t, "r7", node.Labels[defaults.RackTopologyKey])
+	}
+}
+
+func TestSetTopologyReadyCondition(t *testing.T) {
+	sc := &api.StorageCluster{}
+	sc.Status.FailureDomain = "zone"
+
+	assert.True(t, setTopologyReadyCondition(sc, corev1.ConditionFalse, "WaitingForNodes", 2, "3 storage nodes are required"))
+	condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionTopologyReady)
+	assert.NotNil(t, condition)
+	assert.Equal(t, `Found 2 storage nodes, failure domain is "zone": 3 storage nodes are required`, condition.Message)
+	waitingSince := metav1.NewTime(time.Now().Add(-time.Hour))
+	condition.LastTransitionTime = waitingSince
+
+	// the same condition is left untouched
+	assert.False(t, setTopologyReadyCondition(sc, corev1.ConditionFalse, "WaitingForNodes", 2, "3 storage nodes are required"))
+	// a new message keeps the transition time of the status
+	assert.True(t, setTopologyReadyCondition(sc, corev1.ConditionFalse, "WaitingForNodes", 1, "3 storage nodes are required"))
+	condition = conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionTopologyReady)
+	assert.Equal(t, waitingSince, condition.LastTransitionTime)
+
+	assert.True(t, setTopologyReadyCondition(sc, corev1.ConditionTrue, "TopologyReconciled", 3, ""))
+	condition = conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionTopologyReady)
+	assert.Equal(t, corev1.ConditionTrue, condition.Status)
+	assert.Equal(t, `Found 3 storage nodes, failure domain is "zone"`, condition.Message)
+	assert.True(t, condition.LastTransitionTime.After(waitingSince.Time))
+}
+
+func TestNodeTopologyMapTopologyReady(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	reconciler := createFakeStorageClusterReconciler(t, sc, mockNodeList.DeepCopy())
+
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	condition := conditionsv1.FindStatusCondition(sc.Status.Conditions, api.ConditionTopologyReady)
+	assert.NotNil(t, condition)
+	assert.Equal(t, corev1.ConditionTrue, condition.Status)
+	assert.Equal(t, "TopologyReconciled", condition.Reason)
+	assert.Equal(t, `Found 3 storage nodes, failure domain is "zone"`, condition.Message)
+}
+
+func TestPlanRackRebalance(t *testing.T) {
+	nodeList := &corev1.NodeList{}
+	nodeRacks := api.NewNodeTopologyMap()
+	addNode := func(name, zone, rack string) {
+		labels := map[string]string{hostnameLabel: name, defaults.RackTopologyKey: rack}
+		if zone != "" {
+			labels[zoneTopologyLabel] = zone
+		}
+		nodeList.Items = append(nodeList.Items, corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}})
+		nodeRacks.Add(rack, name)
+	}
+	for i := 0; i < 6; i++ {
+		addNode(fmt.Sprintf("a%d", i), "zone1", "rack0")
+	}
+	addNode("b0", "zone1", "rack1")
+	// racks of other zones and racks managed by the admin are left alone
+	addNode("c0", "zone2", "rack2")
+	for i := 0; i < 6; i++ {
+		addNode(fmt.Sprintf("d%d", i), "zone2", "admin")
+	}
+
+	moves := planRackRebalance(nodeList, nodeRacks, defaultRackPrefix, 2)
+	assert.Equal(t, []nodeRackAssignment{{Node: "a4", Rack: "rack1"}, {Node: "a5", Rack: "rack1"}}, moves)
+	assert.Empty(t, planRackRebalance(nodeList, nodeRacks, defaultRackPrefix, 6))
+	// the racks are left untouched
+	assert.Len(t, nodeRacks.Labels["rack0"], 6)
+
+	sc := &api.StorageCluster{}
+	assert.Equal(t, defaultRackRebalanceRatio, getRackRebalanceRatio(sc))
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{RackRebalanceRatio: 3}
+	assert.Equal(t, 3, getRackRebalanceRatio(sc))
+}
+
+func TestNodeTopologyMapAutoRebalanceRacks(t *testing.T) {
+	nodeList := &corev1.NodeList{}
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("node%d", i)
+		rack := "rack0"
+		if i >= 4 {
+			rack = fmt.Sprintf("rack%d", i-3)
+		}
+		nodeList.Items = append(nodeList.Items, corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{hostnameLabel: name, defaults.NodeAffinityKey: "", defaults.RackTopologyKey: rack},
+			},
+			Status: mockNodeList.Items[0].Status,
+		})
+	}
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Spec.NodeTopologies = &api.NodeTopologySpec{AutoRebalanceRacks: true}
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+
+	racks := map[string]int{}
+	for _, n := range nodeList.Items {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+		assert.NoError(t, err)
+		racks[node.Labels[defaults.RackTopologyKey]]++
+	}
+	assert.Equal(t, map[string]int{"rack0": 2, "rack1": 2, "rack2": 2}, racks)
+}
+
+func TestDeterminePlacementRackNoValidRack(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	nodeRacks := api.NewNodeTopologyMap()
+	for i := range nodeList.Items {
+		nodeRacks.Add(fmt.Sprintf("rack%d", i), nodeList.Items[i].Name)
+	}
+	node := corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node4",
+			Labels: map[string]string{hostnameLabel: "node4", zoneTopologyLabel: "zone4"},
+		},
+	}
+	nodeList.Items = append(nodeList.Items, node)
+
+	// every rack holds a node of another zone
+	rack := determinePlacementRack(getNodesByName(nodeList), node, 3, 0, defaultRackPrefix, validTopologyLabelKeys, "", nodeRacks)
+	assert.Equal(t, "rack3", rack)
+	assert.Contains(t, nodeRacks.Labels, "rack3")
+}
+
+func TestDeterminePlacementRackCapacity(t *testing.T) {
+	const capacityLabel = "ocs.openshift.io/storage-capacity"
+	newNode := func(name, zone, capacity string) corev1.Node {
+		return corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{hostnameLabel: name, zoneTopologyLabel: zone, capacityLabel: capacity},
+			},
+		}
+	}
+	nodeList := &corev1.NodeList{Items: []corev1.Node{
+		newNode("big", "zone1", "10Ti"),
+		newNode("small1", "zone1", "1Ti"),
+		newNode("small2", "zone1", "1Ti"),
+		newNode("other", "zone2", "1Ti"),
+	}}
+	nodeRacks := api.NewNodeTopologyMap()
+	nodeRacks.Add("rack0", "big")
+	nodeRacks.Add("rack1", "small1")
+	nodeRacks.Add("rack1", "small2")
+	nodeRacks.Add("rack2", "other")
+	node := newNode("node5", "zone1", "2Ti")
+	nodeList.Items = append(nodeList.Items, node)
+	nodesByName := getNodesByName(nodeList)
+
+	// counting the nodes puts three small nodes on par with a big one
+	rack := determinePlacementRack(nodesByName, node, 3, 0, defaultRackPrefix, validTopologyLabelKeys, "", nodeRacks.DeepCopy())
+	assert.Equal(t, "rack0", rack)
+
+	// the rack of the other zone holds the least capacity but is skipped
+	rack = determinePlacementRack(nodesByName, node, 3, 0, defaultRackPrefix, validTopologyLabelKeys, capacityLabel, nodeRacks.DeepCopy())
+	assert.Equal(t, "rack1", rack)
+
+	// the capacity may be an allocatable resource of the nodes
+	for name, storage := range map[string]string{"big": "100Gi", "small1": "500Gi", "small2": "500Gi"} {
+		node := nodesByName[name]
+		node.Status.Allocatable = corev1.ResourceList{corev1.ResourceEphemeralStorage: resource.MustParse(storage)}
+		nodesByName[name] = node
+	}
+	rack = determinePlacementRack(nodesByName, node, 3, 0, defaultRackPrefix, validTopologyLabelKeys, string(corev1.ResourceEphemeralStorage), nodeRacks.DeepCopy())
+	assert.Equal(t, "rack0", rack)
+}
+
+func TestGetNodeCapacity(t *testing.T) {
+	node := corev1.Node{}
+	node.Labels = map[string]string{"capacity": "1Ki", "invalid": "lots"}
+	node.Status.Allocatable = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")}
+
+	assert.Equal(t, int64(1024000), getNodeCapacity(node, "capacity"))
+	assert.Equal(t, int64(500), getNodeCapacity(node, string(corev1.ResourceCPU)))
+	assert.Equal(t, int64(0), getNodeCapacity(node, "invalid"))
+	assert.Equal(t, int64(0), getNodeCapacity(node, "missing"))
+}
+
+func TestDeterminePlacementRackMatchesScan(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	extraNodes := []corev1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "node4",
+				Labels: map[string]string{hostnameLabel: "node4", zoneTopologyLabel: "zone1"},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "node5",
+				Labels: map[string]string{hostnameLabel: "node5", zoneTopologyLabel: "zone4"},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "node6",
+				Labels: map[string]string{hostnameLabel: "node6"},
+			},
+		},
+	}
+	nodeList.Items = append(nodeList.Items, extraNodes...)
+
+	cases := []struct {
+		label     string
+		node      string
+		minRacks  int
+		nodeRacks map[string][]string
+	}{
+		{
+			label:     "Case 1", // no racks yet
+			node:      "node1",
+			minRacks:  3,
+			nodeRacks: map[string][]string{},
+		},
+		{
+			label:     "Case 2", // fewer racks than minRacks
+			node:      "node2",
+			minRacks:  3,
+			nodeRacks: map[string][]string{"rack0": {"node1"}},
+		},
+		{
+			label:    "Case 3", // a rack of the same zone is valid
+			node:     "node4",
+			minRacks: 3,
+			nodeRacks: map[string][]string{
+				"rack0": {"node1"},
+				"rack1": {"node2"},
+				"rack2": {"node3"},
+			},
+		},
+		{
+			label:    "Case 4", // no rack of the node's zone
+			node:     "node5",
+			minRacks: 3,
+			nodeRacks: map[string][]string{
+				"rack0": {"node1"},
+				"rack1": {"node2"},
+				"rack2": {"node3"},
+			},
+		},
+		{
+			label:    "Case 5", // racks holding unknown nodes
+			node:     "node4",
+			minRacks: 2,
+			nodeRacks: map[string][]string{
+				"rack0": {"gone", "node1"},
+				"rack1": {"node2", "node3"},
+			},
+		},
+		{
+			label:    "Case 6", // node without a zone label
+			node:     "node6",
+			minRacks: 2,
+			nodeRacks: map[string][]string{
+				"rack0": {"node1"},
+				"rack1": {"node2", "node4"},
+				"rack2": {},
+			},
+		},
+	}
+
+	nodesByName := getNodesByName(nodeList)
+	for _, c := range cases {
+		scanRacks := &api.NodeTopologyMap{Labels: map[string]api.TopologyLabelValues{}}
+		indexedRacks := &api.NodeTopologyMap{Labels: map[string]api.TopologyLabelValues{}}
+		for rack, nodeNames := range c.nodeRacks {
+			scanRacks.Labels[rack] = append(api.TopologyLabelValues{}, nodeNames...)
+			indexedRacks.Labels[rack] = append(api.TopologyLabelValues{}, nodeNames...)
+		}
+		node := nodesByName[c.node]
+
+		expected := determinePlacementRackScan(nodeList, node, c.minRacks, defaultRackPrefix, scanRacks)
+		actual := determinePlacementRack(nodesByName, node, c.minRacks, 0, defaultRackPrefix, validTopologyLabelKeys, "", indexedRacks)
+		assert.Equalf(t, expected, actual, "[%s]: rack selection differs", c.label)
+		assert.Equalf(t, scanRacks, indexedRacks, "[%s]: rack map differs", c.label)
+	}
+}
+
+func TestNodeTopologyMapPruneStaleRacks(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+		nodeList.Items[i].Labels[defaults.RackTopologyKey] = fmt.Sprintf("rack%d", i)
+	}
+	// node4 left the StorageCluster, but is still in the cluster
+	nodeList.Items = append(nodeList.Items, corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node4",
+			Labels: map[string]string{hostnameLabel: "node4", defaults.RackTopologyKey: "rack3"},
+		},
+	})
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	for _, rack := range []string{"rack0", "rack1", "rack2", "rack3"} {
+		sc.Status.NodeTopologies.Add(defaults.RackTopologyKey, rack)
+	}
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	err := reconcileTestNodeTopologyMap(&reconciler, sc)
+	assert.NoError(t, err)
+	_, racks := sc.Status.NodeTopologies.GetKeyValues(defaults.RackTopologyKey)
+	assert.ElementsMatch(t, []string{"rack0", "rack1", "rack2"}, racks)
+
+	// the rack labels of the nodes are kept
+	for _, n := range nodeList.Items {
+		node := &corev1.Node{}
+		err = reconciler.client.Get(nil, types.NamespacedName{Name: n.Name}, node)
+		assert.NoError(t, err)
+		assert.Equal(t, n.Labels[defaults.RackTopologyKey], node.Labels[defaults.RackTopologyKey])
+	}
+
+	// the rack label is removed from the map along with its last rack
+	assert.True(t, pruneStaleRacks(sc, api.NewNodeTopologyMap(), reconciler.reqLogger))
+	assert.NotContains(t, sc.Status.NodeTopologies.Labels, defaults.RackTopologyKey)
+	assert.False(t, pruneStaleRacks(sc, api.NewNodeTopologyMap(), reconciler.reqLogger))
+}
+
+func BenchmarkEnsureNodeRacks(b *testing.B) {
+	nodeList := &corev1.NodeList{}
+	nodeRacks := api.NewNodeTopologyMap()
+	topologyMap := api.NewNodeTopologyMap()
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("node%d", i)
+		rack := fmt.Sprintf("rack%d", i%10)
+		nodeList.Items = append(nodeList.Items, corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{hostnameLabel: name, defaults.RackTopologyKey: rack},
+			},
+		})
+		nodeRacks.Add(rack, name)
+		if !topologyMap.Contains(defaults.RackTopologyKey, rack) {
+			topologyMap.Add(defaults.RackTopologyKey, rack)
+		}
+	}
+	reconciler := ReconcileStorageCluster{reqLogger: logf.Log.WithName("topology_test")}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := reconciler.ensureNodeRacks(context.TODO(), nodeList, 3, 0, 0, defaultRackPrefix, validTopologyLabelKeys, "", nil, nodeRacks, topologyMap, defaultNodePatchConcurrency, reconciler.reqLogger)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// determinePlacementRackScan is the former implementation of
+// determinePlacementRack, which scanned the node list for every rack member.
+func determinePlacementRackScan(nodes *corev1.NodeList, node corev1.Node, minRacks int, rackPrefix string, nodeRacks *api.NodeTopologyMap) string {
+	rackList := []string{}
+
+	if len(nodeRacks.Labels) < minRacks {
+		for i := len(nodeRacks.Labels); i < minRacks; i++ {
+			for j := 0; j <= i; j++ {
+				newRack := fmt.Sprintf("%s%d", rackPrefix, j)
+				if _, ok := nodeRacks.Labels[newRack]; !ok {
+					nodeRacks.Labels[newRack] = api.TopologyLabelValues{}
+					break
+				}
+			}
+		}
+	}
+
+	targetAZ := ""
+	for label, value := range node.Labels {
+		for _, key := range validTopologyLabelKeys {
+			if strings.Contains(label, key) && strings.Contains(label, "zone") {
+				targetAZ = value
+				break
+			}
+		}
+		if targetAZ != "" {
+			break
+		}
+	}
+
+	if len(targetAZ) > 0 {
+		for rack := range nodeRacks.Labels {
+			nodeNames := nodeRacks.Labels[rack]
+			if len(nodeNames) == 0 {
+				rackList = append(rackList, rack)
+				continue
+			}
+
+			validRack := false
+			for _, nodeName := range nodeNames {
+				for _, n := range nodes.Items {
+					if n.Name == nodeName {
+						for label, value := range n.Labels {
+							for _, key := range validTopologyLabelKeys {
+								if strings.Contains(label, key) && strings.Contains(label, "zone") && value == targetAZ {
+									validRack = true
+									break
+								}
+							}
+							if validRack {
+								break
+							}
+						}
+						break
+					}
+				}
+				if validRack {
+					break
+				}
+			}
+			if validRack {
+				rackList = append(rackList, rack)
+			}
+		}
+	} else {
+		for rack := range nodeRacks.Labels {
+			rackList = append(rackList, rack)
+		}
+	}
+
+	// all the racks hold nodes from other zones
+	if len(rackList) == 0 {
+		return getEmptyRack(nodeRacks, rackPrefix)
+	}
+
+	sort.Strings(rackList)
+	rack := rackList[0]
+
+	for _, r := range rackList {
+		if len(nodeRacks.Labels[r]) < len(nodeRacks.Labels[rack]) {
+			rack = r
+		}
+	}
+
+	return rack
+}
+
+func TestGetKeyValuesDeterministic(t *testing.T) {
+	topologyMap := api.NewNodeTopologyMap()
+	for _, zone := range []string{"zone3", "zone1", "zone2"} {
+		topologyMap.Add(zoneTopologyLabel, zone)
+	}
+	topologyMap.Add("failure-domain.beta.kubernetes.io/zone", "zone9")
+
+	label, values := topologyMap.GetKeyValues("zone")
+	assert.Equal(t, "failure-domain.beta.kubernetes.io/zone", label)
+	assert.Equal(t, []string{"zone9"}, values)
+
+	for i := 0; i < 10; i++ {
+		l, v := topologyMap.GetKeyValues(zoneTopologyLabel)
+		assert.Equal(t, zoneTopologyLabel, l)
+		assert.Equal(t, []string{"zone1", "zone2", "zone3"}, v)
+	}
+	// the stored values are left untouched
+	assert.Equal(t, api.TopologyLabelValues{"zone3", "zone1", "zone2"}, topologyMap.Labels[zoneTopologyLabel])
+}
+
+func TestGetKeyValuesLabelNameSuffix(t *testing.T) {
+	topologyMap := api.NewNodeTopologyMap()
+	topologyMap.Add("acme.io/dezoned", "d1")
+	topologyMap.Add("acme.io/powerzone", "p1")
+
+	// "acme.io/dezoned" sorts first but is not a zone label
+	label, values := topologyMap.GetKeyValues("zone")
+	assert.Equal(t, "acme.io/powerzone", label)
+	assert.Equal(t, []string{"p1"}, values)
+
+	topologyMap = api.NewNodeTopologyMap()
+	topologyMap.Add("myapp.io/brackets", "b1")
+	label, values = topologyMap.GetKeyValues("rack")
+	assert.Equal(t, "rack", label)
+	assert.Equal(t, []string{}, values)
+}
+
+func TestNodeZoneLabelPreference(t *testing.T) {
+	node := corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{
+				"failure-domain.kubernetes.io/dezoned":  "d1",
+				"failure-domain.kubernetes.io/zone":     "zone-a",
+				corev1.LabelZoneFailureDomain:           "zone-b",
+				corev1.LabelZoneFailureDomainStable:     "zone-c",
+				"topology.rook.io/powerzone":            "zone-d",
+				"failure-domain.beta.kubernetes.io/foo": "f1",
+			},
+		},
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "zone-c", nodeZone(node))
+	}
+
+	delete(node.Labels, corev1.LabelZoneFailureDomainStable)
+	assert.Equal(t, "zone-b", nodeZone(node))
+	delete(node.Labels, corev1.LabelZoneFailureDomain)
+	assert.Equal(t, "zone-a", nodeZone(node))
+	delete(node.Labels, "failure-domain.kubernetes.io/zone")
+	assert.Equal(t, "zone-d", nodeZone(node))
+	delete(node.Labels, "topology.rook.io/powerzone")
+	assert.Equal(t, "", nodeZone(node))
+}
+
+func TestEnsureTopologyConfigMap(t *testing.T) {
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	sc.Status.NodeTopologies.Add(zoneTopologyLabel, "zone1")
+
+	reconciler := createFakeStorageClusterReconciler(t, sc)
+	getConfigMap := func() *corev1.ConfigMap {
+		cm := &corev1.ConfigMap{}
+		err := reconciler.client.Get(nil, types.NamespacedName{Name: getTopologyConfigMapName(sc), Namespace: sc.Namespace}, cm)
+		assert.NoError(t, err)
+		return cm
+	}
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, reconciler.ensureTopologyConfigMap(context.TODO(), sc, reconciler.reqLogger))
+		cm := getConfigMap()
+		assert.Equal(t, "1", cm.Annotations[topologyGenerationAnnotation])
+		topologyMap := &api.NodeTopologyMap{}
+		assert.NoError(t, json.Unmarshal([]byte(cm.Data[topologyConfigMapKey]), topologyMap))
+		assert.Equal(t, sc.Status.NodeTopologies, topologyMap)
+	}
+
+	sc.Status.NodeTopologies.Add(zoneTopologyLabel, "zone2")
+	assert.NoError(t, reconciler.ensureTopologyConfigMap(context.TODO(), sc, reconciler.reqLogger))
+	cm := getConfigMap()
+	assert.Equal(t, "2", cm.Annotations[topologyGenerationAnnotation])
+	assert.Contains(t, cm.Data[topologyConfigMapKey], "zone2")
+}
+
+func TestGetPartiallyOverlappingZoneLabels(t *testing.T) {
+	topologyMap := api.NewNodeTopologyMap()
+	for _, zone := range []string{"zone1", "zone2", "zone3"} {
+		topologyMap.Add(corev1.LabelZoneFailureDomain, zone)
+		topologyMap.Add(corev1.LabelZoneFailureDomainStable, zone)
+	}
+	// identical values
+	assert.Equal(t, "", getPartiallyOverlappingZoneLabels(topologyMap))
+
+	// disjoint values
+	topologyMap.Labels[corev1.LabelZoneFailureDomainStable] = api.TopologyLabelValues{"us-east-1a", "us-east-1b"}
+	assert.Equal(t, "", getPartiallyOverlappingZoneLabels(topologyMap))
+
+	// partially overlapping values
+	topologyMap.Labels[corev1.LabelZoneFailureDomainStable] = api.TopologyLabelValues{"zone1", "us-east-1b"}
+	assert.Equal(t, fmt.Sprintf("%s and %s only share [zone1]", corev1.LabelZoneFailureDomain, corev1.LabelZoneFailureDomainStable), getPartiallyOverlappingZoneLabels(topologyMap))
+}
+
+func TestGetRedundantDeprecatedLabels(t *testing.T) {
+	cases := []struct {
+		label      string
+		deprecated []string
+		current    []string
+		redundant  bool
+	}{
+		{label: "exact match", deprecated: []string{"zone1", "zone2", "zone3"}, current: []string{"zone1", "zone2", "zone3"}, redundant: true},
+		{label: "subset", deprecated: []string{"zone1", "", ""}, current: []string{"zone1", "zone2", "zone3"}, redundant: true},
+		{label: "divergent", deprecated: []string{"zone1", "zone9", ""}, current: []string{"zone1", "zone2", "zone3"}, redundant: false},
+		{label: "no replacement", deprecated: []string{"zone1", "zone2", "zone3"}, current: []string{"", "", ""}, redundant: false},
+	}
+
+	for _, c := range cases {
+		nodeList := mockNodeList.DeepCopy()
+		for i := range nodeList.Items {
+			delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+			if c.deprecated[i] != "" {
+				nodeList.Items[i].Labels[corev1.LabelZoneFailureDomain] = c.deprecated[i]
+			}
+			if c.current[i] != "" {
+				nodeList.Items[i].Labels[corev1.LabelZoneFailureDomainStable] = c.current[i]
+			}
+		}
+		redundant := getRedundantDeprecatedLabels(nodeList)
+		assert.Equal(t, c.redundant, redundant[corev1.LabelZoneFailureDomain], c.label)
+		assert.False(t, redundant[corev1.LabelZoneFailureDomainStable], c.label)
+	}
+}
+
+func TestNodeTopologyMapFilterDeprecatedLabels(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	for i := range nodeList.Items {
+		zone := nodeList.Items[i].Labels[zoneTopologyLabel]
+		delete(nodeList.Items[i].Labels, zoneTopologyLabel)
+		nodeList.Items[i].Labels[corev1.LabelZoneFailureDomainStable] = zone
+	}
+	// only the oldest node still carries the deprecated label
+	nodeList.Items[0].Labels[corev1.LabelZoneFailureDomain] = "zone1"
+
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+	sc.Status.NodeTopologies.Add(corev1.LabelZoneFailureDomain, "zone1")
+
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+	for i := 0; i < 2; i++ {
+		err := reconcileTestNodeTopologyMap(&reconciler, sc)
+		assert.NoError(t, err)
+		assert.NotContains(t, sc.Status.NodeTopologies.Labels, corev1.LabelZoneFailureDomain)
+		assert.ElementsMatch(t, []string{"zone1", "zone2", "zone3"}, sc.Status.NodeTopologies.Labels[corev1.LabelZoneFailureDomainStable])
+		assert.Equal(t, "zone", determineFailureDomain(sc))
+	}
+}
+
+func TestGetTopologyChangeMessagePreferredZoneKey(t *testing.T) {
+	vendorZoneLabel := "acme.io/zone"
+	committed := api.NewNodeTopologyMap()
+	committed.Add(zoneTopologyLabel, "zone1")
+	committed.Add(vendorZoneLabel, "a")
+	current := api.NewNodeTopologyMap()
+	current.Add(zoneTopologyLabel, "zone1")
+	current.Add(vendorZoneLabel, "a")
+
+	assert.Empty(t, getTopologyChangeMessage("zone", committed, "zone", current, vendorZoneLabel))
+
+	current.Add(vendorZoneLabel, "b")
+	assert.Equal(t, "Node topology changed: failure domain zone [a b], was zone [a]",
+		getTopologyChangeMessage("zone", committed, "zone", current, vendorZoneLabel))
+}
+
+func TestValidateNodeTopology(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeLabelSelector = ""
+	reconciler := createFakeStorageClusterReconciler(t, sc, nodeList)
+
+	updated, err := reconciler.validateNodeTopology(context.TODO(), sc, nodeList, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	assert.Equal(t, 3, reconciler.nodeCount)
+	assert.NotEmpty(t, sc.Status.NodeLabelSelector)
+
+	// the selector is only recorded once
+	updated, err = reconciler.validateNodeTopology(context.TODO(), sc, nodeList, reconciler.reqLogger)
+	assert.NoError(t, err)
+	assert.False(t, updated)
+
+	nodeList.Items = nodeList.Items[:2]
+	_, err = reconciler.validateNodeTopology(context.TODO(), sc, nodeList, reconciler.reqLogger)
+	assert.True(t, stderrors.Is(err, ErrInsufficientNodes))
+}
+
+func TestCollectNodeTopology(t *testing.T) {
+	nodeList := mockNodeList.DeepCopy()
+	nodeList.Items[0].Labels["topology.rook.io/rack"] = "rack0"
+	nodeList.Items[1].Labels["topology.rook.io/rack"] = "rack0"
+	sc := &api.StorageCluster{}
+	mockStorageCluster.DeepCopyInto(sc)
+	sc.Status.NodeTopologies = api.NewNodeTopologyMap()
+
+	nodeRacks, topologyLabelKeys, updated := collectNodeTopology(sc, nodeList, sc.Status.NodeTopologies.DeepCopy(), logt)
+	assert.True(t, updated)
+	assert.NotEmpty(t, topologyLabelKeys)
+	assert.ElementsMatch(t, []string{"node1", "node2"}, nodeRacks.Labels["rack0"])
+	assert.ElementsMatch(t, []string{"zone1", "zone2", "zone3"}, sc.Status.NodeTopologies.Labels[zoneTopologyLabel])
+	assert.ElementsMatch(t, []string{"rack0"}, sc.Status.NodeTopologies.Labels["topology.rook.io/rack"])
+
+	_, _, updated = collectNodeTopology(sc, nodeList, sc.Status.NodeTopologies.DeepCopy(), logt)
+	assert.False(t, updated)
+}
@@ -55,7 +55,7 @@ func (r *ReconcileStorageCluster) deleteNodeAffinityKeyFromNodes(sc *ocsv1.Stora
 
 	// We should delete the label only when the StorageCluster is using the default NodeAffinityKey
 	if sc.Spec.LabelSelector == nil {
-		nodes, err := r.getStorageClusterEligibleNodes(sc, reqLogger)
+		nodes, err := r.getStorageClusterNodes(context.TODO(), sc)
 		if err != nil {
 			reqLogger.Error(err, fmt.Sprintf("Unable to obtain the list of nodes eligible for the Storage Cluster"))
 			return nil
@@ -98,7 +98,7 @@ func (r *ReconcileStorageCluster) deleteNodeAffinityKeyFromNodes(sc *ocsv1.Stora
 // deleteNodeTaint deletes the default NodeTolerationKey from the OCS nodes
 func (r *ReconcileStorageCluster) deleteNodeTaint(sc *ocsv1.StorageCluster, reqLogger logr.Logger) (err error) {
 
-	nodes, err := r.getStorageClusterEligibleNodes(sc, reqLogger)
+	nodes, err := r.getStorageClusterNodes(context.TODO(), sc)
 	if err != nil {
 		reqLogger.Error(err, fmt.Sprintf("Unable to obtain the list of nodes eligible for the Storage Cluster"))
 		return nil
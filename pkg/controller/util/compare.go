@@ -0,0 +1,45 @@
+package util
+
+import "sort"
+
+// CompareStringSlicesUnordered returns true if both slices hold the same
+// elements, each the same number of times, regardless of their order
+func CompareStringSlicesUnordered(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := make(map[string]int, len(a))
+	for _, s := range a {
+		counts[s]++
+	}
+	for _, s := range b {
+		if counts[s] == 0 {
+			return false
+		}
+		counts[s]--
+	}
+
+	return true
+}
+
+// SortedEqual returns true if both slices hold the same elements once
+// sorted. The slices are copied before sorting, so the caller's slices are
+// left untouched
+func SortedEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	sortedA := append([]string{}, a...)
+	sortedB := append([]string{}, b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,60 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareStringSlicesUnordered(t *testing.T) {
+	cases := []struct {
+		label    string
+		a        []string
+		b        []string
+		expected bool
+	}{
+		{label: "nil and empty", a: nil, b: []string{}, expected: true},
+		{label: "different lengths", a: []string{"zone1", "zone2"}, b: []string{"zone1"}, expected: false},
+		{label: "different order", a: []string{"zone2", "zone3", "zone1"}, b: []string{"zone1", "zone2", "zone3"}, expected: true},
+		{label: "different values", a: []string{"zone1", "zone2"}, b: []string{"zone1", "zone3"}, expected: false},
+		{label: "same duplicates", a: []string{"zone1", "zone2", "zone1"}, b: []string{"zone1", "zone1", "zone2"}, expected: true},
+		{label: "different duplicates", a: []string{"zone1", "zone1", "zone2"}, b: []string{"zone1", "zone2", "zone2"}, expected: false},
+		{label: "duplicates of a single value", a: []string{"zone1", "zone1"}, b: []string{"zone1", "zone2"}, expected: false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, CompareStringSlicesUnordered(c.a, c.b), c.label)
+		assert.Equal(t, c.expected, CompareStringSlicesUnordered(c.b, c.a), c.label)
+	}
+}
+
+func TestSortedEqual(t *testing.T) {
+	cases := []struct {
+		label    string
+		a        []string
+		b        []string
+		expected bool
+	}{
+		{label: "nil and empty", a: nil, b: []string{}, expected: true},
+		{label: "both nil", a: nil, b: nil, expected: true},
+		{label: "different lengths", a: []string{"zone1", "zone2"}, b: []string{"zone1"}, expected: false},
+		{label: "same order", a: []string{"zone1", "zone2"}, b: []string{"zone1", "zone2"}, expected: true},
+		{label: "different order", a: []string{"zone2", "zone3", "zone1"}, b: []string{"zone1", "zone2", "zone3"}, expected: true},
+		{label: "different values", a: []string{"zone1", "zone2"}, b: []string{"zone1", "zone3"}, expected: false},
+		{label: "different duplicates", a: []string{"zone1", "zone1", "zone2"}, b: []string{"zone1", "zone2", "zone2"}, expected: false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, SortedEqual(c.a, c.b), c.label)
+		assert.Equal(t, c.expected, SortedEqual(c.b, c.a), c.label)
+	}
+}
+
+func TestSortedEqualKeepsInputs(t *testing.T) {
+	a := []string{"zone3", "zone1", "zone2"}
+	b := []string{"zone2", "zone3", "zone1"}
+
+	assert.True(t, SortedEqual(a, b))
+	assert.Equal(t, []string{"zone3", "zone1", "zone2"}, a)
+	assert.Equal(t, []string{"zone2", "zone3", "zone1"}, b)
+}
@@ -0,0 +1,64 @@
+package util
+
+// ContainsString returns true if the slice holds the given string
+func ContainsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RemoveString returns a copy of the slice without any occurrence of the
+// given string, keeping the order of the other elements
+func RemoveString(slice []string, s string) []string {
+	result := make([]string, 0, len(slice))
+	for _, item := range slice {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+// StringSliceToSet returns the set of the strings of the slice
+func StringSliceToSet(slice []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(slice))
+	for _, item := range slice {
+		set[item] = struct{}{}
+	}
+
+	return set
+}
+
+// StringSetDifference returns the strings of a absent from b, keeping their
+// order in a
+func StringSetDifference(a, b []string) []string {
+	set := StringSliceToSet(b)
+	difference := []string{}
+	for _, item := range a {
+		if _, ok := set[item]; !ok {
+			difference = append(difference, item)
+		}
+	}
+
+	return difference
+}
+
+// StringIntersection returns the strings found in both a and b, once each,
+// keeping their order in a
+func StringIntersection(a, b []string) []string {
+	set := StringSliceToSet(b)
+	intersection := []string{}
+	for _, item := range a {
+		if _, ok := set[item]; ok {
+			intersection = append(intersection, item)
+			delete(set, item)
+		}
+	}
+
+	return intersection
+}
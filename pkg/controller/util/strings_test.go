@@ -0,0 +1,108 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainsString(t *testing.T) {
+	cases := []struct {
+		label    string
+		slice    []string
+		s        string
+		expected bool
+	}{
+		{label: "nil slice", slice: nil, s: "rack0", expected: false},
+		{label: "empty slice", slice: []string{}, s: "rack0", expected: false},
+		{label: "not found", slice: []string{"rack0", "rack1"}, s: "rack2", expected: false},
+		{label: "found", slice: []string{"rack0", "rack1"}, s: "rack1", expected: true},
+		{label: "duplicates", slice: []string{"rack1", "rack0", "rack1"}, s: "rack1", expected: true},
+		{label: "empty string", slice: []string{"rack0", ""}, s: "", expected: true},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, ContainsString(c.slice, c.s), c.label)
+	}
+}
+
+func TestRemoveString(t *testing.T) {
+	cases := []struct {
+		label    string
+		slice    []string
+		s        string
+		expected []string
+	}{
+		{label: "nil slice", slice: nil, s: "rack0", expected: []string{}},
+		{label: "empty slice", slice: []string{}, s: "rack0", expected: []string{}},
+		{label: "not found", slice: []string{"rack0", "rack1"}, s: "rack2", expected: []string{"rack0", "rack1"}},
+		{label: "found", slice: []string{"rack0", "rack1", "rack2"}, s: "rack1", expected: []string{"rack0", "rack2"}},
+		{label: "duplicates", slice: []string{"rack1", "rack0", "rack1", "rack2"}, s: "rack1", expected: []string{"rack0", "rack2"}},
+		{label: "only the string", slice: []string{"rack1", "rack1"}, s: "rack1", expected: []string{}},
+	}
+
+	for _, c := range cases {
+		original := append([]string{}, c.slice...)
+		assert.Equal(t, c.expected, RemoveString(c.slice, c.s), c.label)
+		if c.slice != nil {
+			assert.Equal(t, original, c.slice, c.label)
+		}
+	}
+}
+
+func TestStringSliceToSet(t *testing.T) {
+	cases := []struct {
+		label    string
+		slice    []string
+		expected map[string]struct{}
+	}{
+		{label: "nil slice", slice: nil, expected: map[string]struct{}{}},
+		{label: "empty slice", slice: []string{}, expected: map[string]struct{}{}},
+		{label: "distinct", slice: []string{"zone1", "zone2"}, expected: map[string]struct{}{"zone1": {}, "zone2": {}}},
+		{label: "duplicates", slice: []string{"zone1", "zone2", "zone1"}, expected: map[string]struct{}{"zone1": {}, "zone2": {}}},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, StringSliceToSet(c.slice), c.label)
+	}
+}
+
+func TestStringSetDifference(t *testing.T) {
+	cases := []struct {
+		label    string
+		a        []string
+		b        []string
+		expected []string
+	}{
+		{label: "both empty", a: []string{}, b: nil, expected: []string{}},
+		{label: "empty a", a: nil, b: []string{"zone1"}, expected: []string{}},
+		{label: "empty b", a: []string{"zone2", "zone1"}, b: nil, expected: []string{"zone2", "zone1"}},
+		{label: "disjoint", a: []string{"zone1", "zone2"}, b: []string{"zone3"}, expected: []string{"zone1", "zone2"}},
+		{label: "identical", a: []string{"zone1", "zone2"}, b: []string{"zone2", "zone1"}, expected: []string{}},
+		{label: "overlapping", a: []string{"zone3", "zone1", "zone2"}, b: []string{"zone1", "zone4"}, expected: []string{"zone3", "zone2"}},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, StringSetDifference(c.a, c.b), c.label)
+	}
+}
+
+func TestStringIntersection(t *testing.T) {
+	cases := []struct {
+		label    string
+		a        []string
+		b        []string
+		expected []string
+	}{
+		{label: "empty", a: nil, b: []string{"zone1"}, expected: []string{}},
+		{label: "disjoint", a: []string{"zone1", "zone2"}, b: []string{"zone3", "zone4"}, expected: []string{}},
+		{label: "identical", a: []string{"zone2", "zone1"}, b: []string{"zone1", "zone2"}, expected: []string{"zone2", "zone1"}},
+		{label: "partially overlapping", a: []string{"zone3", "zone1", "zone2"}, b: []string{"zone2", "zone3", "zone4"}, expected: []string{"zone3", "zone2"}},
+		{label: "duplicates in a", a: []string{"zone1", "zone2", "zone1"}, b: []string{"zone1"}, expected: []string{"zone1"}},
+		{label: "duplicates in b", a: []string{"zone2", "zone1"}, b: []string{"zone1", "zone1", "zone2"}, expected: []string{"zone2", "zone1"}},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, StringIntersection(c.a, c.b), c.label)
+	}
+}